@@ -7,56 +7,208 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// TimestampFormat описывает формат временной метки во входном файле
+type TimestampFormat struct {
+	Layout   string `yaml:"layout"`   // Шаблон time.Parse; пустой - эпоха Unix
+	Location string `yaml:"location"` // Часовой пояс для меток без зоны (UTC, Local, Europe/Moscow)
+	Unit     string `yaml:"unit"`     // Единицы эпохи Unix: s, ms, us, ns
+}
+
+// StateValues значения по блокам состояния (начальное состояние, начальная ковариация)
+type StateValues struct {
+	Position   []float64 `yaml:"position"`
+	Velocity   []float64 `yaml:"velocity"`
+	Quaternion []float64 `yaml:"quaternion"`
+	Angle      []float64 `yaml:"angle"`
+	Bias_acc   []float64 `yaml:"bias_acc"`
+	Bias_gyro  []float64 `yaml:"bias_gyro"`
+}
+
+// Blocks возвращает значения по именам блоков состояния (ключам YAML)
+func (v StateValues) Blocks() map[string][]float64 {
+	return map[string][]float64{
+		"position":   v.Position,
+		"velocity":   v.Velocity,
+		"quaternion": v.Quaternion,
+		"angle":      v.Angle,
+		"bias_acc":   v.Bias_acc,
+		"bias_gyro":  v.Bias_gyro,
+	}
+}
+
+// ProcessNoiseValues шум процесса по блокам состояния; скалярное значение задает все элементы блока
+type ProcessNoiseValues struct {
+	Position   []float64 `yaml:"position"`
+	Velocity   float64   `yaml:"velocity"`
+	Quaternion []float64 `yaml:"quaternion"`
+	Angle      []float64 `yaml:"angle"`
+	Bias_acc   float64   `yaml:"bias_acc"`
+	Bias_gyro  float64   `yaml:"bias_gyro"`
+}
+
+// Blocks возвращает значения по именам блоков состояния (ключам YAML)
+func (v ProcessNoiseValues) Blocks() map[string][]float64 {
+	return map[string][]float64{
+		"position":   v.Position,
+		"velocity":   {v.Velocity},
+		"quaternion": v.Quaternion,
+		"angle":      v.Angle,
+		"bias_acc":   {v.Bias_acc},
+		"bias_gyro":  {v.Bias_gyro},
+	}
+}
+
 type Config struct {
 	EKF struct {
-		TimeStep        float64 `yaml:"time_step"`
-		StateSize       int     `yaml:"state_size"`
-		MeasurementSize int     `yaml:"measurement_size"`
-		InitialState    struct {
-			Position   []float64 `yaml:"position"`
-			Velocity   []float64 `yaml:"velocity"`
-			Quaternion []float64 `yaml:"quaternion"`
-			Angle      []float64 `yaml:"angle"`
-			Bias_acc   []float64 `yaml:"bias_acc"`
-			Bias_gyro  []float64 `yaml:"bias_gyro"`
-		} `yaml:"initial_state"`
-		InitialCov struct {
-			Position   []float64 `yaml:"position"`
-			Velocity   []float64 `yaml:"velocity"`
-			Quaternion []float64 `yaml:"quaternion"`
-			Angle      []float64 `yaml:"angle"`
-			Bias_acc   []float64 `yaml:"bias_acc"`
-			Bias_gyro  []float64 `yaml:"bias_gyro"`
-		} `yaml:"initial_covariance"`
-		ProcessNoise struct {
-			Position   []float64 `yaml:"position"`
-			Velocity   float64   `yaml:"velocity"`
-			Quaternion []float64 `yaml:"quaternion"`
-			Angle      []float64 `yaml:"angle"`
-			Bias_acc   float64   `yaml:"bias_acc"`
-			Bias_gyro  float64   `yaml:"bias_gyro"`
-		} `yaml:"process_noise"`
+		TimeStep    float64 `yaml:"time_step"`     // Начальный шаг модели; далее шаг по меткам времени данных
+		MaxTimeStep float64 `yaml:"max_time_step"` // Наибольший шаг интегрирования при разрывах данных
+		// Блоки вектора состояния по порядку (пусто - position, velocity, quaternion, bias_acc, bias_gyro);
+		// размерность состояния определяется блоками
+		StateBlocks     []string `yaml:"state_blocks"`
+		MeasurementSize int      `yaml:"measurement_size"`
+		// Глубина истории состояний для коррекции запаздывающими измерениями GNSS
+		History time.Duration `yaml:"history"`
+		// Таблица CSV оценок фильтра по мере обработки (пусто - не сохраняется)
+		Output string `yaml:"output"`
+		// Тип фильтра: ekf - аддитивная ковариация кватерниона, eskf - фильтр по вектору ошибки
+		// (ковариация ориентации задается в initial_covariance.angle и process_noise.angle),
+		// ukf - сигма-точечный фильтр
+		Filter string `yaml:"filter"`
+		// Параметры сигма-точек UKF
+		UKF struct {
+			Alpha float64 `yaml:"alpha"`
+			Beta  float64 `yaml:"beta"`
+			Kappa float64 `yaml:"kappa"`
+		} `yaml:"ukf"`
+		// Якобианы модели: analytic - аналитические (если модель их предоставляет), numeric - конечные разности
+		Jacobian string `yaml:"jacobian"`
+		// Проверка аналитических якобианов при запуске: число случайных состояний (0 - без проверки) и допуск
+		JacobianCheck     int     `yaml:"jacobian_check"`
+		JacobianTolerance float64 `yaml:"jacobian_tolerance"`
+		// Режим моделирования: эталон и измерения с выборками шумов от воспроизводимого генератора
+		Simulation struct {
+			Enabled bool   `yaml:"enabled"`
+			Seed    uint64 `yaml:"seed"`
+		} `yaml:"simulation"`
+		InitialState StateValues        `yaml:"initial_state"`
+		InitialCov   StateValues        `yaml:"initial_covariance"`
+		ProcessNoise ProcessNoiseValues `yaml:"process_noise"`
+		// Измерения GNSS, применяемые в коррекции; каждое обновляет фильтр отдельно
+		Measurements struct {
+			Position        bool    `yaml:"position"` // Без высоты в отсчете - позиция в плане (horizontal_position)
+			Speed           bool    `yaml:"speed"`
+			Heading         bool    `yaml:"heading"`
+			HeadingMinSpeed float64 `yaml:"heading_min_speed"` // Курс используется при скорости не ниже, м/с
+		} `yaml:"measurements"`
+		// Проверка невязок измерений по критерию хи-квадрат
+		Gating struct {
+			Policy      string             `yaml:"policy"`      // off, reject, inflate
+			Probability float64            `yaml:"probability"` // Доверительная вероятность порога
+			Thresholds  map[string]float64 `yaml:"thresholds"`  // Явные пороги по типам измерений
+		} `yaml:"gating"`
+		// Диагностика согласованности фильтра: NIS по типам измерений, NEES при моделировании
+		Diagnostics struct {
+			Enabled     bool    `yaml:"enabled"`
+			Window      int     `yaml:"window"`      // Окно скользящего теста хи-квадрат
+			Probability float64 `yaml:"probability"` // Двусторонняя доверительная вероятность теста
+			File        string  `yaml:"file"`        // CSV с записями диагностики (пусто - не сохранять)
+		} `yaml:"diagnostics"`
+		// Вычисление ковариации: sqrt - через квадратные корни (QR), joseph - над полной матрицей
+		Covariance struct {
+			Form          string  `yaml:"form"`
+			MinEigenvalue float64 `yaml:"min_eigenvalue"` // Нижняя граница собственных чисел при исправлении
+		} `yaml:"covariance"`
+		// Адаптация шумов Q и R по невязкам (Sage-Husa) с коэффициентом забывания
+		AdaptiveNoise struct {
+			Enabled    bool       `yaml:"enabled"`
+			Forgetting float64    `yaml:"forgetting"`
+			Q          bool       `yaml:"q"`
+			R          bool       `yaml:"r"`
+			QBounds    [2]float64 `yaml:"q_bounds"` // Границы Q относительно process_noise
+			RBounds    [2]float64 `yaml:"r_bounds"` // Границы R относительно шума измерения эпохи
+			File       string     `yaml:"file"`     // CSV с адаптированными значениями (пусто - не сохранять)
+		} `yaml:"adaptive_noise"`
+		// Сглаживание RTS для постобработки записанных поездок
+		Smoother struct {
+			Enabled bool          `yaml:"enabled"`
+			File    string        `yaml:"file"`     // Таблица CSV сглаженной траектории (пусто - не сохраняется)
+			Lag     time.Duration `yaml:"lag"`      // Задержка сглаживания в реальном времени (0 - выключено)
+			LagFile string        `yaml:"lag_file"` // Таблица CSV оценок, сглаженных с задержкой (пусто - не сохраняется)
+		} `yaml:"smoother"`
+		// Взаимодействующие модели (IMM): режимы движения с разными шумами процесса
+		IMM struct {
+			Enabled bool `yaml:"enabled"`
+			Modes   []struct {
+				Name              string  `yaml:"name"`
+				ProcessNoiseScale float64 `yaml:"process_noise_scale"` // Множитель process_noise режима
+			} `yaml:"modes"`
+			Transition [][]float64 `yaml:"transition"` // Вероятности переходов между режимами за цикл (строка - из режима)
+			Initial    []float64   `yaml:"initial"`    // Начальные вероятности режимов (пусто - равные)
+			File       string      `yaml:"file"`       // CSV с вероятностями режимов (пусто - не сохранять)
+		} `yaml:"imm"`
 		MeasurementNoise struct {
 			Position_GNSS []float64 `yaml:"position_gnss"`
 			Speed         float64   `yaml:"speed"`
+
+			// Адаптивный шум: R = СКО² из оценок точности приемника, СКО ограничено снизу и сверху
+			Adaptive           bool      `yaml:"adaptive"`
+			Position_Sigma_Min []float64 `yaml:"position_sigma_min"`
+			Position_Sigma_Max []float64 `yaml:"position_sigma_max"`
+			Speed_Sigma_Min    float64   `yaml:"speed_sigma_min"`
+			Speed_Sigma_Max    float64   `yaml:"speed_sigma_max"`
+
+			Heading     float64 `yaml:"heading"`     // Дисперсия курса GNSS, рад²
+			Heading_Min float64 `yaml:"heading_min"` // Нижняя граница СКО курса, градусы
+			Heading_Max float64 `yaml:"heading_max"` // Верхняя граница СКО курса, градусы
 		} `yaml:"measurement_noise"`
 	} `yaml:"ekf"`
 
 	Sensors struct {
-		SyncThreshold time.Duration `yaml:"sync_threshold"`
+		SyncThreshold time.Duration `yaml:"sync_threshold"` // Допуск на использование ближайшего отсчета без интерполяции
+		MaxGap        float64       `yaml:"max_gap"`        // Наибольший интерполируемый разрыв между отсчетами (в периодах номинальной частоты)
+		ParseMode     string        `yaml:"parse_mode"`     // Разбор входных файлов: strict - ошибка на первой некорректной записи, lenient - пропуск с отчетом
 		Accelerometer struct {
-			Frequency float64 `yaml:"frequency"` // Частота акселерометра (Гц)
+			Frequency float64           `yaml:"frequency"` // Частота акселерометра (Гц)
+			File      string            `yaml:"file"`      // Входной файл
+			Format    string            `yaml:"format"`    // Формат входного файла: csv, ubx
+			Timestamp TimestampFormat   `yaml:"timestamp"` // Формат временной метки
+			Columns   map[string]string `yaml:"columns"`   // Колонки полей: имя из заголовка или номер
 		} `yaml:"accelerometer"`
 		Gyroscope struct {
-			Frequency float64 `yaml:"frequency"` // Частота гироскопа (Гц)
+			Frequency float64           `yaml:"frequency"` // Частота гироскопа (Гц)
+			File      string            `yaml:"file"`      // Входной файл
+			Format    string            `yaml:"format"`    // Формат входного файла: csv, ubx
+			Timestamp TimestampFormat   `yaml:"timestamp"` // Формат временной метки
+			Columns   map[string]string `yaml:"columns"`   // Колонки полей: имя из заголовка или номер
 		} `yaml:"gyroscope"`
 		GNSS struct {
-			Frequency          float64       `yaml:"frequency"`           // Частота GNSS (Гц)
-			SyncWindow         time.Duration `yaml:"sync_window"`         // Окно синхронизации для GNSS
-			ReferenceLatitude  float64       `yaml:"reference_latitude"`  // Широта (градусы)
-			ReferenceLongitude float64       `yaml:"reference_longitude"` // Долгота (градусы)
-			ReferenceAltitude  float64       `yaml:"reference_altitude"`  // Высота (метры)
+			Frequency          float64           `yaml:"frequency"`           // Частота GNSS (Гц)
+			File               string            `yaml:"file"`                // Входной файл
+			Format             string            `yaml:"format"`              // Формат входного файла: csv, nmea, ubx
+			Timestamp          TimestampFormat   `yaml:"timestamp"`           // Формат временной метки
+			Columns            map[string]string `yaml:"columns"`             // Колонки полей: имя из заголовка или номер
+			Latency            time.Duration     `yaml:"latency"`             // Задержка поступления решения относительно эпохи измерения
+			ReferenceLatitude  float64           `yaml:"reference_latitude"`  // Широта (градусы)
+			ReferenceLongitude float64           `yaml:"reference_longitude"` // Долгота (градусы)
+			ReferenceAltitude  float64           `yaml:"reference_altitude"`  // Высота (метры)
 		} `yaml:"gnss"`
+		Clock struct {
+			Estimate       bool          `yaml:"estimate"`        // Оценивать смещение часов GNSS по данным
+			Offset         time.Duration `yaml:"offset"`          // Смещение часов GNSS относительно IMU (без оценки или если она не удалась)
+			Drift          float64       `yaml:"drift"`           // Известный дрейф часов GNSS (с/с)
+			Duration       time.Duration `yaml:"duration"`        // Длительность начала записи GNSS для оценки (0 - 30 мин)
+			MaxLag         time.Duration `yaml:"max_lag"`         // Диапазон грубого поиска вокруг разности начала записей
+			RefineLag      time.Duration `yaml:"refine_lag"`      // Диапазон уточнения в окне вокруг грубой оценки
+			LagStep        time.Duration `yaml:"lag_step"`        // Разрешение оценки смещения
+			Span           time.Duration `yaml:"span"`            // Интервал, на котором сравниваются приращения скорости
+			Window         time.Duration `yaml:"window"`          // Длительность окна для оценки дрейфа (0 - одно окно)
+			MinIntervals   int           `yaml:"min_intervals"`   // Наименьшее число интервалов GNSS в окне
+			MinCorrelation float64       `yaml:"min_correlation"` // Наименьшая корреляция для принятия оценки окна
+			ForwardAxis    []float64     `yaml:"forward_axis"`    // Продольная ось автомобиля в осях акселерометра
+		} `yaml:"clock"`
+		UBX struct {
+			ESFTimeTag time.Duration `yaml:"esf_time_tag"` // Цена единицы метки времени ESF-RAW (зависит от прошивки)
+		} `yaml:"ubx"`
 	} `yaml:"sensors"`
 }
 
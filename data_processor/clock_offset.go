@@ -0,0 +1,396 @@
+package data_processor
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"main.go/config"
+	"main.go/internal/models"
+)
+
+// ErrClockOffset недостаточно данных для оценки смещения часов
+var ErrClockOffset = errors.New("не удалось оценить смещение часов GNSS")
+
+// defaultClockDuration длительность начала записи GNSS для оценки, если не задана
+const defaultClockDuration = 30 * time.Minute
+
+// ClockModel модель расхождения часов GNSS и IMU: t_imu = t_gnss + Offset + Drift·(t_gnss - Reference)
+type ClockModel struct {
+	Offset    time.Duration // Смещение на момент Reference
+	Drift     float64       // Дрейф (с/с)
+	Reference time.Time     // Опорный момент по часам GNSS
+
+	Windows     int     // Число окон, по которым получена оценка (0 - задано в конфигурации)
+	Correlation float64 // Средний коэффициент корреляции в окнах
+}
+
+// Apply переводит метку времени GNSS в шкалу IMU
+func (c ClockModel) Apply(t time.Time) time.Time {
+	shift := float64(c.Offset)
+	if !c.Reference.IsZero() {
+		shift += c.Drift * float64(t.Sub(c.Reference))
+	}
+	return t.Add(time.Duration(shift))
+}
+
+func (c ClockModel) String() string {
+	if c.Windows == 0 {
+		return fmt.Sprintf("смещение часов GNSS: %v, дрейф %.3g с/с (из конфигурации)", c.Offset, c.Drift)
+	}
+	return fmt.Sprintf("смещение часов GNSS: %v, дрейф %.3g с/с (окон: %d, корреляция %.2f)",
+		c.Offset, c.Drift, c.Windows, c.Correlation)
+}
+
+// CorrectGNSSClock переводит метки времени потока GNSS в шкалу IMU
+func CorrectGNSSClock(gnssStream iter.Seq2[models.GNSSData, error], clock ClockModel) iter.Seq2[models.GNSSData, error] {
+	return func(yield func(models.GNSSData, error) bool) {
+		for gnss, err := range gnssStream {
+			if err == nil {
+				gnss.Timestamp = clock.Apply(gnss.Timestamp)
+			}
+			if !yield(gnss, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ClockCorrection возвращает поправку часов GNSS: заданную в конфигурации или оцененную по началу
+// входных файлов. Читается не более clock.duration записи GNSS и соответствующий ей отрезок IMU.
+func ClockCorrection(cfg *config.Config) (ClockModel, error) {
+	clk := cfg.Sensors.Clock
+	if !clk.Estimate {
+		return ClockModel{Offset: clk.Offset, Drift: clk.Drift}, nil
+	}
+
+	duration := clk.Duration
+	if duration <= 0 {
+		duration = defaultClockDuration
+	}
+
+	gnssFile, err := os.Open(cfg.Sensors.GNSS.File)
+	if err != nil {
+		return ClockModel{}, err
+	}
+	defer gnssFile.Close()
+
+	var gnssEnd time.Time
+	gnss, err := collectWhile(StreamGNSS(gnssFile, cfg.Sensors.GNSS.File, cfg, nil), func(g models.GNSSData) bool {
+		if gnssEnd.IsZero() {
+			gnssEnd = g.Timestamp.Add(duration)
+		}
+		return !g.Timestamp.After(gnssEnd)
+	})
+	if err != nil {
+		return ClockModel{}, err
+	}
+	if len(gnss) == 0 {
+		return ClockModel{}, fmt.Errorf("%w: нет данных GNSS", ErrClockOffset)
+	}
+
+	accFile, err := os.Open(cfg.Sensors.Accelerometer.File)
+	if err != nil {
+		return ClockModel{}, err
+	}
+	defer accFile.Close()
+
+	// IMU - до конца отрезка GNSS со смещением не более грубой оценки + max_lag
+	var accEnd time.Time
+	acc, err := collectWhile(StreamAccelerometer(accFile, cfg.Sensors.Accelerometer.File, cfg, nil), func(a models.ACCData) bool {
+		if accEnd.IsZero() {
+			centre := a.Timestamp.Sub(gnss[0].Timestamp)
+			accEnd = gnss[len(gnss)-1].Timestamp.Add(centre + clk.MaxLag + clk.Span)
+		}
+		return !a.Timestamp.After(accEnd)
+	})
+	if err != nil {
+		return ClockModel{}, err
+	}
+
+	return EstimateClockOffset(acc, gnss, cfg)
+}
+
+// EstimateClockOffset оценивает смещение и дрейф часов GNSS относительно IMU.
+// Приращения скорости GNSS между соседними отсчетами сравниваются с интегралом продольного
+// ускорения IMU за тот же интервал, сдвинутый на пробное смещение; выбирается сдвиг с наибольшей
+// по модулю корреляцией. Грубое смещение - разность начала записей IMU и GNSS, оно уточняется
+// поиском в пределах ±MaxLag по всем интервалам, затем в каждом окне - в пределах ±RefineLag.
+// Дрейф - наклон прямой через оценки окон.
+func EstimateClockOffset(acc []models.ACCData, gnss []models.GNSSData, cfg *config.Config) (ClockModel, error) {
+	clk := cfg.Sensors.Clock
+
+	imu := newForwardIntegral(acc, clk.ForwardAxis)
+	if imu == nil {
+		return ClockModel{}, fmt.Errorf("%w: нет данных акселерометра", ErrClockOffset)
+	}
+
+	intervals := speedIntervals(gnss, clk.Span, maxGap(cfg.Sensors.MaxGap, cfg.Sensors.GNSS.Frequency))
+	if len(intervals) == 0 {
+		return ClockModel{}, fmt.Errorf("%w: нет скорости GNSS", ErrClockOffset)
+	}
+
+	lagStep := clk.LagStep
+	if lagStep <= 0 {
+		lagStep = 10 * time.Millisecond
+	}
+	coarseStep := period(cfg.Sensors.GNSS.Frequency) / 4
+	if coarseStep < lagStep {
+		coarseStep = lagStep
+	}
+
+	// Грубая оценка по началу записей, уточненная по всем интервалам
+	centre := acc[0].Timestamp.Sub(gnss[0].Timestamp)
+	coarse, _ := bestLag(imu, intervals, centre-clk.MaxLag, centre+clk.MaxLag, coarseStep)
+	refine := clk.RefineLag
+	if refine < coarseStep {
+		refine = coarseStep
+	}
+
+	// Разбиение на окна
+	window := clk.Window
+	start := intervals[0].t0
+	if window <= 0 {
+		window = intervals[len(intervals)-1].t1.Sub(start) + 1
+	}
+
+	type windowOffset struct {
+		t      float64 // Середина окна относительно start (с)
+		offset float64 // Смещение (с)
+		r      float64 // Модуль коэффициента корреляции
+	}
+	var offsets []windowOffset
+
+	for first, k := 0, 1; first < len(intervals); k++ {
+		end := start.Add(window * time.Duration(k))
+		last := first
+		for last < len(intervals) && intervals[last].t0.Before(end) {
+			last++
+		}
+		part := intervals[first:last]
+		first = last
+
+		if len(part) < max(clk.MinIntervals, 3) {
+			continue
+		}
+
+		// Поиск вокруг грубой оценки, затем уточнение вокруг максимума
+		best, _ := bestLag(imu, part, coarse-refine, coarse+refine, coarseStep)
+		best, r := bestLag(imu, part, best-coarseStep, best+coarseStep, lagStep)
+		if r < clk.MinCorrelation {
+			continue
+		}
+
+		mid := part[0].t0.Add(part[len(part)-1].t1.Sub(part[0].t0) / 2)
+		offsets = append(offsets, windowOffset{
+			t:      mid.Sub(start).Seconds(),
+			offset: best.Seconds(),
+			r:      r,
+		})
+	}
+
+	// Линейная регрессия смещения по времени
+	var n, st, so, stt, sto, sr float64
+	for _, w := range offsets {
+		n++
+		st += w.t
+		so += w.offset
+		stt += w.t * w.t
+		sto += w.t * w.offset
+		sr += w.r
+	}
+	if n == 0 {
+		return ClockModel{}, fmt.Errorf("%w: корреляция ниже %.2f во всех окнах", ErrClockOffset, clk.MinCorrelation)
+	}
+
+	offset, drift := so/n, 0.0
+	if d := n*stt - st*st; n > 1 && d > 0 {
+		drift = (n*sto - st*so) / d
+		offset = (so - drift*st) / n
+	}
+
+	return ClockModel{
+		Offset:      time.Duration(offset * float64(time.Second)).Round(lagStep),
+		Drift:       drift,
+		Reference:   start,
+		Windows:     int(n),
+		Correlation: sr / n,
+	}, nil
+}
+
+// speedInterval приращение скорости GNSS за интервал
+type speedInterval struct {
+	t0, t1 time.Time
+	dv     float64
+}
+
+// speedIntervals вычисляет приращения скорости GNSS на интервалах не короче span (сглаживание шума).
+// Если скорость в данных отсутствует, она оценивается по смещению между соседними отсчетами.
+// Интервалы не пересекают разрывы длиннее maxGap.
+func speedIntervals(gnss []models.GNSSData, span, maxGap time.Duration) []speedInterval {
+	type sample struct {
+		t     time.Time
+		speed float64
+	}
+
+	hasSpeed := false
+	for _, g := range gnss {
+		if g.HasSpeed {
+			hasSpeed = true
+			break
+		}
+	}
+
+	var samples []sample
+	for i, g := range gnss {
+		if hasSpeed {
+			if g.HasSpeed {
+				samples = append(samples, sample{g.Timestamp, g.Speed})
+			}
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		prev := gnss[i-1]
+		dt := g.Timestamp.Sub(prev.Timestamp)
+		if dt <= 0 {
+			continue
+		}
+		samples = append(samples, sample{
+			t:     prev.Timestamp.Add(dt / 2),
+			speed: surfaceDistance(prev.Latitude, prev.Longitude, g.Latitude, g.Longitude) / dt.Seconds(),
+		})
+	}
+
+	var intervals []speedInterval
+	for i, j := 0, 1; j < len(samples); j++ {
+		dt := samples[j].t.Sub(samples[j-1].t)
+		if dt <= 0 || maxGap > 0 && dt > maxGap {
+			// Разрыв: интервалы не должны его пересекать
+			i = j
+			continue
+		}
+		for i < j-1 && samples[j].t.Sub(samples[i+1].t) >= span {
+			i++
+		}
+		if samples[j].t.Sub(samples[i].t) < span {
+			continue
+		}
+		intervals = append(intervals, speedInterval{
+			t0: samples[i].t,
+			t1: samples[j].t,
+			dv: samples[j].speed - samples[i].speed,
+		})
+	}
+
+	return intervals
+}
+
+// surfaceDistance расстояние между близкими точками по поверхности Земли (м)
+func surfaceDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	phi := (lat1 + lat2) / 2 * math.Pi / 180
+	dx := (lon2 - lon1) * math.Pi / 180 * math.Cos(phi)
+	dy := (lat2 - lat1) * math.Pi / 180
+	return earthRadius * math.Hypot(dx, dy)
+}
+
+// forwardIntegral накопленный интеграл продольного ускорения IMU (м/с)
+type forwardIntegral struct {
+	t []time.Time
+	v []float64
+}
+
+// newForwardIntegral интегрирует проекцию ускорения (в g) на продольную ось методом трапеций
+func newForwardIntegral(acc []models.ACCData, axis []float64) *forwardIntegral {
+	if len(acc) < 2 {
+		return nil
+	}
+	if len(axis) != 3 {
+		axis = []float64{0, 1, 0}
+	}
+
+	const gravity = 9.81
+	forward := func(a models.ACCData) float64 {
+		return gravity * (a.AccelX*axis[0] + a.AccelY*axis[1] + a.AccelZ*axis[2])
+	}
+
+	f := &forwardIntegral{t: []time.Time{acc[0].Timestamp}, v: []float64{0}}
+	for i := 1; i < len(acc); i++ {
+		dt := acc[i].Timestamp.Sub(acc[i-1].Timestamp).Seconds()
+		if dt <= 0 {
+			continue
+		}
+		f.t = append(f.t, acc[i].Timestamp)
+		f.v = append(f.v, f.v[len(f.v)-1]+(forward(acc[i-1])+forward(acc[i]))/2*dt)
+	}
+
+	return f
+}
+
+// at возвращает значение интеграла в момент t; false - если t вне данных IMU
+func (f *forwardIntegral) at(t time.Time) (float64, bool) {
+	i := sort.Search(len(f.t), func(i int) bool { return !f.t[i].Before(t) })
+	if i == len(f.t) || i == 0 && t.Before(f.t[0]) {
+		return 0, false
+	}
+	if i == 0 || f.t[i].Equal(t) {
+		return f.v[i], true
+	}
+	w := float64(t.Sub(f.t[i-1])) / float64(f.t[i].Sub(f.t[i-1]))
+	return lerp(f.v[i-1], f.v[i], w), true
+}
+
+// bestLag перебирает смещения от min до max с шагом step и возвращает смещение с наибольшей
+// корреляцией приращений скорости GNSS и IMU. Отрицательная корреляция означает несовпадение
+// приращений, а не их совпадение с обратным знаком, поэтому знак r учитывается.
+func bestLag(imu *forwardIntegral, intervals []speedInterval, min, max, step time.Duration) (time.Duration, float64) {
+	best, bestR := time.Duration(0), math.Inf(-1)
+	gnssDV := make([]float64, 0, len(intervals))
+	imuDV := make([]float64, 0, len(intervals))
+
+	for lag := min; lag <= max; lag += step {
+		gnssDV, imuDV = gnssDV[:0], imuDV[:0]
+		for _, in := range intervals {
+			v0, ok0 := imu.at(in.t0.Add(lag))
+			v1, ok1 := imu.at(in.t1.Add(lag))
+			if !ok0 || !ok1 {
+				continue
+			}
+			gnssDV = append(gnssDV, in.dv)
+			imuDV = append(imuDV, v1-v0)
+		}
+		// Требуем перекрытия хотя бы половины интервалов
+		if len(gnssDV) < len(intervals)/2 || len(gnssDV) < 3 {
+			continue
+		}
+		if r := correlation(gnssDV, imuDV); r > bestR {
+			best, bestR = lag, r
+		}
+	}
+
+	return best, bestR
+}
+
+// correlation коэффициент корреляции Пирсона
+func correlation(x, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy, sxx, syy, sxy float64
+	for i := range x {
+		sx += x[i]
+		sy += y[i]
+		sxx += x[i] * x[i]
+		syy += y[i] * y[i]
+		sxy += x[i] * y[i]
+	}
+	d := math.Sqrt((n*sxx - sx*sx) * (n*syy - sy*sy))
+	if d == 0 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
@@ -0,0 +1,164 @@
+package data_processor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Имена полей входных файлов
+const (
+	ColumnTime      = "time"
+	ColumnX         = "x"
+	ColumnY         = "y"
+	ColumnZ         = "z"
+	ColumnLatitude  = "latitude"
+	ColumnLongitude = "longitude"
+	ColumnAltitude  = "altitude"
+	ColumnSpeed     = "speed"
+	ColumnBearing   = "bearing"
+
+	ColumnHorizontalAccuracy = "horizontal_accuracy"
+	ColumnVerticalAccuracy   = "vertical_accuracy"
+	ColumnSpeedAccuracy      = "speed_accuracy"
+	ColumnBearingAccuracy    = "bearing_accuracy"
+)
+
+// Колонки по умолчанию: имена из заголовка Sensor Logger либо номера колонок для файлов без заголовка
+var (
+	imuColumns = map[string][]string{
+		ColumnTime: {"time", "timestamp", "0"},
+		ColumnX:    {"x", "1"},
+		ColumnY:    {"y", "2"},
+		ColumnZ:    {"z", "3"},
+	}
+	imuRequired = []string{ColumnTime, ColumnX, ColumnY, ColumnZ}
+
+	gnssColumns = map[string][]string{
+		ColumnTime:      {"time", "timestamp", "0"},
+		ColumnLatitude:  {"latitude", "lat", "1"},
+		ColumnLongitude: {"longitude", "lon", "2"},
+		ColumnAltitude:  {"altitude", "alt"},
+		ColumnSpeed:     {"speed"},
+		ColumnBearing:   {"bearing", "heading", "course"},
+
+		ColumnHorizontalAccuracy: {"horizontalAccuracy", "horizontal_accuracy", "hAcc"},
+		ColumnVerticalAccuracy:   {"verticalAccuracy", "vertical_accuracy", "vAcc"},
+		ColumnSpeedAccuracy:      {"speedAccuracy", "speed_accuracy", "sAcc"},
+		ColumnBearingAccuracy:    {"bearingAccuracy", "bearing_accuracy", "headAcc"},
+	}
+	gnssRequired = []string{ColumnTime, ColumnLatitude, ColumnLongitude}
+)
+
+// ColumnSchema сопоставляет именованные поля записи с номерами колонок CSV
+type ColumnSchema struct {
+	index map[string]int
+	width int // Минимальное число полей в записи
+}
+
+// NewColumnSchema определяет номера колонок по заголовку файла (nil - заголовка нет).
+// Колонка поля задается в mapping именем из заголовка или номером; поля, отсутствующие в mapping,
+// ищутся по списку кандидатов defaults. Отсутствие обязательной колонки - ошибка.
+func NewColumnSchema(header []string, mapping map[string]string, defaults map[string][]string, required []string) (*ColumnSchema, error) {
+	schema := &ColumnSchema{index: make(map[string]int)}
+
+	for field, candidates := range defaults {
+		// номера колонок по умолчанию применимы только к файлам без заголовка
+		byIndex := header == nil
+		if name, ok := mapping[field]; ok {
+			candidates = []string{name}
+			byIndex = true
+		}
+
+		for _, name := range candidates {
+			if idx, ok := findColumn(header, name, byIndex); ok {
+				schema.index[field] = idx
+				break
+			}
+		}
+	}
+
+	for field, name := range mapping {
+		if _, ok := defaults[field]; !ok {
+			return nil, fmt.Errorf("неизвестное поле %q в описании колонок (колонка %q)", field, name)
+		}
+	}
+
+	for _, field := range required {
+		idx, ok := schema.index[field]
+		if !ok {
+			if name, ok := mapping[field]; ok {
+				return nil, fmt.Errorf("отсутствует обязательная колонка %q (поле %q)", name, field)
+			}
+			return nil, fmt.Errorf("отсутствует обязательная колонка для поля %q", field)
+		}
+		if idx+1 > schema.width {
+			schema.width = idx + 1
+		}
+	}
+
+	return schema, nil
+}
+
+// Has сообщает, найдена ли колонка для поля
+func (s *ColumnSchema) Has(field string) bool {
+	_, ok := s.index[field]
+	return ok
+}
+
+// Index возвращает номер колонки поля (-1 - колонки нет)
+func (s *ColumnSchema) Index(field string) int {
+	if idx, ok := s.index[field]; ok {
+		return idx
+	}
+	return -1
+}
+
+// Field возвращает значение поля из записи (пустая строка - колонки нет)
+func (s *ColumnSchema) Field(record []string, field string) string {
+	idx, ok := s.index[field]
+	if !ok || idx >= len(record) {
+		return ""
+	}
+	return strings.TrimSpace(record[idx])
+}
+
+// Width возвращает минимальное число полей в записи, содержащей все обязательные колонки
+func (s *ColumnSchema) Width() int {
+	return s.width
+}
+
+// findColumn ищет колонку по имени в заголовке либо (если byIndex) по номеру
+func findColumn(header []string, name string, byIndex bool) (int, bool) {
+	name = strings.TrimSpace(name)
+
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return i, true
+		}
+	}
+
+	if !byIndex {
+		return 0, false
+	}
+
+	idx, err := strconv.Atoi(name)
+	if err != nil || idx < 0 {
+		return 0, false
+	}
+	if header != nil && idx >= len(header) {
+		return 0, false
+	}
+
+	return idx, true
+}
+
+// isHeader проверяет, является ли запись заголовком (ни одно поле не является числом)
+func isHeader(record []string) bool {
+	for _, field := range record {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(field), 64); err == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -2,192 +2,359 @@ package data_processor
 
 import (
 	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
 	"os"
-	"strconv"
 	"time"
 
+	"main.go/config"
 	"main.go/internal/models"
 )
 
-// ReadAccelerometerCSV читает данные акселерометра из CSV
-func ReadAccelerometerCSV(filename string) ([]models.ACCData, error) {
-	file, err := os.Open(filename)
+// StreamAccelerometerCSV последовательно читает данные акселерометра из CSV, не загружая файл целиком.
+// name - имя источника для сообщений об ошибках; report (может быть nil) накапливает итог разбора.
+func StreamAccelerometerCSV(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.ACCData, error] {
+	parser, err := NewTimestampParser(cfg.Sensors.Accelerometer.Timestamp)
 	if err != nil {
-		return nil, err
+		return failedSeq[models.ACCData](err)
 	}
-	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	return streamCSV(r, name, cfg.Sensors.ParseMode, report, cfg.Sensors.Accelerometer.Columns, imuColumns, imuRequired,
+		func(record []string, schema *ColumnSchema) (models.ACCData, error) {
+			timestamp, err := timeField(record, schema, parser)
+			if err != nil {
+				return models.ACCData{}, err
+			}
+
+			var acc [3]float64
+			for i, field := range []string{ColumnX, ColumnY, ColumnZ} {
+				if acc[i], err = floatField(record, schema, field, true); err != nil {
+					return models.ACCData{}, err
+				}
+			}
+
+			return models.ACCData{
+				Timestamp: timestamp,
+				AccelX:    acc[0],
+				AccelY:    acc[1],
+				AccelZ:    acc[2],
+			}, nil
+		})
+}
+
+// StreamGyroCSV последовательно читает данные гироскопа из CSV, не загружая файл целиком
+func StreamGyroCSV(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GYROData, error] {
+	parser, err := NewTimestampParser(cfg.Sensors.Gyroscope.Timestamp)
 	if err != nil {
-		return nil, err
+		return failedSeq[models.GYROData](err)
 	}
 
-	var data []models.ACCData
-	time_ := 0
+	return streamCSV(r, name, cfg.Sensors.ParseMode, report, cfg.Sensors.Gyroscope.Columns, imuColumns, imuRequired,
+		func(record []string, schema *ColumnSchema) (models.GYROData, error) {
+			timestamp, err := timeField(record, schema, parser)
+			if err != nil {
+				return models.GYROData{}, err
+			}
 
-	// Пропускаем заголовок если есть
-	startIdx := 0
-	if len(records) > 0 {
-		// Проверяем, является ли первая строка заголовком
-		if _, err := strconv.ParseFloat(records[0][0], 64); err != nil {
-			startIdx = 1
-		}
-	}
+			var gyro [3]float64
+			for i, field := range []string{ColumnX, ColumnY, ColumnZ} {
+				if gyro[i], err = floatField(record, schema, field, true); err != nil {
+					return models.GYROData{}, err
+				}
+			}
 
-	for i := startIdx; i < len(records); i++ {
-		record := records[i]
+			return models.GYROData{
+				Timestamp: timestamp,
+				GyroX:     gyro[0],
+				GyroY:     gyro[1],
+				GyroZ:     gyro[2],
+			}, nil
+		})
+}
 
-		if len(record) < 3 {
-			continue
-		}
+// StreamGNSSDataCSV последовательно читает данные GNSS из CSV, не загружая файл целиком
+func StreamGNSSDataCSV(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GNSSData, error] {
+	parser, err := NewTimestampParser(cfg.Sensors.GNSS.Timestamp)
+	if err != nil {
+		return failedSeq[models.GNSSData](err)
+	}
 
-		// Предполагаем формат: timestamp, accel_x, accel_y, accel_z
-		/*timestamp, err := strconv.ParseInt(record[0], 10, 64)
-		if err != nil {
-			continue
-		}
-		*/
+	return streamCSV(r, name, cfg.Sensors.ParseMode, report, cfg.Sensors.GNSS.Columns, gnssColumns, gnssRequired,
+		func(record []string, schema *ColumnSchema) (models.GNSSData, error) {
+			timestamp, err := timeField(record, schema, parser)
+			if err != nil {
+				return models.GNSSData{}, err
+			}
 
-		timestamp := time_
+			// Необязательные колонки: при отсутствии остаются нулевыми
+			fields := []string{
+				ColumnLatitude, ColumnLongitude, ColumnAltitude, ColumnSpeed, ColumnBearing,
+				ColumnHorizontalAccuracy, ColumnVerticalAccuracy, ColumnSpeedAccuracy, ColumnBearingAccuracy,
+			}
+			required := []bool{true, true, false, false, false, false, false, false, false}
 
-		time_ = time_ + 10
+			var values [9]float64
+			for i, field := range fields {
+				if values[i], err = floatField(record, schema, field, required[i]); err != nil {
+					return models.GNSSData{}, err
+				}
+			}
 
-		accelX, _ := strconv.ParseFloat(record[1], 64)
-		accelY, _ := strconv.ParseFloat(record[2], 64)
-		accelZ, _ := strconv.ParseFloat(record[3], 64)
+			// Пустое поле или отсутствующая колонка - значение не пришло
+			present := func(field string) bool {
+				return schema.Field(record, field) != ""
+			}
 
-		data = append(data, models.ACCData{
-			//Timestamp: time.Unix(0, timestamp*int64(time.Millisecond)),
-			Timestamp: time.Unix(0, int64(timestamp)*int64(time.Millisecond)),
-			AccelX:    accelX,
-			AccelY:    accelY,
-			AccelZ:    accelZ,
+			return models.GNSSData{
+				Timestamp: timestamp,
+				Latitude:  values[0],
+				Longitude: values[1],
+				Altitude:  values[2],
+				Speed:     values[3],
+				Heading:   values[4],
+
+				HasAltitude: present(ColumnAltitude),
+				HasSpeed:    present(ColumnSpeed),
+				HasHeading:  present(ColumnBearing),
+
+				HorizontalAccuracy: values[5],
+				VerticalAccuracy:   values[6],
+				SpeedAccuracy:      values[7],
+				BearingAccuracy:    values[8],
+			}, nil
 		})
+}
+
+// StreamAccelerometer последовательно читает данные акселерометра в формате, заданном в конфигурации (csv, ubx)
+func StreamAccelerometer(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.ACCData, error] {
+	switch cfg.Sensors.Accelerometer.Format {
+	case "", "csv":
+		return StreamAccelerometerCSV(r, name, cfg, report)
+	case "ubx":
+		return StreamUBXAccelerometer(r, name, cfg, report)
 	}
+	return failedSeq[models.ACCData](fmt.Errorf("неизвестный формат данных акселерометра %q", cfg.Sensors.Accelerometer.Format))
+}
 
-	return data, nil
+// StreamGyro последовательно читает данные гироскопа в формате, заданном в конфигурации (csv, ubx)
+func StreamGyro(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GYROData, error] {
+	switch cfg.Sensors.Gyroscope.Format {
+	case "", "csv":
+		return StreamGyroCSV(r, name, cfg, report)
+	case "ubx":
+		return StreamUBXGyro(r, name, cfg, report)
+	}
+	return failedSeq[models.GYROData](fmt.Errorf("неизвестный формат данных гироскопа %q", cfg.Sensors.Gyroscope.Format))
+}
+
+// StreamGNSS последовательно читает данные GNSS в формате, заданном в конфигурации (csv, nmea, ubx)
+func StreamGNSS(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GNSSData, error] {
+	switch cfg.Sensors.GNSS.Format {
+	case "", "csv":
+		return StreamGNSSDataCSV(r, name, cfg, report)
+	case "nmea":
+		return StreamGNSSNMEA(r, name, cfg, report)
+	case "ubx":
+		return StreamUBXGNSS(r, name, cfg, report)
+	}
+	return failedSeq[models.GNSSData](fmt.Errorf("неизвестный формат данных GNSS %q", cfg.Sensors.GNSS.Format))
 }
 
-// ReadGyroCSV читает данные акселерометра из CSV
-func ReadGyroCSV(filename string) ([]models.GYROData, error) {
+// ReadAccelerometerCSV читает данные акселерометра из CSV
+func ReadAccelerometerCSV(filename string, cfg *config.Config, report *ParseReport) ([]models.ACCData, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+	return collect(StreamAccelerometerCSV(file, filename, cfg, report))
+}
+
+// ReadGyroCSV читает данные гироскопа из CSV
+func ReadGyroCSV(filename string, cfg *config.Config, report *ParseReport) ([]models.GYROData, error) {
+	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	var data []models.GYROData
-	time_ := 0
-
-	// Пропускаем заголовок если есть
-	startIdx := 0
-	if len(records) > 0 {
-		// Проверяем, является ли первая строка заголовком
-		if _, err := strconv.ParseFloat(records[0][0], 64); err != nil {
-			startIdx = 1
-		}
-	}
-
-	for i := startIdx; i < len(records); i++ {
-		record := records[i]
-
-		if len(record) < 3 {
-			continue
-		}
-
-		/*
-			// Предполагаем формат: timestamp, gyro_x, gyro_y, gyro_z
-			timestamp, err := strconv.ParseInt(record[0], 10, 64)
-			if err != nil {
-				continue
-			}
-		*/
-
-		timestamp := time_
-
-		time_ = time_ + 10
-
-		gyroX, _ := strconv.ParseFloat(record[1], 64)
-		gyroY, _ := strconv.ParseFloat(record[2], 64)
-		gyroZ, _ := strconv.ParseFloat(record[3], 64)
-
-		data = append(data, models.GYROData{
-			Timestamp: time.Unix(0, int64(timestamp)*int64(time.Millisecond)),
-			GyroX:     gyroX,
-			GyroY:     gyroY,
-			GyroZ:     gyroZ,
-		})
-	}
-
-	return data, nil
+	return collect(StreamGyroCSV(file, filename, cfg, report))
 }
 
 // ReadGNSSDataCSV читает данные GNSS из CSV
-func ReadGNSSDataCSV(filename string) ([]models.GNSSData, error) {
+func ReadGNSSDataCSV(filename string, cfg *config.Config, report *ParseReport) ([]models.GNSSData, error) {
 	file, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
-	if err != nil {
-		return nil, err
-	}
-
-	var data []models.GNSSData
-	time_ := 0
+	return collect(StreamGNSSDataCSV(file, filename, cfg, report))
+}
 
-	startIdx := 0
-	if len(records) > 0 {
-		if _, err := strconv.ParseFloat(records[0][0], 64); err != nil {
-			startIdx = 1
+// streamCSV построчно читает CSV, определяет колонки по заголовку (если он есть) и описанию колонок
+// и передает потребителю записи, разобранные функцией decode. В строгом режиме первая некорректная
+// запись завершает поток ошибкой *ParseError, в мягком - пропускается и учитывается в report.
+func streamCSV[T any](r io.Reader, name string, mode string, report *ParseReport,
+	mapping map[string]string,
+	defaults map[string][]string,
+	required []string,
+	decode func(record []string, schema *ColumnSchema) (T, error),
+) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+
+		mode, err := parseMode(mode)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		if report != nil {
+			report.File = name
 		}
-	}
 
-	for i := startIdx; i < len(records); i++ {
-		record := records[i]
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1 // длина записи проверяется по схеме колонок
+		reader.ReuseRecord = true
 
-		if len(record) < 2 {
-			continue
+		// reject обрабатывает некорректную запись; возвращает false, если чтение нужно прекратить
+		reject := func(perr *ParseError) bool {
+			if mode == ParseStrict {
+				yield(zero, perr)
+				return false
+			}
+			report.drop(perr)
+			return true
 		}
 
-		/*
-			// Формат: timestamp, latitude, longitude, altitude, speed, heading
-			timestamp, err := strconv.ParseInt(record[0], 10, 64)
+		var schema *ColumnSchema
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
 			if err != nil {
+				var csvErr *csv.ParseError
+				if !errors.As(err, &csvErr) {
+					yield(zero, fmt.Errorf("%s: %w", name, err))
+					return
+				}
+				perr := &ParseError{File: name, Line: csvErr.Line, Column: csvErr.Column, Err: csvErr.Err}
+				if !reject(perr) {
+					return
+				}
 				continue
 			}
-		*/
 
-		timestamp := time_
+			line, _ := reader.FieldPos(0)
 
-		time_ = time_ + 1000
+			if schema == nil {
+				// Пропускаем заголовок если есть
+				var header []string
+				if isHeader(record) {
+					header = record
+				}
 
-		lat, _ := strconv.ParseFloat(record[10], 64)
-		lon, _ := strconv.ParseFloat(record[9], 64)
-		alt, _ := strconv.ParseFloat(record[8], 64)
+				schema, err = NewColumnSchema(header, mapping, defaults, required)
+				if err != nil {
+					yield(zero, fmt.Errorf("%s: %w", name, err))
+					return
+				}
 
-		speed, _ := strconv.ParseFloat(record[6], 64)
+				if header != nil {
+					continue
+				}
+			}
+
+			if len(record) < schema.Width() {
+				perr := &ParseError{
+					File: name,
+					Line: line,
+					Err:  fmt.Errorf("%w: %d из %d", ErrShortRecord, len(record), schema.Width()),
+				}
+				if !reject(perr) {
+					return
+				}
+				continue
+			}
 
-		dataPoint := models.GNSSData{
-			Timestamp: time.Unix(0, int64(timestamp)*int64(time.Millisecond)),
-			Latitude:  lat,
-			Longitude: lon,
-			Altitude:  alt,
-			Speed:     speed,
+			value, err := decode(record, schema)
+			if err != nil {
+				perr := &ParseError{File: name, Line: line, Err: err}
+				var ferr *fieldError
+				if errors.As(err, &ferr) {
+					perr.Field = ferr.field
+					perr.Column = schema.Index(ferr.field) + 1
+					perr.Err = ferr.err
+				}
+				if !reject(perr) {
+					return
+				}
+				continue
+			}
+
+			report.accept()
+			if !yield(value, nil) {
+				return
+			}
 		}
+	}
+}
 
-		data = append(data, dataPoint)
+// timeField разбирает временную метку записи
+func timeField(record []string, schema *ColumnSchema, parser *TimestampParser) (time.Time, error) {
+	timestamp, err := parser.Parse(schema.Field(record, ColumnTime))
+	if err != nil {
+		return time.Time{}, &fieldError{field: ColumnTime, err: err}
 	}
+	return timestamp, nil
+}
 
+// collect собирает поток в срез
+func collect[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	var data []T
+	for value, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, value)
+	}
 	return data, nil
 }
+
+// collectWhile собирает поток в срез до первого значения, для которого keep возвращает false
+func collectWhile[T any](seq iter.Seq2[T, error], keep func(T) bool) ([]T, error) {
+	var data []T
+	for value, err := range seq {
+		if err != nil {
+			return nil, err
+		}
+		if !keep(value) {
+			break
+		}
+		data = append(data, value)
+	}
+	return data, nil
+}
+
+// failedSeq возвращает поток, состоящий из одной ошибки
+func failedSeq[T any](err error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		yield(zero, err)
+	}
+}
+
+// sliceSeq возвращает поток элементов среза
+func sliceSeq[T any](data []T) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		for _, value := range data {
+			if !yield(value, nil) {
+				return
+			}
+		}
+	}
+}
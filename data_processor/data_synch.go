@@ -1,104 +1,233 @@
 package data_processor
 
 import (
+	"iter"
+	"time"
+
 	"main.go/config"
 
 	"main.go/internal/models"
 )
 
-/*
-// SynchronizedData представляет синхронизированные данные
-type SynchronizedData struct {
-	Timestamp time.Time
-	// IMU данные
-	AccelX, AccelY, AccelZ float64
-	GyroX, GyroY, GyroZ    float64
-	// GNSS данные (если есть)
-	HasGNSS                       bool
-	Latitude, Longitude, Altitude float64
-	Speed                         float64
-	Heading                       float64
-}
-*/
-
-// ReadGNSSDataCSV_1 синхронизирует данные акселерометра, гироскопа и GNSS
-func ReadGNSSDataCSV_1(accData []models.ACCData,
+// Synchronize синхронизирует загруженные в память данные акселерометра, гироскопа и GNSS
+func Synchronize(accData []models.ACCData,
 	gyroData []models.GYROData,
 	gnssData []models.GNSSData,
 	cfg *config.Config,
 ) ([]models.SynchronizedData, error) {
+	return collect(SynchronizeStream(sliceSeq(accData), sliceSeq(gyroData), sliceSeq(gnssData), cfg))
+}
 
-	// Проверяем, что данные IMU имеют одинаковую длину (частоту)
-	if len(accData) != len(gyroData) {
-		// В реальном приложении здесь нужна более сложная логика синхронизации
-		// Для простоты берем минимальную длину
-		minLen := len(accData)
-		if len(gyroData) < minLen {
-			minLen = len(gyroData)
+// SynchronizeStream объединяет потоки акселерометра, гироскопа и GNSS в порядке временных меток.
+// На каждый отсчет датчика выдается событие с его временем: второй канал IMU интерполируется
+// к этому времени. Отсчет GNSS выдается в момент поступления (эпоха + задержка из конфигурации)
+// с меткой эпохи измерения и данными IMU на момент поступления.
+// События, для которых данные IMU получить нельзя, пропускаются; исключение - отсчет GNSS
+// внутри разрыва в потоке IMU, он выдается без данных IMU (HasIMU = false).
+func SynchronizeStream(accStream iter.Seq2[models.ACCData, error],
+	gyroStream iter.Seq2[models.GYROData, error],
+	gnssStream iter.Seq2[models.GNSSData, error],
+	cfg *config.Config,
+) iter.Seq2[models.SynchronizedData, error] {
+	return func(yield func(models.SynchronizedData, error) bool) {
+		acc := newSensorChannel(accStream, func(d models.ACCData) time.Time { return d.Timestamp },
+			maxGap(cfg.Sensors.MaxGap, cfg.Sensors.Accelerometer.Frequency), 0)
+		defer acc.stop()
+		gyro := newSensorChannel(gyroStream, func(d models.GYROData) time.Time { return d.Timestamp },
+			maxGap(cfg.Sensors.MaxGap, cfg.Sensors.Gyroscope.Frequency), 0)
+		defer gyro.stop()
+		// Решения GNSS упорядочиваются по времени поступления (эпоха + задержка).
+		// Отсчеты GNSS чаще номинальной частоты считаются повторами.
+		latency := cfg.Sensors.GNSS.Latency
+		gnss := newSensorChannel(gnssStream, func(d models.GNSSData) time.Time { return d.Timestamp.Add(latency) },
+			0, period(cfg.Sensors.GNSS.Frequency)/2)
+		defer gnss.stop()
+
+		for _, ch := range []interface{ advance() error }{acc, gyro, gnss} {
+			if err := ch.advance(); err != nil {
+				yield(models.SynchronizedData{}, err)
+				return
+			}
 		}
-		accData = accData[:minLen]
-		gyroData = gyroData[:minLen]
-	}
 
-	var syncedData []models.SynchronizedData
-	gnssIndex := 0
-	// Синхронизируем данные по временным меткам
-	for i := 0; i < len(accData); i++ {
-		acc := accData[i]
-		gyro := gyroData[i]
-
-		// Проверяем, что временные метки IMU данных близки (в пределах допустимого отклонения)
-		timeDiff := acc.Timestamp.Sub(gyro.Timestamp)
-		if timeDiff.Abs() > cfg.Sensors.SyncThreshold {
-			// Пропускаем несинхронные данные или используем интерполяцию
-			continue
-		}
+		for {
+			// Следующее событие - самый ранний из ожидающих отсчетов
+			var source models.SensorSource
+			var t time.Time
+			for _, head := range []struct {
+				source models.SensorSource
+				ok     bool
+				t      time.Time
+			}{
+				{models.SourceACC, acc.hasHead, acc.headTime()},
+				{models.SourceGYRO, gyro.hasHead, gyro.headTime()},
+				{models.SourceGNSS, gnss.hasHead, gnss.headTime()},
+			} {
+				if head.ok && (source == "" || head.t.Before(t)) {
+					source, t = head.source, head.t
+				}
+			}
+			if source == "" {
+				return
+			}
+
+			data := models.SynchronizedData{Timestamp: t, Source: source}
+
+			// Данные IMU на момент события
+			accOK := acc.interpolate(t, cfg.Sensors.SyncThreshold, func(a, b models.ACCData, w float64) {
+				data.AccelX = lerp(a.AccelX, b.AccelX, w)
+				data.AccelY = lerp(a.AccelY, b.AccelY, w)
+				data.AccelZ = lerp(a.AccelZ, b.AccelZ, w)
+			})
+			gyroOK := gyro.interpolate(t, cfg.Sensors.SyncThreshold, func(a, b models.GYROData, w float64) {
+				data.GyroX = lerp(a.GyroX, b.GyroX, w)
+				data.GyroY = lerp(a.GyroY, b.GyroY, w)
+				data.GyroZ = lerp(a.GyroZ, b.GyroZ, w)
+			})
+
+			var err error
+			switch source {
+			case models.SourceACC:
+				err = acc.advance()
+			case models.SourceGYRO:
+				err = gyro.advance()
+			case models.SourceGNSS:
+				fix := gnss.head
+				data.Timestamp = fix.Timestamp // эпоха измерения; при задержке - раньше времени события
+				data.HasGNSS = true
+				data.Latitude = fix.Latitude
+				data.Longitude = fix.Longitude
+				data.Altitude = fix.Altitude
+				data.Speed = fix.Speed
+				data.Heading = fix.Heading
+				data.HasAltitude, data.HasSpeed, data.HasHeading = fix.HasAltitude, fix.HasSpeed, fix.HasHeading
+				data.HorizontalAccuracy = fix.HorizontalAccuracy
+				data.VerticalAccuracy = fix.VerticalAccuracy
+				data.SpeedAccuracy = fix.SpeedAccuracy
+				data.BearingAccuracy = fix.BearingAccuracy
+				err = gnss.advance()
+			}
+			if err != nil {
+				yield(models.SynchronizedData{}, err)
+				return
+			}
+
+			data.HasIMU = accOK && gyroOK
+			if !data.HasIMU {
+				// До начала и после конца записи IMU отсчеты GNSS не используются
+				if !data.HasGNSS || !acc.inside() || !gyro.inside() {
+					continue
+				}
+				data.AccelX, data.AccelY, data.AccelZ = 0, 0, 0
+				data.GyroX, data.GyroY, data.GyroZ = 0, 0, 0
+			}
 
-		// Используем среднее время между акселерометром и гироскопом
-		avgTime := acc.Timestamp.Add(timeDiff / 2)
-
-		data := models.SynchronizedData{
-			Timestamp: avgTime,
-			AccelX:    acc.AccelX,
-			AccelY:    acc.AccelY,
-			AccelZ:    acc.AccelZ,
-			GyroX:     gyro.GyroX,
-			GyroY:     gyro.GyroY,
-			GyroZ:     gyro.GyroZ,
-			HasGNSS:   false,
+			if !yield(data, nil) {
+				return
+			}
 		}
+	}
+}
 
-		// Ищем ближайшие GNSS данные
-		for gnssIndex < len(gnssData) {
-			gnssTime := gnssData[gnssIndex].Timestamp
-			timeDiffGNSS := avgTime.Sub(gnssTime).Abs()
+// sensorChannel окно потока одного датчика: последний использованный отсчет и следующий ожидающий
+type sensorChannel[T any] struct {
+	next    func() (T, error, bool)
+	stop    func()
+	time    func(T) time.Time
+	maxGap  time.Duration // Наибольший интерполируемый разрыв (0 - без ограничения)
+	minStep time.Duration // Отсчеты ближе к предыдущему пропускаются (0 - все отсчеты)
 
-			// Если GNSS данные в пределах окна синхронизации
-			if timeDiffGNSS <= cfg.Sensors.GNSS.SyncWindow {
-				data.HasGNSS = true
-				data.Latitude = gnssData[gnssIndex].Latitude
-				data.Longitude = gnssData[gnssIndex].Longitude
-				data.Altitude = gnssData[gnssIndex].Altitude
-				data.Speed = gnssData[gnssIndex].Speed
-
-				// Если время точно совпало, переходим к следующему GNSS отсчету
-				if timeDiffGNSS == 0 {
-					gnssIndex++
-				}
-				break
+	prev, head       T
+	hasPrev, hasHead bool
+}
 
-			} else if gnssTime.After(avgTime) {
-				// GNSS данные в будущем - выходим из цикла
-				break
+func newSensorChannel[T any](stream iter.Seq2[T, error], timeOf func(T) time.Time, maxGap, minStep time.Duration) *sensorChannel[T] {
+	next, stop := iter.Pull2(stream)
+	return &sensorChannel[T]{next: next, stop: stop, time: timeOf, maxGap: maxGap, minStep: minStep}
+}
+
+// advance делает ожидающий отсчет использованным и читает следующий.
+// Отсчеты, нарушающие порядок времени или идущие чаще minStep, пропускаются.
+func (c *sensorChannel[T]) advance() error {
+	if c.hasHead {
+		c.prev, c.hasPrev = c.head, true
+	}
+
+	for {
+		value, err, ok := c.next()
+		if !ok {
+			c.hasHead = false
+			return nil
+		}
+		if err != nil {
+			c.hasHead = false
+			return err
+		}
+		if c.hasPrev {
+			if step := c.time(value).Sub(c.time(c.prev)); step <= 0 || step < c.minStep {
+				continue
 			}
+		}
+		c.head, c.hasHead = value, true
+		return nil
+	}
+}
+
+// headTime возвращает время ожидающего отсчета
+func (c *sensorChannel[T]) headTime() time.Time {
+	if !c.hasHead {
+		return time.Time{}
+	}
+	return c.time(c.head)
+}
 
-			// Переходим к следующему GNSS отсчету
-			gnssIndex++
+// interpolate передает в set соседние с t отсчеты и вес второго из них.
+// Если разрыв между соседями больше maxGap или одного из них нет, используется ближайший отсчет
+// не дальше tolerance от t. Возвращает false, если данных на момент t нет.
+func (c *sensorChannel[T]) interpolate(t time.Time, tolerance time.Duration, set func(a, b T, w float64)) bool {
+	if c.hasPrev && c.hasHead {
+		t0, t1 := c.time(c.prev), c.time(c.head)
+		gap := t1.Sub(t0)
+		if c.maxGap == 0 || gap <= c.maxGap {
+			set(c.prev, c.head, float64(t.Sub(t0))/float64(gap))
+			return true
 		}
+	}
+
+	if c.hasPrev && t.Sub(c.time(c.prev)).Abs() <= tolerance {
+		set(c.prev, c.prev, 0)
+		return true
+	}
+	if c.hasHead && c.time(c.head).Sub(t).Abs() <= tolerance {
+		set(c.head, c.head, 0)
+		return true
+	}
 
-		syncedData = append(syncedData, data)
+	return false
+}
 
+// inside сообщает, что поток начался и не закончился: есть и использованный, и ожидающий отсчет
+func (c *sensorChannel[T]) inside() bool {
+	return c.hasPrev && c.hasHead
+}
+
+// lerp линейная интерполяция между a и b с весом w
+func lerp(a, b, w float64) float64 {
+	return a + (b-a)*w
+}
+
+// period возвращает период отсчетов по частоте (0 - частота не задана)
+func period(frequency float64) time.Duration {
+	if frequency <= 0 {
+		return 0
 	}
+	return time.Duration(float64(time.Second) / frequency)
+}
 
-	return syncedData, nil
+// maxGap возвращает наибольший интерполируемый разрыв для датчика с частотой frequency
+func maxGap(periods, frequency float64) time.Duration {
+	if periods <= 0 {
+		return 0
+	}
+	return time.Duration(periods * float64(period(frequency)))
 }
@@ -0,0 +1,447 @@
+package data_processor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/config"
+	"main.go/internal/models"
+)
+
+// Ошибки разбора NMEA 0183
+var (
+	ErrNMEAChecksum = errors.New("неверная контрольная сумма NMEA")
+	ErrNMEASentence = errors.New("некорректное предложение NMEA")
+)
+
+const knotsToMS = 1852.0 / 3600.0 // узлы -> м/с
+
+// nmeaEpoch накапливает данные предложений одной эпохи (с одинаковым временем UTC)
+type nmeaEpoch struct {
+	tod     time.Duration // Время от начала суток UTC
+	hasTime bool
+
+	data        models.GNSSData
+	hasPosition bool // Координаты получены из GGA или RMC
+	valid       bool // Приемник сообщил о наличии решения
+	vtgSpeed    bool // Скорость получена из VTG (точнее, чем из RMC)
+}
+
+// StreamGNSSNMEA последовательно читает данные GNSS из журнала NMEA 0183 (GGA, RMC, VTG, GSA).
+// Предложения с одинаковым временем UTC объединяются в один отсчет; дата берется из RMC
+// и переносится на следующие сутки при переходе через полночь. Эпохи без решения
+// и эпохи до первой даты из RMC пропускаются.
+func StreamGNSSNMEA(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GNSSData, error] {
+	return func(yield func(models.GNSSData, error) bool) {
+		mode, err := parseMode(cfg.Sensors.ParseMode)
+		if err != nil {
+			yield(models.GNSSData{}, err)
+			return
+		}
+		if report != nil {
+			report.File = name
+		}
+
+		var (
+			date    time.Time // Начало текущих суток UTC (нулевое - дата неизвестна)
+			lastTOD time.Duration
+			epoch   nmeaEpoch
+		)
+
+		// flush завершает текущую эпоху; возвращает false, если потребитель прекратил чтение
+		flush := func() bool {
+			defer func() { epoch = nmeaEpoch{} }()
+
+			if !epoch.hasTime || !epoch.hasPosition || !epoch.valid || date.IsZero() {
+				return true
+			}
+
+			// Переход через полночь без нового RMC
+			if epoch.tod+12*time.Hour < lastTOD {
+				date = date.Add(24 * time.Hour)
+			}
+			lastTOD = epoch.tod
+
+			epoch.data.Timestamp = date.Add(epoch.tod)
+			report.accept()
+			return yield(epoch.data, nil)
+		}
+
+		scanner := bufio.NewScanner(r)
+		line := 0
+		for scanner.Scan() {
+			line++
+
+			text := strings.TrimSpace(scanner.Text())
+			start := strings.IndexByte(text, '$')
+			if start < 0 {
+				continue
+			}
+
+			fields, err := splitNMEA(text[start:])
+			if err != nil {
+				perr := &ParseError{File: name, Line: line, Column: start + 1, Err: err}
+				if mode == ParseStrict {
+					yield(models.GNSSData{}, perr)
+					return
+				}
+				report.drop(perr)
+				continue
+			}
+
+			// Тип предложения без идентификатора источника ($GPGGA, $GNGGA -> GGA)
+			kind := fields[0]
+			if len(kind) >= 5 {
+				kind = kind[len(kind)-3:]
+			}
+
+			var tod time.Duration
+			var hasTime bool
+			switch kind {
+			case "GGA", "RMC":
+				if len(fields) < 2 || fields[1] == "" {
+					break
+				}
+				tod, err = parseNMEATime(fields[1])
+				if err != nil {
+					err = &fieldError{field: kind + ".time", err: err}
+					break
+				}
+				hasTime = true
+			case "VTG", "GSA":
+			default:
+				continue
+			}
+
+			// Новая эпоха начинается с предложения с другим временем
+			if err == nil && hasTime && epoch.hasTime && tod != epoch.tod {
+				if !flush() {
+					return
+				}
+			}
+			if err == nil && hasTime && !epoch.hasTime {
+				epoch.tod = tod
+				epoch.hasTime = true
+			}
+
+			if err == nil {
+				switch kind {
+				case "GGA":
+					err = epoch.parseGGA(fields)
+				case "RMC":
+					var rmcDate time.Time
+					rmcDate, err = epoch.parseRMC(fields)
+					if err == nil && !rmcDate.IsZero() {
+						date = rmcDate
+						lastTOD = epoch.tod
+					}
+				case "VTG":
+					err = epoch.parseVTG(fields)
+				case "GSA":
+					err = epoch.parseGSA(fields)
+				}
+			}
+
+			if err != nil {
+				perr := &ParseError{File: name, Line: line, Err: err}
+				var ferr *fieldError
+				if errors.As(err, &ferr) {
+					perr.Field = ferr.field
+					perr.Err = ferr.err
+				}
+				if mode == ParseStrict {
+					yield(models.GNSSData{}, perr)
+					return
+				}
+				report.drop(perr)
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			yield(models.GNSSData{}, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+
+		flush()
+	}
+}
+
+// ReadGNSSNMEA читает данные GNSS из журнала NMEA 0183
+func ReadGNSSNMEA(filename string, cfg *config.Config, report *ParseReport) ([]models.GNSSData, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return collect(StreamGNSSNMEA(file, filename, cfg, report))
+}
+
+// parseGGA разбирает GGA: время, координаты, качество решения, число спутников, HDOP, высота
+func (e *nmeaEpoch) parseGGA(f []string) error {
+	if len(f) < 10 {
+		return fmt.Errorf("%w: GGA содержит %d полей", ErrNMEASentence, len(f))
+	}
+
+	quality, err := nmeaInt(f, 6, "GGA.quality")
+	if err != nil {
+		return err
+	}
+	e.data.FixQuality = quality
+	if quality == 0 {
+		return nil
+	}
+
+	if e.data.Satellites, err = nmeaInt(f, 7, "GGA.satellites"); err != nil {
+		return err
+	}
+	if e.data.HDOP, err = nmeaFloat(f, 8, "GGA.hdop"); err != nil {
+		return err
+	}
+	if f[9] != "" {
+		if e.data.Altitude, err = nmeaFloat(f, 9, "GGA.altitude"); err != nil {
+			return err
+		}
+		e.data.HasAltitude = true
+	}
+
+	lat, lon, ok, err := nmeaPosition(f, 2, "GGA")
+	if err != nil || !ok {
+		return err
+	}
+
+	e.data.Latitude = lat
+	e.data.Longitude = lon
+	e.hasPosition = true
+	e.valid = true
+	return nil
+}
+
+// parseRMC разбирает RMC: время, статус, координаты, скорость, курс и дату.
+// Возвращает дату (начало суток UTC) или нулевое время, если даты нет.
+func (e *nmeaEpoch) parseRMC(f []string) (time.Time, error) {
+	if len(f) < 10 {
+		return time.Time{}, fmt.Errorf("%w: RMC содержит %d полей", ErrNMEASentence, len(f))
+	}
+
+	var date time.Time
+	if f[9] != "" {
+		d, err := time.ParseInLocation("020106", f[9], time.UTC)
+		if err != nil {
+			return time.Time{}, &fieldError{field: "RMC.date", err: fmt.Errorf("%w %q", ErrBadTimestamp, f[9])}
+		}
+		date = d
+	}
+
+	if f[2] != "A" {
+		return date, nil
+	}
+
+	lat, lon, ok, err := nmeaPosition(f, 3, "RMC")
+	if err != nil || !ok {
+		return date, err
+	}
+
+	if !e.hasPosition {
+		e.data.Latitude = lat
+		e.data.Longitude = lon
+		e.hasPosition = true
+	}
+	e.valid = true
+
+	if f[7] != "" && !e.vtgSpeed {
+		knots, err := nmeaFloat(f, 7, "RMC.speed")
+		if err != nil {
+			return date, err
+		}
+		e.data.Speed = knots * knotsToMS
+		e.data.HasSpeed = true
+	}
+	if f[8] != "" {
+		if e.data.Heading, err = nmeaFloat(f, 8, "RMC.course"); err != nil {
+			return date, err
+		}
+		e.data.HasHeading = true
+	}
+
+	return date, nil
+}
+
+// parseVTG разбирает VTG: истинный курс и скорость относительно земли
+func (e *nmeaEpoch) parseVTG(f []string) error {
+	if len(f) < 9 {
+		return fmt.Errorf("%w: VTG содержит %d полей", ErrNMEASentence, len(f))
+	}
+
+	var err error
+	if f[1] != "" {
+		if e.data.Heading, err = nmeaFloat(f, 1, "VTG.course"); err != nil {
+			return err
+		}
+		e.data.HasHeading = true
+	}
+
+	switch {
+	case f[7] != "":
+		kmh, err := nmeaFloat(f, 7, "VTG.speed_kmh")
+		if err != nil {
+			return err
+		}
+		e.data.Speed = kmh / 3.6
+		e.data.HasSpeed, e.vtgSpeed = true, true
+	case f[5] != "":
+		knots, err := nmeaFloat(f, 5, "VTG.speed_knots")
+		if err != nil {
+			return err
+		}
+		e.data.Speed = knots * knotsToMS
+		e.data.HasSpeed, e.vtgSpeed = true, true
+	}
+
+	return nil
+}
+
+// parseGSA разбирает GSA: тип решения и геометрические факторы
+func (e *nmeaEpoch) parseGSA(f []string) error {
+	if len(f) < 18 {
+		return fmt.Errorf("%w: GSA содержит %d полей", ErrNMEASentence, len(f))
+	}
+
+	var err error
+	if e.data.FixType, err = nmeaInt(f, 2, "GSA.fix_type"); err != nil {
+		return err
+	}
+	if e.data.PDOP, err = nmeaFloat(f, 15, "GSA.pdop"); err != nil {
+		return err
+	}
+	if e.data.HDOP == 0 {
+		if e.data.HDOP, err = nmeaFloat(f, 16, "GSA.hdop"); err != nil {
+			return err
+		}
+	}
+	if e.data.VDOP, err = nmeaFloat(f, 17, "GSA.vdop"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// splitNMEA проверяет контрольную сумму предложения и разбивает его на поля
+func splitNMEA(sentence string) ([]string, error) {
+	body := strings.TrimPrefix(sentence, "$")
+
+	star := strings.LastIndexByte(body, '*')
+	if star < 0 {
+		return nil, fmt.Errorf("%w: нет контрольной суммы", ErrNMEASentence)
+	}
+
+	want, err := strconv.ParseUint(body[star+1:], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("%w: контрольная сумма %q", ErrNMEASentence, body[star+1:])
+	}
+
+	body = body[:star]
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	if sum != byte(want) {
+		return nil, fmt.Errorf("%w: %02X, ожидается %02X", ErrNMEAChecksum, sum, want)
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) < 3 {
+		return nil, fmt.Errorf("%w: адрес %q", ErrNMEASentence, fields[0])
+	}
+
+	return fields, nil
+}
+
+// parseNMEATime разбирает время UTC hhmmss.ss и возвращает время от начала суток
+func parseNMEATime(s string) (time.Duration, error) {
+	if len(s) < 6 {
+		return 0, fmt.Errorf("%w %q", ErrBadTimestamp, s)
+	}
+
+	h, errH := strconv.Atoi(s[0:2])
+	m, errM := strconv.Atoi(s[2:4])
+	sec, errS := strconv.ParseFloat(s[4:], 64)
+	if errH != nil || errM != nil || errS != nil || h > 23 || m > 59 || sec >= 61 {
+		return 0, fmt.Errorf("%w %q", ErrBadTimestamp, s)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(math.Round(sec*1e6))*time.Microsecond, nil
+}
+
+// nmeaPosition разбирает пару координат ddmm.mmmm,N,dddmm.mmmm,E начиная с поля idx.
+// ok = false, если координаты не заполнены.
+func nmeaPosition(f []string, idx int, kind string) (lat, lon float64, ok bool, err error) {
+	if f[idx] == "" || f[idx+2] == "" {
+		return 0, 0, false, nil
+	}
+
+	lat, err = nmeaDegrees(f[idx], f[idx+1], "N", "S")
+	if err != nil {
+		return 0, 0, false, &fieldError{field: kind + ".latitude", err: err}
+	}
+	lon, err = nmeaDegrees(f[idx+2], f[idx+3], "E", "W")
+	if err != nil {
+		return 0, 0, false, &fieldError{field: kind + ".longitude", err: err}
+	}
+
+	return lat, lon, true, nil
+}
+
+// nmeaDegrees переводит координату из формата (d)ddmm.mmmm с полушарием в градусы
+func nmeaDegrees(value, hemisphere, positive, negative string) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q", ErrBadNumber, value)
+	}
+
+	deg := math.Floor(v / 100)
+	deg += (v - deg*100) / 60
+
+	switch hemisphere {
+	case positive:
+		return deg, nil
+	case negative:
+		return -deg, nil
+	}
+	return 0, fmt.Errorf("%w: полушарие %q", ErrNMEASentence, hemisphere)
+}
+
+// nmeaFloat разбирает числовое поле предложения (пустое поле равно нулю)
+func nmeaFloat(f []string, idx int, field string) (float64, error) {
+	if idx >= len(f) || f[idx] == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseFloat(f[idx], 64)
+	if err != nil {
+		return 0, &fieldError{field: field, err: fmt.Errorf("%w %q", ErrBadNumber, f[idx])}
+	}
+	return v, nil
+}
+
+// nmeaInt разбирает целочисленное поле предложения (пустое поле равно нулю)
+func nmeaInt(f []string, idx int, field string) (int, error) {
+	if idx >= len(f) || f[idx] == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.Atoi(f[idx])
+	if err != nil {
+		return 0, &fieldError{field: field, err: fmt.Errorf("%w %q", ErrBadNumber, f[idx])}
+	}
+	return v, nil
+}
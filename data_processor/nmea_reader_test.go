@@ -0,0 +1,226 @@
+package data_processor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"main.go/config"
+	"main.go/internal/models"
+)
+
+// nmeaSentence дописывает к телу предложения верную контрольную сумму
+func nmeaSentence(body string) string {
+	var sum byte
+	for i := 0; i < len(body); i++ {
+		sum ^= body[i]
+	}
+	return fmt.Sprintf("$%s*%02X", body, sum)
+}
+
+// readNMEA разбирает журнал из предложений и возвращает все отсчеты
+func readNMEA(t *testing.T, mode string, sentences ...string) ([]models.GNSSData, *ParseReport, error) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Sensors.ParseMode = mode
+	report := &ParseReport{}
+	data, err := collect(StreamGNSSNMEA(strings.NewReader(strings.Join(sentences, "\n")), "test.nmea", cfg, report))
+	return data, report, err
+}
+
+func TestSplitNMEAChecksum(t *testing.T) {
+	const body = "GPGGA,120000.00,5545.0000,N,03737.0000,E,1,08,0.9,150.0,M,,M,,"
+	valid := nmeaSentence(body)
+
+	tests := []struct {
+		name     string
+		sentence string
+		want     error
+	}{
+		{"верная сумма", valid, nil},
+		{"сумма в нижнем регистре", valid[:len(valid)-2] + strings.ToLower(valid[len(valid)-2:]), nil},
+		{"неверная сумма", "$" + body + "*00", ErrNMEAChecksum},
+		{"нет суммы", "$" + body, ErrNMEASentence},
+		{"сумма не шестнадцатеричная", "$" + body + "*ZZ", ErrNMEASentence},
+		{"испорченное поле", strings.Replace(valid, "120000", "120001", 1), ErrNMEAChecksum},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := splitNMEA(tt.sentence)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ошибка %v, ожидается %v", err, tt.want)
+			}
+			if err == nil && fields[0] != "GPGGA" {
+				t.Errorf("адрес %q, ожидается GPGGA", fields[0])
+			}
+		})
+	}
+}
+
+func TestStreamGNSSNMEAMidnightRollover(t *testing.T) {
+	gga := func(tod string) string {
+		return nmeaSentence("GPGGA," + tod + ",5545.0000,N,03737.0000,E,1,08,0.9,150.0,M,,M,,")
+	}
+	rmc := func(tod, date string) string {
+		return nmeaSentence("GPRMC," + tod + ",A,5545.0000,N,03737.0000,E,10.0,90.0," + date + ",,,A")
+	}
+	day := time.Date(2024, 7, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		sentences []string
+		want      []time.Time
+	}{
+		{
+			name:      "переход без нового RMC",
+			sentences: []string{rmc("235959.00", "310724"), gga("235959.00"), gga("000000.00"), gga("000001.00")},
+			want: []time.Time{
+				day.Add(24*time.Hour - time.Second),
+				day.Add(24 * time.Hour),
+				day.Add(24*time.Hour + time.Second),
+			},
+		},
+		{
+			name:      "переход с новым RMC",
+			sentences: []string{rmc("235959.50", "310724"), rmc("000000.50", "010824"), gga("000001.50")},
+			want: []time.Time{
+				day.Add(24*time.Hour - 500*time.Millisecond),
+				day.Add(24*time.Hour + 500*time.Millisecond),
+				day.Add(24*time.Hour + 1500*time.Millisecond),
+			},
+		},
+		{
+			name:      "эпохи до первой даты пропускаются",
+			sentences: []string{gga("235958.00"), rmc("235959.00", "310724"), gga("000000.00")},
+			want: []time.Time{
+				day.Add(24*time.Hour - time.Second),
+				day.Add(24 * time.Hour),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _, err := readNMEA(t, ParseStrict, tt.sentences...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != len(tt.want) {
+				t.Fatalf("получено %d отсчетов, ожидается %d", len(data), len(tt.want))
+			}
+			for i, d := range data {
+				if !d.Timestamp.Equal(tt.want[i]) {
+					t.Errorf("отсчет %d: время %v, ожидается %v", i, d.Timestamp, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestStreamGNSSNMEASpeedPrecedence(t *testing.T) {
+	const (
+		rmc        = "GPRMC,120000.00,A,5545.0000,N,03737.0000,E,10.0,90.0,310724,,,A"
+		vtgKmh     = "GPVTG,45.0,T,,M,20.0,N,36.0,K,A"
+		vtgKnots   = "GPVTG,45.0,T,,M,20.0,N,,K,A"
+		vtgNoSpeed = "GPVTG,45.0,T,,M,,N,,K,A"
+	)
+
+	tests := []struct {
+		name      string
+		sentences []string
+		speed     float64
+	}{
+		{"только RMC", []string{rmc}, 10 * knotsToMS},
+		{"VTG после RMC", []string{rmc, vtgKmh}, 10},
+		{"VTG перед RMC", []string{vtgKmh, rmc}, 10},
+		{"VTG без км/ч", []string{rmc, vtgKnots}, 20 * knotsToMS},
+		{"VTG без скорости", []string{vtgNoSpeed, rmc}, 10 * knotsToMS},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentences := make([]string, len(tt.sentences))
+			for i, s := range tt.sentences {
+				sentences[i] = nmeaSentence(s)
+			}
+
+			data, _, err := readNMEA(t, ParseStrict, sentences...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 1 {
+				t.Fatalf("получено %d отсчетов, ожидается 1", len(data))
+			}
+			if math.Abs(data[0].Speed-tt.speed) > 1e-9 {
+				t.Errorf("скорость %v, ожидается %v", data[0].Speed, tt.speed)
+			}
+		})
+	}
+}
+
+func TestStreamGNSSNMEAChecksumModes(t *testing.T) {
+	good := nmeaSentence("GPRMC,120000.00,A,5545.0000,N,03737.0000,E,10.0,90.0,310724,,,A")
+	bad := "$GPRMC,120001.00,A,5545.0000,N,03737.0000,E,10.0,90.0,310724,,,A*00"
+
+	if _, _, err := readNMEA(t, ParseStrict, good, bad); !errors.Is(err, ErrNMEAChecksum) {
+		t.Errorf("strict: ошибка %v, ожидается %v", err, ErrNMEAChecksum)
+	}
+
+	data, report, err := readNMEA(t, ParseLenient, good, bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1 || report.Accepted != 1 || report.Dropped != 1 {
+		t.Errorf("lenient: %d отсчетов, принято %d, отброшено %d; ожидается 1, 1, 1",
+			len(data), report.Accepted, report.Dropped)
+	}
+}
+
+func TestStreamGNSSNMEAFieldPresence(t *testing.T) {
+	const (
+		gga       = "GPGGA,120000.00,5545.0000,N,03737.0000,E,1,08,0.9,150.0,M,,M,,"
+		ggaNoAlt  = "GPGGA,120000.00,5545.0000,N,03737.0000,E,1,08,0.9,,M,,M,,"
+		rmc       = "GPRMC,120000.00,A,5545.0000,N,03737.0000,E,10.0,90.0,310724,,,A"
+		rmcNoMove = "GPRMC,120000.00,A,5545.0000,N,03737.0000,E,,,310724,,,A"
+		vtgCourse = "GPVTG,45.0,T,,M,,N,,K,A"
+	)
+
+	tests := []struct {
+		name                     string
+		sentences                []string
+		altitude, speed, heading bool
+	}{
+		{"GGA и RMC", []string{rmc, gga}, true, true, true},
+		{"только RMC", []string{rmc}, false, true, true},
+		{"GGA без высоты", []string{rmc, ggaNoAlt}, false, true, true},
+		{"RMC без скорости и курса", []string{rmcNoMove, gga}, true, false, false},
+		{"курс из VTG без скорости", []string{rmcNoMove, vtgCourse}, false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sentences := make([]string, len(tt.sentences))
+			for i, s := range tt.sentences {
+				sentences[i] = nmeaSentence(s)
+			}
+
+			data, _, err := readNMEA(t, ParseStrict, sentences...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(data) != 1 {
+				t.Fatalf("получено %d отсчетов, ожидается 1", len(data))
+			}
+			d := data[0]
+			if d.HasAltitude != tt.altitude || d.HasSpeed != tt.speed || d.HasHeading != tt.heading {
+				t.Errorf("высота %v, скорость %v, курс %v; ожидается %v, %v, %v",
+					d.HasAltitude, d.HasSpeed, d.HasHeading, tt.altitude, tt.speed, tt.heading)
+			}
+		})
+	}
+}
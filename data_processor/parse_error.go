@@ -0,0 +1,169 @@
+package data_processor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Режимы разбора входных файлов
+const (
+	ParseStrict  = "strict"  // первая некорректная запись прерывает чтение с ошибкой
+	ParseLenient = "lenient" // некорректные записи пропускаются и учитываются в отчете
+)
+
+// Причины отбраковки записей
+var (
+	ErrShortRecord = errors.New("недостаточно полей в записи")
+	ErrEmptyField  = errors.New("пустое значение")
+	ErrBadNumber   = errors.New("некорректное число")
+	ErrNotFinite   = errors.New("значение не является конечным числом")
+)
+
+// ParseError ошибка разбора записи входного файла
+type ParseError struct {
+	File   string // Имя файла
+	Line   int    // Номер строки (с 1), 0 - двоичный формат
+	Column int    // Номер колонки (с 1), 0 - запись целиком
+	Offset int64  // Смещение записи в байтах (двоичные форматы)
+	Field  string // Имя поля (пусто - запись целиком)
+	Err    error  // Причина
+}
+
+func (e *ParseError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, ":%d", e.Column)
+		}
+	} else {
+		fmt.Fprintf(&b, "+%d", e.Offset)
+	}
+	if e.Field != "" {
+		fmt.Fprintf(&b, ": поле %q", e.Field)
+	}
+	fmt.Fprintf(&b, ": %v", e.Err)
+	return b.String()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// reason возвращает краткую причину отбраковки для отчета
+func (e *ParseError) reason() string {
+	cause := e.Err
+	for _, sentinel := range []error{ErrBadTimestamp, ErrBadNumber, ErrEmptyField, ErrNotFinite, ErrShortRecord, ErrNMEAChecksum, ErrNMEASentence, ErrUBXChecksum, ErrUBXLength} {
+		if errors.Is(cause, sentinel) {
+			cause = sentinel
+		}
+	}
+
+	if e.Field == "" {
+		return cause.Error()
+	}
+	return fmt.Sprintf("поле %q: %v", e.Field, cause)
+}
+
+// ParseReport итог разбора файла: сколько записей отброшено и по каким причинам
+type ParseReport struct {
+	File     string         // Имя файла
+	Accepted int            // Принято записей
+	Dropped  int            // Отброшено записей
+	Reasons  map[string]int // Число отброшенных записей по причинам
+	First    *ParseError    // Первая отброшенная запись
+}
+
+// drop учитывает отброшенную запись
+func (r *ParseReport) drop(err *ParseError) {
+	if r == nil {
+		return
+	}
+	if r.Reasons == nil {
+		r.Reasons = make(map[string]int)
+	}
+	if r.First == nil {
+		r.First = err
+	}
+	r.Dropped++
+	r.Reasons[err.reason()]++
+}
+
+// accept учитывает принятую запись
+func (r *ParseReport) accept() {
+	if r != nil {
+		r.Accepted++
+	}
+}
+
+func (r *ParseReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: принято %d, отброшено %d", r.File, r.Accepted, r.Dropped)
+
+	reasons := make([]string, 0, len(r.Reasons))
+	for reason := range r.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		return r.Reasons[reasons[i]] > r.Reasons[reasons[j]] ||
+			r.Reasons[reasons[i]] == r.Reasons[reasons[j]] && reasons[i] < reasons[j]
+	})
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "\n  %6d  %s", r.Reasons[reason], reason)
+	}
+	if r.First != nil {
+		fmt.Fprintf(&b, "\n  первая: %v", r.First)
+	}
+
+	return b.String()
+}
+
+// fieldError ошибка разбора отдельного поля записи; номер строки добавляет читатель потока
+type fieldError struct {
+	field string
+	err   error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("поле %q: %v", e.field, e.err)
+}
+
+// parseMode проверяет режим разбора из конфигурации (пустой - строгий)
+func parseMode(mode string) (string, error) {
+	switch mode {
+	case "", ParseStrict:
+		return ParseStrict, nil
+	case ParseLenient:
+		return ParseLenient, nil
+	}
+	return "", fmt.Errorf("неизвестный режим разбора %q (ожидается %s или %s)", mode, ParseStrict, ParseLenient)
+}
+
+// floatField разбирает числовое поле записи. Отсутствующее или пустое необязательное поле равно нулю.
+func floatField(record []string, schema *ColumnSchema, field string, required bool) (float64, error) {
+	raw := schema.Field(record, field)
+	if raw == "" {
+		if required {
+			return 0, &fieldError{field: field, err: ErrEmptyField}
+		}
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, &fieldError{field: field, err: fmt.Errorf("%w %q", ErrBadNumber, raw)}
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, &fieldError{field: field, err: ErrNotFinite}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,89 @@
+package data_processor
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"main.go/config"
+)
+
+// ErrBadTimestamp некорректная временная метка
+var ErrBadTimestamp = errors.New("некорректная временная метка")
+
+// TimestampParser разбирает временные метки входных файлов
+type TimestampParser struct {
+	layout   string         // Шаблон time.Parse (пустой - эпоха Unix)
+	location *time.Location // Часовой пояс для меток без зоны
+	unit     time.Duration  // Единица эпохи Unix
+}
+
+// NewTimestampParser создает парсер временных меток по описанию формата из конфигурации
+func NewTimestampParser(tf config.TimestampFormat) (*TimestampParser, error) {
+	location := time.UTC
+	if tf.Location != "" {
+		loc, err := time.LoadLocation(tf.Location)
+		if err != nil {
+			return nil, fmt.Errorf("неизвестный часовой пояс %q: %w", tf.Location, err)
+		}
+		location = loc
+	}
+
+	unit, err := epochUnit(tf.Unit)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TimestampParser{
+		layout:   tf.Layout,
+		location: location,
+		unit:     unit,
+	}, nil
+}
+
+// Parse преобразует строку с временной меткой в time.Time
+func (p *TimestampParser) Parse(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+
+	if p.layout != "" {
+		t, err := time.ParseInLocation(p.layout, s, p.location)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w %q: ожидается формат %q", ErrBadTimestamp, s, p.layout)
+		}
+		return t, nil
+	}
+
+	// Эпоха Unix: целое число сохраняем без потери точности (наносекунды не помещаются в float64)
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if v > math.MaxInt64/int64(p.unit) || v < math.MinInt64/int64(p.unit) {
+			return time.Time{}, fmt.Errorf("%w %q: вне допустимого диапазона", ErrBadTimestamp, s)
+		}
+		return time.Unix(0, v*int64(p.unit)).In(p.location), nil
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w %q: ожидается эпоха Unix", ErrBadTimestamp, s)
+	}
+
+	return time.Unix(0, int64(v*float64(p.unit))).In(p.location), nil
+}
+
+// epochUnit возвращает длительность единицы эпохи Unix
+func epochUnit(unit string) (time.Duration, error) {
+	switch unit {
+	case "", "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+
+	return 0, fmt.Errorf("неизвестная единица эпохи %q (ожидается s, ms, us или ns)", unit)
+}
@@ -0,0 +1,573 @@
+package data_processor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"time"
+
+	"main.go/config"
+	"main.go/internal/models"
+)
+
+// Ошибки разбора UBX
+var (
+	ErrUBXChecksum = errors.New("неверная контрольная сумма UBX")
+	ErrUBXLength   = errors.New("некорректная длина сообщения UBX")
+)
+
+// Синхросимволы, классы и идентификаторы сообщений UBX
+const (
+	ubxSync1 = 0xB5
+	ubxSync2 = 0x62
+
+	ubxClassNAV = 0x01
+	ubxClassESF = 0x10
+
+	ubxNavStatus = 0x03
+	ubxNavPVT    = 0x07
+	ubxEsfRaw    = 0x03
+
+	ubxMaxPayload = 8192 // Длина больше этой считается сбоем синхронизации
+)
+
+// Типы данных ESF-RAW
+const (
+	esfGyroZ = 5
+	esfGyroY = 13
+	esfGyroX = 14
+	esfAccX  = 16
+	esfAccY  = 17
+	esfAccZ  = 18
+)
+
+// UBXNavStatus состояние навигационного решения (NAV-STATUS)
+type UBXNavStatus struct {
+	ITOW    uint32        // Время недели GPS (мс)
+	FixType int           // Тип решения: 0 - нет, 1 - счисление, 2 - 2D, 3 - 3D, 4 - GNSS + счисление, 5 - только время
+	FixOK   bool          // Решение в пределах допустимых масок
+	TTFF    time.Duration // Время до первого решения
+	Uptime  time.Duration // Время с момента запуска
+}
+
+// UBXRecord запись журнала UBX: заполнено ровно одно из полей
+type UBXRecord struct {
+	GNSS   *models.GNSSData
+	ACC    *models.ACCData
+	GYRO   *models.GYROData
+	Status *UBXNavStatus
+}
+
+// ubxPVT решение NAV-PVT с временем недели GPS и меткой ESF-RAW своей эпохи
+type ubxPVT struct {
+	gnss   models.GNSSData
+	itow   uint32
+	tag    uint32
+	hasTag bool
+}
+
+// ubxFrame проверенное сообщение UBX
+type ubxFrame struct {
+	class, id byte
+	payload   []byte
+	offset    int64
+}
+
+// StreamUBX последовательно читает журнал приемника u-blox, проверяет контрольные суммы сообщений
+// и декодирует NAV-PVT (GNSS), NAV-STATUS и ESF-RAW (акселерометр, гироскоп).
+// NAV-PVT сверяется с NAV-STATUS того же iTOW независимо от порядка сообщений: решение
+// выдается, когда пришел NAV-STATUS его эпохи или сообщение NAV следующей.
+// Метки времени ESF-RAW переводятся в UTC по первому NAV-PVT с достоверным временем и
+// последней метке ESF-RAW, полученной в той же эпохе; отсчеты IMU до привязки пропускаются. Ускорения выдаются в g, угловые скорости - в град/с,
+// как в журналах Sensor Logger.
+func StreamUBX(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[UBXRecord, error] {
+	return func(yield func(UBXRecord, error) bool) {
+		mode, err := parseMode(cfg.Sensors.ParseMode)
+		if err != nil {
+			yield(UBXRecord{}, err)
+			return
+		}
+		if report != nil {
+			report.File = name
+		}
+
+		tick := cfg.Sensors.UBX.ESFTimeTag
+		if tick <= 0 {
+			tick = time.Millisecond
+		}
+
+		var (
+			status  *UBXNavStatus
+			pending *ubxPVT // NAV-PVT, ожидающий NAV-STATUS своей эпохи
+			epoch   uint32  // iTOW последнего сообщения NAV
+			hasNav  bool
+
+			// Привязка меток времени ESF-RAW к UTC
+			lastTag    uint32
+			tagEpoch   uint32 // iTOW эпохи, в которой получена lastTag
+			hasTag     bool
+			candidate  *ubxPVT // Выданное решение, ожидающее ESF-RAW своей эпохи для привязки
+			anchorTag  uint32
+			anchorTime time.Time
+			tagWraps   int64
+			prevTag    uint32
+		)
+
+		// esfTime переводит метку времени ESF-RAW в UTC с учетом переполнения счетчика
+		esfTime := func(tag uint32) time.Time {
+			if tag < prevTag && prevTag-tag > 1<<31 {
+				tagWraps++
+			}
+			prevTag = tag
+			ticks := tagWraps<<32 + int64(tag) - int64(anchorTag)
+			return anchorTime.Add(time.Duration(ticks) * tick)
+		}
+
+		// emit выдает решение NAV-PVT и, если привязки еще нет, привязывает к нему метки ESF-RAW
+		emit := func(pvt *ubxPVT) bool {
+			if anchorTime.IsZero() {
+				candidate = pvt
+				if pvt.hasTag {
+					anchorTime, anchorTag, prevTag = pvt.gnss.Timestamp, pvt.tag, pvt.tag
+					candidate = nil
+				}
+			}
+			report.accept()
+			return yield(UBXRecord{GNSS: &pvt.gnss}, nil)
+		}
+
+		// release выдает отложенное решение, для которого NAV-STATUS уже не придет
+		release := func() bool {
+			if pending == nil {
+				return true
+			}
+			pvt := pending
+			pending = nil
+			return emit(pvt)
+		}
+
+		for frame, err := range ubxFrames(r) {
+			if err != nil {
+				var perr *ParseError
+				if !errors.As(err, &perr) {
+					yield(UBXRecord{}, fmt.Errorf("%s: %w", name, err))
+					return
+				}
+				perr.File = name
+				if mode == ParseStrict {
+					yield(UBXRecord{}, perr)
+					return
+				}
+				report.drop(perr)
+				continue
+			}
+
+			reject := func(err error) bool {
+				perr := &ParseError{File: name, Offset: frame.offset, Err: err}
+				if mode == ParseStrict {
+					yield(UBXRecord{}, perr)
+					return false
+				}
+				report.drop(perr)
+				return true
+			}
+
+			switch {
+			case frame.class == ubxClassNAV && frame.id == ubxNavStatus:
+				s, err := decodeNavStatus(frame)
+				if err != nil {
+					if !reject(err) {
+						return
+					}
+					continue
+				}
+				status = s
+				epoch, hasNav = s.ITOW, true
+
+				// NAV-STATUS той же эпохи сообщает, что решение вне допустимых масок
+				if pending != nil && pending.itow == s.ITOW && !s.FixOK {
+					pending = nil
+				}
+				if !release() {
+					return
+				}
+
+				report.accept()
+				if !yield(UBXRecord{Status: s}, nil) {
+					return
+				}
+
+			case frame.class == ubxClassNAV && frame.id == ubxNavPVT:
+				gnss, itow, ok, err := decodeNavPVT(frame)
+				if err != nil {
+					if !reject(err) {
+						return
+					}
+					continue
+				}
+				epoch, hasNav = itow, true
+				if !release() {
+					return
+				}
+				if !ok {
+					continue
+				}
+
+				// NAV-STATUS может прийти до или после NAV-PVT той же эпохи
+				pvt := &ubxPVT{gnss: gnss, itow: itow}
+				if hasTag && tagEpoch == itow {
+					pvt.tag, pvt.hasTag = lastTag, true
+				}
+				if status == nil || status.ITOW != itow {
+					pending = pvt
+					continue
+				}
+				if status.FixOK && !emit(pvt) {
+					return
+				}
+
+			case frame.class == ubxClassESF && frame.id == ubxEsfRaw:
+				samples, err := decodeEsfRaw(frame)
+				if err != nil {
+					if !reject(err) {
+						return
+					}
+					continue
+				}
+				report.accept()
+				if len(samples) == 0 {
+					continue
+				}
+
+				// Метки до первого сообщения NAV не относятся ни к одной эпохе
+				if hasNav {
+					lastTag = samples[len(samples)-1].tag
+					tagEpoch = epoch
+					hasTag = true
+					if pending != nil && pending.itow == epoch && !pending.hasTag {
+						pending.tag, pending.hasTag = lastTag, true
+					}
+					if anchorTime.IsZero() && candidate != nil && candidate.itow == epoch {
+						anchorTime, anchorTag, prevTag = candidate.gnss.Timestamp, lastTag, lastTag
+						candidate = nil
+					}
+				}
+				if anchorTime.IsZero() {
+					continue
+				}
+
+				for _, s := range samples {
+					t := esfTime(s.tag)
+					if s.hasAcc {
+						acc := models.ACCData{Timestamp: t, AccelX: s.acc[0], AccelY: s.acc[1], AccelZ: s.acc[2]}
+						if !yield(UBXRecord{ACC: &acc}, nil) {
+							return
+						}
+					}
+					if s.hasGyro {
+						gyro := models.GYROData{Timestamp: t, GyroX: s.gyro[0], GyroY: s.gyro[1], GyroZ: s.gyro[2]}
+						if !yield(UBXRecord{GYRO: &gyro}, nil) {
+							return
+						}
+					}
+				}
+			}
+		}
+
+		release()
+	}
+}
+
+// StreamUBXGNSS последовательно читает решения NAV-PVT из журнала u-blox
+func StreamUBXGNSS(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GNSSData, error] {
+	return func(yield func(models.GNSSData, error) bool) {
+		for rec, err := range StreamUBX(r, name, cfg, report) {
+			if err != nil {
+				yield(models.GNSSData{}, err)
+				return
+			}
+			if rec.GNSS != nil && !yield(*rec.GNSS, nil) {
+				return
+			}
+		}
+	}
+}
+
+// StreamUBXAccelerometer последовательно читает отсчеты акселерометра ESF-RAW из журнала u-blox
+func StreamUBXAccelerometer(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.ACCData, error] {
+	return func(yield func(models.ACCData, error) bool) {
+		for rec, err := range StreamUBX(r, name, cfg, report) {
+			if err != nil {
+				yield(models.ACCData{}, err)
+				return
+			}
+			if rec.ACC != nil && !yield(*rec.ACC, nil) {
+				return
+			}
+		}
+	}
+}
+
+// StreamUBXGyro последовательно читает отсчеты гироскопа ESF-RAW из журнала u-blox
+func StreamUBXGyro(r io.Reader, name string, cfg *config.Config, report *ParseReport) iter.Seq2[models.GYROData, error] {
+	return func(yield func(models.GYROData, error) bool) {
+		for rec, err := range StreamUBX(r, name, cfg, report) {
+			if err != nil {
+				yield(models.GYROData{}, err)
+				return
+			}
+			if rec.GYRO != nil && !yield(*rec.GYRO, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ReadUBX читает журнал u-blox и разделяет его на данные акселерометра, гироскопа и GNSS
+func ReadUBX(filename string, cfg *config.Config, report *ParseReport) ([]models.ACCData, []models.GYROData, []models.GNSSData, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer file.Close()
+
+	var accData []models.ACCData
+	var gyroData []models.GYROData
+	var gnssData []models.GNSSData
+
+	for rec, err := range StreamUBX(file, filename, cfg, report) {
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		switch {
+		case rec.GNSS != nil:
+			gnssData = append(gnssData, *rec.GNSS)
+		case rec.ACC != nil:
+			accData = append(accData, *rec.ACC)
+		case rec.GYRO != nil:
+			gyroData = append(gyroData, *rec.GYRO)
+		}
+	}
+
+	return accData, gyroData, gnssData, nil
+}
+
+// ubxFrames выделяет из потока сообщения UBX с верной контрольной суммой.
+// При сбое выдает *ParseError и продолжает поиск синхросимволов со следующего байта.
+func ubxFrames(r io.Reader) iter.Seq2[ubxFrame, error] {
+	return func(yield func(ubxFrame, error) bool) {
+		br := bufio.NewReaderSize(r, ubxMaxPayload+8)
+		var offset int64
+
+		for {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				yield(ubxFrame{}, err)
+				return
+			}
+			offset++
+			if b != ubxSync1 {
+				continue
+			}
+
+			start := offset - 1
+
+			head, err := br.Peek(5)
+			if err != nil {
+				if err == io.EOF {
+					return
+				}
+				yield(ubxFrame{}, err)
+				return
+			}
+			if head[0] != ubxSync2 {
+				continue
+			}
+
+			length := int(binary.LittleEndian.Uint16(head[3:5]))
+			if length > ubxMaxPayload {
+				if !yield(ubxFrame{}, &ParseError{Offset: start, Err: fmt.Errorf("%w: %d", ErrUBXLength, length)}) {
+					return
+				}
+				continue
+			}
+
+			// sync2, class, id, length(2), payload, ck_a, ck_b
+			frame, err := br.Peek(5 + length + 2)
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					yield(ubxFrame{}, &ParseError{Offset: start, Err: fmt.Errorf("%w: сообщение обрезано", ErrUBXLength)})
+					return
+				}
+				yield(ubxFrame{}, err)
+				return
+			}
+
+			ckA, ckB := ubxChecksum(frame[1 : 5+length])
+			if ckA != frame[5+length] || ckB != frame[5+length+1] {
+				err := fmt.Errorf("%w: класс 0x%02X, id 0x%02X", ErrUBXChecksum, frame[1], frame[2])
+				if !yield(ubxFrame{}, &ParseError{Offset: start, Err: err}) {
+					return
+				}
+				continue
+			}
+
+			payload := make([]byte, length)
+			copy(payload, frame[5:5+length])
+			class, id := frame[1], frame[2]
+
+			n, _ := br.Discard(5 + length + 2)
+			offset += int64(n)
+
+			if !yield(ubxFrame{class: class, id: id, payload: payload, offset: start}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ubxChecksum вычисляет 8-битную контрольную сумму Флетчера по классу, id, длине и данным сообщения
+func ubxChecksum(data []byte) (byte, byte) {
+	var a, b byte
+	for _, c := range data {
+		a += c
+		b += a
+	}
+	return a, b
+}
+
+// decodeNavStatus декодирует NAV-STATUS
+func decodeNavStatus(f ubxFrame) (*UBXNavStatus, error) {
+	p := f.payload
+	if len(p) < 16 {
+		return nil, fmt.Errorf("%w: NAV-STATUS %d байт", ErrUBXLength, len(p))
+	}
+
+	return &UBXNavStatus{
+		ITOW:    binary.LittleEndian.Uint32(p[0:4]),
+		FixType: int(p[4]),
+		FixOK:   p[5]&0x01 != 0,
+		TTFF:    time.Duration(binary.LittleEndian.Uint32(p[8:12])) * time.Millisecond,
+		Uptime:  time.Duration(binary.LittleEndian.Uint32(p[12:16])) * time.Millisecond,
+	}, nil
+}
+
+// decodeNavPVT декодирует NAV-PVT. ok = false, если решения нет или время недостоверно.
+func decodeNavPVT(f ubxFrame) (gnss models.GNSSData, itow uint32, ok bool, err error) {
+	p := f.payload
+	if len(p) < 92 {
+		return gnss, 0, false, fmt.Errorf("%w: NAV-PVT %d байт", ErrUBXLength, len(p))
+	}
+
+	le := binary.LittleEndian
+	i4 := func(off int) float64 { return float64(int32(le.Uint32(p[off : off+4]))) }
+	u4 := func(off int) float64 { return float64(le.Uint32(p[off : off+4])) }
+
+	itow = le.Uint32(p[0:4])
+	valid := p[11]
+	fixType := int(p[20])
+	flags := p[21]
+
+	validDate := valid&0x01 != 0
+	validTime := valid&0x02 != 0
+	fixOK := flags&0x01 != 0
+	if !validDate || !validTime || !fixOK || fixType < 2 || fixType > 4 {
+		return gnss, itow, false, nil
+	}
+
+	gnss.Timestamp = time.Date(int(le.Uint16(p[4:6])), time.Month(p[6]), int(p[7]),
+		int(p[8]), int(p[9]), int(p[10]), 0, time.UTC).
+		Add(time.Duration(int32(le.Uint32(p[16:20]))))
+
+	gnss.Longitude = i4(24) * 1e-7
+	gnss.Latitude = i4(28) * 1e-7
+	gnss.Altitude = i4(36) * 1e-3 // высота над уровнем моря
+	gnss.HorizontalAccuracy = u4(40) * 1e-3
+	gnss.VerticalAccuracy = u4(44) * 1e-3
+	gnss.Speed = i4(60) * 1e-3
+	gnss.Heading = i4(64) * 1e-5
+	gnss.SpeedAccuracy = u4(68) * 1e-3
+	gnss.BearingAccuracy = u4(72) * 1e-5
+	gnss.HasAltitude = fixType != 2 // в 2D-решении высота не определяется
+	gnss.HasSpeed, gnss.HasHeading = true, true
+	gnss.PDOP = float64(le.Uint16(p[76:78])) * 0.01
+
+	gnss.FixType = fixType
+	gnss.Satellites = int(p[23])
+	gnss.FixQuality = 1
+	if flags&0x02 != 0 {
+		gnss.FixQuality = 2 // дифференциальные поправки
+	}
+	switch flags >> 6 {
+	case 1:
+		gnss.FixQuality = 5 // RTK float
+	case 2:
+		gnss.FixQuality = 4 // RTK fixed
+	}
+
+	return gnss, itow, true, nil
+}
+
+// esfSample отсчет IMU из ESF-RAW с одной меткой времени
+type esfSample struct {
+	tag               uint32
+	acc, gyro         [3]float64
+	accSeen, gyroSeen [3]bool
+	hasAcc, hasGyro   bool // Получены все три оси
+}
+
+// decodeEsfRaw декодирует ESF-RAW и группирует измерения по меткам времени
+func decodeEsfRaw(f ubxFrame) ([]esfSample, error) {
+	p := f.payload
+	if len(p) < 4 || (len(p)-4)%8 != 0 {
+		return nil, fmt.Errorf("%w: ESF-RAW %d байт", ErrUBXLength, len(p))
+	}
+
+	const gravity = 9.81
+
+	var samples []esfSample
+	index := make(map[uint32]int)
+
+	for off := 4; off < len(p); off += 8 {
+		word := binary.LittleEndian.Uint32(p[off : off+4])
+		tag := binary.LittleEndian.Uint32(p[off+4 : off+8])
+
+		// 24 младших бита - значение со знаком, следующие 6 бит - тип данных
+		value := float64(int32(word<<8) >> 8)
+		dataType := int(word>>24) & 0x3F
+
+		i, ok := index[tag]
+		if !ok {
+			i = len(samples)
+			index[tag] = i
+			samples = append(samples, esfSample{tag: tag})
+		}
+		s := &samples[i]
+
+		switch dataType {
+		case esfGyroX, esfGyroY, esfGyroZ:
+			axis := map[int]int{esfGyroX: 0, esfGyroY: 1, esfGyroZ: 2}[dataType]
+			s.gyro[axis] = value / (1 << 12) // град/с
+			s.gyroSeen[axis] = true
+		case esfAccX, esfAccY, esfAccZ:
+			axis := dataType - esfAccX
+			s.acc[axis] = value / (1 << 10) / gravity // м/с² -> g
+			s.accSeen[axis] = true
+		}
+	}
+
+	for i := range samples {
+		s := &samples[i]
+		s.hasAcc = s.accSeen[0] && s.accSeen[1] && s.accSeen[2]
+		s.hasGyro = s.gyroSeen[0] && s.gyroSeen[1] && s.gyroSeen[2]
+	}
+
+	return samples, nil
+}
@@ -0,0 +1,261 @@
+package data_processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"main.go/config"
+)
+
+// ubxMessage собирает сообщение UBX с контрольной суммой
+func ubxMessage(class, id byte, payload []byte) []byte {
+	msg := []byte{ubxSync1, ubxSync2, class, id, 0, 0}
+	binary.LittleEndian.PutUint16(msg[4:6], uint16(len(payload)))
+	msg = append(msg, payload...)
+	a, b := ubxChecksum(msg[2:])
+	return append(msg, a, b)
+}
+
+// navPVT собирает NAV-PVT с достоверным 3D-решением на момент t
+func navPVT(itow uint32, t time.Time) []byte {
+	p := make([]byte, 92)
+	le := binary.LittleEndian
+	i4 := func(off int, v int32) { le.PutUint32(p[off:off+4], uint32(v)) }
+	le.PutUint32(p[0:4], itow)
+	le.PutUint16(p[4:6], uint16(t.Year()))
+	p[6], p[7] = byte(t.Month()), byte(t.Day())
+	p[8], p[9], p[10] = byte(t.Hour()), byte(t.Minute()), byte(t.Second())
+	p[11] = 0x03 // validDate, validTime
+	i4(16, int32(t.Nanosecond()))
+	p[20] = 3    // 3D
+	p[21] = 0x01 // gnssFixOK
+	p[23] = 12
+	i4(24, 376166667)  // 37.6166667°
+	i4(28, -557500000) // -55.75°
+	i4(36, 150250)     // 150.25 м
+	le.PutUint32(p[40:44], 1500)
+	le.PutUint32(p[44:48], 2500)
+	i4(60, 12345)    // 12.345 м/с
+	i4(64, 27012345) // 270.12345°
+	le.PutUint32(p[68:72], 350)
+	le.PutUint32(p[72:76], 123456)
+	le.PutUint16(p[76:78], 185)
+	return ubxMessage(ubxClassNAV, ubxNavPVT, p)
+}
+
+// navStatus собирает NAV-STATUS
+func navStatus(itow uint32, fixOK bool) []byte {
+	p := make([]byte, 16)
+	binary.LittleEndian.PutUint32(p[0:4], itow)
+	p[4] = 3
+	if fixOK {
+		p[5] = 0x01
+	}
+	return ubxMessage(ubxClassNAV, ubxNavStatus, p)
+}
+
+// esfRaw собирает ESF-RAW с полным набором осей гироскопа и акселерометра для каждой метки
+func esfRaw(tags ...uint32) []byte {
+	p := make([]byte, 4)
+	for _, tag := range tags {
+		for _, dataType := range []uint32{esfGyroX, esfGyroY, esfGyroZ, esfAccX, esfAccY, esfAccZ} {
+			block := make([]byte, 8)
+			binary.LittleEndian.PutUint32(block[0:4], dataType<<24|1<<10)
+			binary.LittleEndian.PutUint32(block[4:8], tag)
+			p = append(p, block...)
+		}
+	}
+	return ubxMessage(ubxClassESF, ubxEsfRaw, p)
+}
+
+// readUBX разбирает журнал из сообщений и возвращает все записи
+func readUBX(t *testing.T, mode string, messages ...[]byte) ([]UBXRecord, *ParseReport, error) {
+	t.Helper()
+
+	cfg := &config.Config{}
+	cfg.Sensors.ParseMode = mode
+	cfg.Sensors.UBX.ESFTimeTag = time.Millisecond
+	report := &ParseReport{}
+	records, err := collect(StreamUBX(bytes.NewReader(bytes.Join(messages, nil)), "test.ubx", cfg, report))
+	return records, report, err
+}
+
+func TestUBXChecksum(t *testing.T) {
+	valid := navStatus(1000, true)
+	corrupted := bytes.Clone(valid)
+	corrupted[len(corrupted)-1]++
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		records  int
+		dropped  int
+	}{
+		{"верная сумма", [][]byte{valid}, 1, 0},
+		{"неверная сумма", [][]byte{corrupted}, 0, 1},
+		{"мусор между сообщениями", [][]byte{valid, {0x00, ubxSync1, 0x13}, valid}, 2, 0},
+		{"сбой не мешает следующему сообщению", [][]byte{corrupted, valid}, 1, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, report, err := readUBX(t, ParseLenient, tt.messages...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tt.records || report.Dropped != tt.dropped {
+				t.Errorf("%d записей, отброшено %d; ожидается %d, %d", len(records), report.Dropped, tt.records, tt.dropped)
+			}
+		})
+	}
+
+	if _, _, err := readUBX(t, ParseStrict, corrupted); !errors.Is(err, ErrUBXChecksum) {
+		t.Errorf("strict: ошибка %v, ожидается %v", err, ErrUBXChecksum)
+	}
+}
+
+func TestDecodeNavPVTScaling(t *testing.T) {
+	at := time.Date(2024, 7, 31, 12, 30, 15, 250_000_000, time.UTC)
+	msg := navPVT(1000, at)
+	gnss, itow, ok, err := decodeNavPVT(ubxFrame{class: msg[2], id: msg[3], payload: msg[6 : len(msg)-2]})
+	if err != nil || !ok {
+		t.Fatalf("ok = %v, ошибка %v", ok, err)
+	}
+	if itow != 1000 || !gnss.Timestamp.Equal(at) {
+		t.Errorf("iTOW %d, время %v; ожидается 1000, %v", itow, gnss.Timestamp, at)
+	}
+
+	tests := []struct {
+		name      string
+		got, want float64
+	}{
+		{"широта", gnss.Latitude, -55.75},
+		{"долгота", gnss.Longitude, 37.6166667},
+		{"высота", gnss.Altitude, 150.25},
+		{"точность в плане", gnss.HorizontalAccuracy, 1.5},
+		{"точность по высоте", gnss.VerticalAccuracy, 2.5},
+		{"скорость", gnss.Speed, 12.345},
+		{"курс", gnss.Heading, 270.12345},
+		{"точность скорости", gnss.SpeedAccuracy, 0.35},
+		{"точность курса", gnss.BearingAccuracy, 1.23456},
+		{"PDOP", gnss.PDOP, 1.85},
+	}
+	for _, tt := range tests {
+		if math.Abs(tt.got-tt.want) > 1e-9 {
+			t.Errorf("%s: %v, ожидается %v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if !gnss.HasAltitude || !gnss.HasSpeed || !gnss.HasHeading {
+		t.Errorf("3D: высота %v, скорость %v, курс %v; ожидаются все поля", gnss.HasAltitude, gnss.HasSpeed, gnss.HasHeading)
+	}
+	payload := bytes.Clone(msg[6 : len(msg)-2])
+	payload[20] = 2 // 2D
+	if gnss, _, _, _ := decodeNavPVT(ubxFrame{payload: payload}); gnss.HasAltitude {
+		t.Error("2D: высота не должна считаться пришедшей")
+	}
+
+	if _, _, _, err := decodeNavPVT(ubxFrame{payload: make([]byte, 91)}); !errors.Is(err, ErrUBXLength) {
+		t.Errorf("короткий NAV-PVT: ошибка %v, ожидается %v", err, ErrUBXLength)
+	}
+}
+
+func TestStreamUBXNavStatusOrder(t *testing.T) {
+	at := time.Date(2024, 7, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		gnss     int
+	}{
+		{"STATUS до PVT, решение принято", [][]byte{navStatus(1000, true), navPVT(1000, at)}, 1},
+		{"STATUS после PVT, решение принято", [][]byte{navPVT(1000, at), navStatus(1000, true)}, 1},
+		{"STATUS до PVT, решение вне масок", [][]byte{navStatus(1000, false), navPVT(1000, at)}, 0},
+		{"STATUS после PVT, решение вне масок", [][]byte{navPVT(1000, at), navStatus(1000, false)}, 0},
+		{"STATUS другой эпохи", [][]byte{navPVT(1000, at), navStatus(2000, false)}, 1},
+		{"без STATUS", [][]byte{navPVT(1000, at), navPVT(2000, at.Add(time.Second))}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, _, err := readUBX(t, ParseStrict, tt.messages...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gnss := 0
+			for _, r := range records {
+				if r.GNSS != nil {
+					gnss++
+				}
+			}
+			if gnss != tt.gnss {
+				t.Errorf("получено %d решений, ожидается %d", gnss, tt.gnss)
+			}
+		})
+	}
+}
+
+func TestStreamUBXEsfTime(t *testing.T) {
+	at := time.Date(2024, 7, 31, 12, 0, 0, 0, time.UTC)
+	const nearWrap = math.MaxUint32 - 9
+
+	tests := []struct {
+		name     string
+		messages [][]byte
+		want     []time.Time
+	}{
+		{
+			name:     "привязка к метке той же эпохи",
+			messages: [][]byte{esfRaw(100), navPVT(1000, at), esfRaw(1090, 1100), navPVT(2000, at.Add(time.Second)), esfRaw(1110)},
+			want:     []time.Time{at.Add(10 * time.Millisecond)},
+		},
+		{
+			name:     "метка предыдущей эпохи не используется",
+			messages: [][]byte{navStatus(0, true), esfRaw(50), navPVT(1000, at), navStatus(1000, true), esfRaw(1100), esfRaw(1110)},
+			want:     []time.Time{at, at.Add(10 * time.Millisecond)},
+		},
+		{
+			name:     "метка после STATUS той же эпохи",
+			messages: [][]byte{navStatus(1000, true), esfRaw(1100), navPVT(1000, at), esfRaw(1110)},
+			want:     []time.Time{at.Add(10 * time.Millisecond)},
+		},
+		{
+			name:     "переполнение счетчика",
+			messages: [][]byte{navPVT(1000, at), navStatus(1000, true), esfRaw(nearWrap), esfRaw(math.MaxUint32, 0, 10)},
+			want: []time.Time{
+				at,
+				at.Add(9 * time.Millisecond),
+				at.Add(10 * time.Millisecond),
+				at.Add(20 * time.Millisecond),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, _, err := readUBX(t, ParseStrict, tt.messages...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []time.Time
+			for _, r := range records {
+				if r.ACC != nil {
+					got = append(got, r.ACC.Timestamp)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("получено %d отсчетов, ожидается %d: %v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("отсчет %d: время %v, ожидается %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
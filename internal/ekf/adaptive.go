@@ -0,0 +1,237 @@
+package ekf
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// NoiseProcess тип записи адаптации шума процесса
+const NoiseProcess = "process"
+
+// AdaptiveNoiseConfig параметры адаптации шумов по невязкам (Sage-Husa)
+type AdaptiveNoiseConfig struct {
+	Forgetting float64    // Коэффициент забывания b из (0, 1): чем ближе к 1, тем медленнее адаптация
+	Q          bool       // Адаптировать шум процесса
+	R          bool       // Адаптировать шум измерений
+	QBounds    [2]float64 // Границы диагонали Q относительно исходного шума процесса
+	RBounds    [2]float64 // Границы диагонали R относительно шума измерения эпохи
+	Output     io.Writer  // Таблица CSV адаптированных значений (nil - не выводится)
+}
+
+// NoiseAdapter оценивает диагонали Q и R по невязкам методом согласования ковариаций
+// с коэффициентом забывания b; вес нового значения d_k = (1-b)/(1-b^(k+1)):
+//
+//	R̂ = (1-d)·R̂ + d·(ν² - diag(H·P⁻·Hᵀ))
+//	Q̂ = (1-d)·Q̂ + d·Q_est,  Q_est = diag(K·ν·νᵀ·Kᵀ + P⁺ - Φ·P·Φᵀ)/n,  n - число предсказаний в эпохе
+//
+// Обе оценки ограничены границами адаптации. R̂ используется начиная со следующей эпохи измерения;
+// отброшенные измерения не учитываются. Значения выводятся в таблицу CSV после каждого обновления.
+type NoiseAdapter struct {
+	cfg AdaptiveNoiseConfig
+
+	q0       []float64 // Исходная диагональ Q
+	q        []float64 // Текущая диагональ Q̂
+	qUpdates int
+	steps    int // Предсказаний с последней эпохи измерений
+
+	r map[string]*adaptedNoise // R̂ по типам измерений
+
+	out *models.CSVTable // Таблица адаптированных значений (nil - не выводится)
+}
+
+// adaptedNoise оценка диагонали R одного типа измерения
+type adaptedNoise struct {
+	values  []float64
+	updates int
+}
+
+// NewNoiseAdapter создает адаптацию шумов с исходной диагональью шума процесса q
+func NewNoiseAdapter(cfg AdaptiveNoiseConfig, q []float64) (*NoiseAdapter, error) {
+	if cfg.Forgetting <= 0 || cfg.Forgetting >= 1 {
+		return nil, fmt.Errorf("коэффициент забывания %v вне (0, 1)", cfg.Forgetting)
+	}
+	for _, b := range [][2]float64{cfg.QBounds, cfg.RBounds} {
+		if b[0] <= 0 || b[1] < b[0] {
+			return nil, fmt.Errorf("неверные границы адаптации шума %v", b)
+		}
+	}
+
+	a := &NoiseAdapter{
+		cfg: cfg,
+		q0:  append([]float64(nil), q...),
+		q:   append([]float64(nil), q...),
+		r:   make(map[string]*adaptedNoise),
+	}
+	if cfg.Output != nil {
+		out, err := models.NewCSVTable(cfg.Output, "адаптированных шумов", []string{"time", "type", "values"})
+		if err != nil {
+			return nil, err
+		}
+		a.out = out
+	}
+	return a, nil
+}
+
+// Flush дописывает буферизованные значения в таблицу и возвращает первую ошибку вывода
+func (a *NoiseAdapter) Flush() error {
+	if a.out == nil {
+		return nil
+	}
+	return a.out.Flush()
+}
+
+// ProcessNoise возвращает текущую диагональ Q̂
+func (a *NoiseAdapter) ProcessNoise() []float64 {
+	return append([]float64(nil), a.q...)
+}
+
+// MeasurementNoise возвращает текущую диагональ R̂ для типа измерения typ (nil - еще не оценивалась)
+func (a *NoiseAdapter) MeasurementNoise(typ string) []float64 {
+	if r, ok := a.r[typ]; ok {
+		return append([]float64(nil), r.values...)
+	}
+	return nil
+}
+
+// String возвращает итоговые значения: Q̂ относительно исходного Q и R̂ по типам
+func (a *NoiseAdapter) String() string {
+	var b strings.Builder
+	if a.cfg.Q {
+		ratio := make([]float64, len(a.q))
+		for i := range a.q {
+			if a.q0[i] > 0 {
+				ratio[i] = a.q[i] / a.q0[i]
+			}
+		}
+		fmt.Fprintf(&b, "%s: %d адаптаций, Q̂/Q %s\n", NoiseProcess, a.qUpdates, formatValues(ratio))
+	}
+	for _, typ := range slices.Sorted(maps.Keys(a.r)) {
+		r := a.r[typ]
+		fmt.Fprintf(&b, "%s: %d адаптаций, R̂ %s\n", typ, r.updates, formatValues(r.values))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// write выводит адаптированные значения типа typ (process - диагональ Q); ошибка сохраняется до Flush
+func (a *NoiseAdapter) write(t time.Time, typ string, values []float64) {
+	if a.out != nil {
+		a.out.Write([]string{t.Format(time.RFC3339Nano), typ, formatFloats(values)})
+	}
+}
+
+// predicted отмечает выполненное предсказание
+func (a *NoiseAdapter) predicted() {
+	a.steps++
+}
+
+// epoch завершает эпоху измерений
+func (a *NoiseAdapter) epoch() {
+	a.steps = 0
+}
+
+// measurementNoise возвращает диагональ R для измерения типа typ с шумом эпохи base:
+// R̂, ограниченную границами относительно base (base - до первой оценки)
+func (a *NoiseAdapter) measurementNoise(typ string, base []float64) []float64 {
+	r, ok := a.r[typ]
+	if !a.cfg.R || !ok {
+		return base
+	}
+
+	diag := make([]float64, len(base))
+	for i := range base {
+		diag[i] = clamp(r.values[i], a.cfg.RBounds[0]*base[i], a.cfg.RBounds[1]*base[i])
+	}
+	return diag
+}
+
+// observe обновляет оценки по невязке inn коррекции измерением типа typ с ковариацией невязки s,
+// шумом измерения r и коэффициентом усиления gain. Возвращает true, если изменилась Q̂.
+func (a *NoiseAdapter) observe(t time.Time, typ string, inn mat.Vector, s mat.Symmetric, r []float64, gain mat.Matrix) bool {
+	ny := inn.Len()
+
+	if a.cfg.R {
+		an, ok := a.r[typ]
+		if !ok {
+			an = &adaptedNoise{values: append([]float64(nil), r...)}
+			a.r[typ] = an
+		}
+		d := a.weight(an.updates)
+		for i := 0; i < ny; i++ {
+			// ν² - (S - R) = ν² - H·P⁻·Hᵀ
+			e := inn.AtVec(i)*inn.AtVec(i) - (s.At(i, i) - r[i])
+			an.values[i] = math.Max((1-d)*an.values[i]+d*e, 0)
+		}
+		an.updates++
+		a.write(t, typ, an.values)
+	}
+
+	if !a.cfg.Q {
+		return false
+	}
+
+	// Q_est = (K·ν·νᵀ·Kᵀ + P⁺ - Φ·P·Φᵀ)/n; при P⁻ = Φ·P·Φᵀ + n·Q̂ и P⁺ = P⁻ - K·S·Kᵀ
+	// Q_est = Q̂ + K·(ν·νᵀ - S)·Kᵀ/n
+	kn := &mat.VecDense{}
+	kn.MulVec(gain, inn)
+	ks := &mat.Dense{}
+	ks.Mul(gain, s)
+	ksk := &mat.Dense{}
+	ksk.Mul(ks, gain.T())
+
+	d := a.weight(a.qUpdates)
+	n := float64(max(a.steps, 1))
+	for i := range a.q {
+		estimate := a.q[i] + (kn.AtVec(i)*kn.AtVec(i)-ksk.At(i, i))/n
+		a.q[i] = clamp((1-d)*a.q[i]+d*estimate, a.cfg.QBounds[0]*a.q0[i], a.cfg.QBounds[1]*a.q0[i])
+	}
+	a.qUpdates++
+	a.write(t, NoiseProcess, a.q)
+
+	return true
+}
+
+// weight возвращает вес нового значения после k обновлений
+func (a *NoiseAdapter) weight(k int) float64 {
+	b := a.cfg.Forgetting
+	return (1 - b) / (1 - math.Pow(b, float64(k+1)))
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Min(math.Max(v, lo), hi)
+}
+
+func formatValues(v []float64) string {
+	s := make([]string, len(v))
+	for i, x := range v {
+		s[i] = fmt.Sprintf("%.3g", x)
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// AdaptiveNoise возвращает адаптацию шумов (nil - выключена)
+func (w *EKFWrapper) AdaptiveNoise() *NoiseAdapter {
+	return w.adapter
+}
+
+// setProcessNoise задает диагональ шума процесса фильтра
+func (w *EKFWrapper) setProcessNoise(diag []float64) error {
+	Q := mat.NewSymDense(len(diag), nil)
+	for i := 0; i < len(diag); i++ {
+		Q.SetSym(i, i, diag[i])
+	}
+	q, err := NewSeededGaussian(Q, nil)
+	if err != nil {
+		return fmt.Errorf("ошибка создания шума процесса: %w", err)
+	}
+
+	return w.kf.SetStateNoise(q)
+}
@@ -0,0 +1,201 @@
+package ekf
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// FilterState состояние обертки фильтра для возобновления обработки.
+// Фильтр при восстановлении создается из той же конфигурации; история состояний
+// и прямой проход сглаживания начинаются заново с восстановленного состояния.
+type FilterState struct {
+	Filter   string         `json:"filter"` // Тип фильтра (ekf, eskf, ukf)
+	Time     time.Time      `json:"time"`
+	State    []float64      `json:"state"`
+	Cov      []float64      `json:"cov"` // Ковариация фильтра по строкам (для eskf - в пространстве ошибки)
+	DT       float64        `json:"dt"`  // Шаг интегрирования модели
+	Rejected map[string]int `json:"rejected,omitempty"`
+	RNG      []byte         `json:"rng,omitempty"`   // Состояние генератора шумов моделирования
+	Truth    []float64      `json:"truth,omitempty"` // Эталонное состояние моделирования
+
+	Adaptive *AdaptiveState `json:"adaptive,omitempty"`
+	IMM      *IMMState      `json:"imm,omitempty"` // Для IMM: State и Cov - объединенная оценка
+}
+
+// IMMState состояние IMM: вероятности и состояния режимов
+type IMMState struct {
+	Probabilities []float64      `json:"probabilities"`
+	Mixed         bool           `json:"mixed"`
+	Modes         []*FilterState `json:"modes"`
+}
+
+// AdaptiveState состояние адаптации шумов
+type AdaptiveState struct {
+	Q        []float64                `json:"q"`
+	QUpdates int                      `json:"q_updates"`
+	Steps    int                      `json:"steps,omitempty"` // Предсказаний с последней эпохи измерений
+	R        map[string]AdaptiveNoise `json:"r,omitempty"`
+}
+
+// AdaptiveNoise оценка диагонали R типа измерения
+type AdaptiveNoise struct {
+	Values  []float64 `json:"values"`
+	Updates int       `json:"updates"`
+}
+
+// Checkpoint возвращает текущее состояние обертки
+func (w *EKFWrapper) Checkpoint() (*FilterState, error) {
+	cov := w.kf.Cov()
+	s := &FilterState{
+		Filter:   filterName(w.config.Filter),
+		Time:     w.lastTime,
+		State:    mat.Col(nil, 0, w.lastEstimate.Val()),
+		Cov:      mat.DenseCopyOf(cov).RawMatrix().Data,
+		Rejected: maps.Clone(w.rejected),
+	}
+	if model, ok := w.kf.Model().(StepModel); ok {
+		s.DT = model.DT()
+	}
+	if w.adapter != nil {
+		s.Adaptive = w.adapter.state()
+	}
+
+	return s, nil
+}
+
+// Restore восстанавливает состояние обертки, созданной с той же конфигурацией фильтра
+func (w *EKFWrapper) Restore(s *FilterState) error {
+	if s == nil {
+		return fmt.Errorf("пустое состояние фильтра")
+	}
+	if s.IMM != nil {
+		return fmt.Errorf("состояние IMM не восстанавливается в одиночный фильтр")
+	}
+	if filterName(s.Filter) != filterName(w.config.Filter) {
+		return fmt.Errorf("состояние фильтра %q, в конфигурации - %q", s.Filter, filterName(w.config.Filter))
+	}
+
+	n := w.kf.Cov().SymmetricDim()
+	if len(s.State) != w.stateDim || len(s.Cov) != n*n {
+		return fmt.Errorf("неверная размерность состояния фильтра: %d (ковариация %d), ожидается %d (%d)",
+			len(s.State), len(s.Cov), w.stateDim, n*n)
+	}
+
+	cov := mat.NewSymDense(n, nil)
+	setSym(cov, mat.NewDense(n, n, s.Cov))
+	if err := w.kf.SetCov(cov); err != nil {
+		return err
+	}
+	est, err := w.newEstimate(mat.NewVecDense(len(s.State), s.State), cov)
+	if err != nil {
+		return fmt.Errorf("ошибка восстановления оценки: %v", err)
+	}
+
+	if model, ok := w.kf.Model().(StepModel); ok && s.DT > 0 {
+		model.SetDT(s.DT)
+	}
+	if w.adapter != nil && s.Adaptive != nil {
+		if err := w.adapter.restore(s.Adaptive); err != nil {
+			return err
+		}
+		if w.adapter.cfg.Q {
+			if err := w.setProcessNoise(w.adapter.ProcessNoise()); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.rejected = make(map[string]int, len(s.Rejected))
+	maps.Copy(w.rejected, s.Rejected)
+
+	w.lastEstimate = est
+	w.lastTime = s.Time
+	w.history = nil
+	w.record(nil, 0)
+	w.trajectory = nil
+	w.track(nil)
+
+	return nil
+}
+
+// Checkpoint возвращает объединенную оценку, вероятности и состояния режимов
+func (m *IMM) Checkpoint() (*FilterState, error) {
+	s := &FilterState{
+		Filter:   filterName(m.modes[0].config.Filter),
+		Time:     m.Time(),
+		State:    mat.Col(nil, 0, m.est.Val()),
+		Cov:      mat.DenseCopyOf(m.p).RawMatrix().Data,
+		Rejected: maps.Clone(m.rejected),
+		IMM:      &IMMState{Probabilities: slices.Clone(m.mu), Mixed: m.mixed},
+	}
+	for i, w := range m.modes {
+		mode, err := w.Checkpoint()
+		if err != nil {
+			return nil, fmt.Errorf("режим %s: %v", m.names[i], err)
+		}
+		s.IMM.Modes = append(s.IMM.Modes, mode)
+	}
+
+	return s, nil
+}
+
+// Restore восстанавливает режимы и их вероятности
+func (m *IMM) Restore(s *FilterState) error {
+	if s == nil || s.IMM == nil {
+		return fmt.Errorf("в состоянии фильтра нет режимов IMM")
+	}
+	if len(s.IMM.Modes) != len(m.modes) || len(s.IMM.Probabilities) != len(m.modes) {
+		return fmt.Errorf("в состоянии %d режимов IMM (%d вероятностей), ожидается %d",
+			len(s.IMM.Modes), len(s.IMM.Probabilities), len(m.modes))
+	}
+
+	for i, w := range m.modes {
+		if err := w.Restore(s.IMM.Modes[i]); err != nil {
+			return fmt.Errorf("режим %s: %w", m.names[i], err)
+		}
+	}
+	m.mu = slices.Clone(s.IMM.Probabilities)
+	m.mixed = s.IMM.Mixed
+	m.rejected = make(map[string]int, len(s.Rejected))
+	maps.Copy(m.rejected, s.Rejected)
+
+	return m.combine()
+}
+
+// state возвращает состояние адаптации шумов
+func (a *NoiseAdapter) state() *AdaptiveState {
+	s := &AdaptiveState{Q: a.ProcessNoise(), QUpdates: a.qUpdates, Steps: a.steps, R: make(map[string]AdaptiveNoise, len(a.r))}
+	for typ, r := range a.r {
+		s.R[typ] = AdaptiveNoise{Values: append([]float64(nil), r.values...), Updates: r.updates}
+	}
+	return s
+}
+
+// restore восстанавливает состояние адаптации шумов
+func (a *NoiseAdapter) restore(s *AdaptiveState) error {
+	if len(s.Q) != len(a.q) {
+		return fmt.Errorf("неверная размерность адаптированного шума процесса: %d, ожидается %d", len(s.Q), len(a.q))
+	}
+
+	a.q = append([]float64(nil), s.Q...)
+	a.qUpdates = s.QUpdates
+	a.steps = s.Steps
+	a.r = make(map[string]*adaptedNoise, len(s.R))
+	for typ, r := range s.R {
+		a.r[typ] = &adaptedNoise{values: append([]float64(nil), r.Values...), updates: r.Updates}
+	}
+
+	return nil
+}
+
+// filterName возвращает тип фильтра с учетом значения по умолчанию
+func filterName(filter string) string {
+	if filter == "" {
+		return FilterEKF
+	}
+	return filter
+}
@@ -0,0 +1,297 @@
+package ekf
+
+import (
+	"fmt"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Формы вычисления ковариации
+const (
+	CovarianceJoseph = "joseph" // Полная матрица: форма Джозефа, затем симметризация и проверка собственных чисел
+	CovarianceSqrt   = "sqrt"   // Квадратные корни: фактор S ковариации P = S·Sᵀ переносится между шагами и обновляется QR составной матрицы факторов
+)
+
+// CovarianceHealth накопленная диагностика ковариации фильтра
+type CovarianceHealth struct {
+	Checks        int     // Число вычисленных ковариаций
+	Repairs       int     // Число исправлений ковариации, не являющейся положительно определенной
+	MaxAsymmetry  float64 // Наибольшая относительная несимметричность до симметризации (форма joseph)
+	MinEigenvalue float64 // Наименьшее собственное число до исправления (+Inf - не вычислялось)
+}
+
+// String возвращает краткую сводку диагностики
+func (h CovarianceHealth) String() string {
+	s := fmt.Sprintf("проверок %d, исправлений %d, наибольшая несимметричность %.3g", h.Checks, h.Repairs, h.MaxAsymmetry)
+	if !math.IsInf(h.MinEigenvalue, 1) {
+		s += fmt.Sprintf(", наименьшее собственное число %.3g", h.MinEigenvalue)
+	}
+	return s
+}
+
+// covTerm слагаемое A·P·Aᵀ суммы ковариаций
+type covTerm struct {
+	a     mat.Matrix    // nil - единичная матрица
+	p     mat.Symmetric // nil - слагаемое пропускается (шум noise.None)
+	state bool          // Ковариация состояния: при исправлении учитывается в диагностике
+}
+
+// covarianceGuard вычисляет ковариацию в заданной форме и поддерживает ее
+// симметричной и положительно определенной
+type covarianceGuard struct {
+	form   string
+	floor  float64 // Нижняя граница собственных чисел при исправлении
+	health CovarianceHealth
+
+	// Форма sqrt: фактор S последней вычисленной ковариации состояния P = S·Sᵀ и сама P.
+	// Следующий шаг продолжает от S без разложения P; ковариация, заданная извне, раскладывается заново.
+	s  *mat.Dense
+	sp *mat.SymDense
+}
+
+// newCovarianceGuard создает вычисление ковариации в форме form с нижней границей собственных чисел floor
+func newCovarianceGuard(form string, floor float64) (*covarianceGuard, error) {
+	switch form {
+	case "":
+		form = CovarianceJoseph
+	case CovarianceJoseph, CovarianceSqrt:
+	default:
+		return nil, fmt.Errorf("неизвестная форма ковариации %q (ожидается %s или %s)", form, CovarianceJoseph, CovarianceSqrt)
+	}
+	if floor < 0 || math.IsNaN(floor) {
+		return nil, fmt.Errorf("неверная нижняя граница собственных чисел ковариации: %v", floor)
+	}
+
+	return &covarianceGuard{form: form, floor: floor, health: CovarianceHealth{MinEigenvalue: math.Inf(1)}}, nil
+}
+
+// congruence возвращает Σ Aᵢ·Pᵢ·Aᵢᵀ. В форме sqrt сумма собирается из факторов Pᵢ = Lᵢ·Lᵢᵀ:
+// QR матрицы [A₁·L₁, A₂·L₂, ...]ᵀ = Q·U дает Σ Aᵢ·Pᵢ·Aᵢᵀ = Uᵀ·U, симметричную и неотрицательно
+// определенную по построению; для ковариации состояния Uᵀ сохраняется как ее фактор.
+// В форме joseph сумма вычисляется над полными матрицами и проверяется.
+func (g *covarianceGuard) congruence(n int, terms ...covTerm) *mat.SymDense {
+	if g.form == CovarianceSqrt {
+		var blocks []*mat.Dense
+		state := false
+		for _, t := range terms {
+			if t.p == nil {
+				continue
+			}
+			var l *mat.Dense
+			if t.state {
+				l, state = g.stateFactor(t.p), true
+			} else {
+				l = g.factor(t.p, false)
+			}
+			if t.a != nil {
+				al := &mat.Dense{}
+				al.Mul(t.a, l)
+				l = al
+			}
+			blocks = append(blocks, l)
+		}
+
+		g.health.Checks++
+		chol := choleskyFromColumns(n, blocks...)
+		if state {
+			return g.keep(chol)
+		}
+		p := &mat.SymDense{}
+		chol.ToSym(p)
+		return p
+	}
+
+	sum := mat.NewDense(n, n, nil)
+	for _, t := range terms {
+		if t.p == nil {
+			continue
+		}
+		if t.a == nil {
+			sum.Add(sum, t.p)
+			continue
+		}
+		ap := &mat.Dense{}
+		ap.Mul(t.a, t.p)
+		apa := &mat.Dense{}
+		apa.Mul(ap, t.a.T())
+		sum.Add(sum, apa)
+	}
+
+	return g.enforce(sum)
+}
+
+// keep запоминает разложение chol как фактор ковариации состояния и возвращает эту ковариацию
+func (g *covarianceGuard) keep(chol *mat.Cholesky) *mat.SymDense {
+	l := &mat.TriDense{}
+	chol.LTo(l)
+	g.s = mat.DenseCopyOf(l)
+
+	p := &mat.SymDense{}
+	chol.ToSym(p)
+	g.sp = mat.NewSymDense(p.SymmetricDim(), nil)
+	g.sp.CopySym(p)
+	return p
+}
+
+// stateFactor возвращает фактор ковариации состояния p: сохраненный, если p - последняя вычисленная
+// ковариация, иначе - разложение p
+func (g *covarianceGuard) stateFactor(p mat.Symmetric) *mat.Dense {
+	if g.s != nil && mat.Equal(p, g.sp) {
+		return g.s
+	}
+	return g.factor(p, true)
+}
+
+// enforce симметризует квадратную матрицу m и заменяет собственные числа ниже границы.
+// Собственные числа вычисляются, только если не проходит разложение Холецкого P - floor·I.
+func (g *covarianceGuard) enforce(m mat.Matrix) *mat.SymDense {
+	n, _ := m.Dims()
+	g.health.Checks++
+	g.s, g.sp = nil, nil
+
+	var asym, scale float64
+	for i := 0; i < n; i++ {
+		scale = math.Max(scale, math.Abs(m.At(i, i)))
+		for j := i + 1; j < n; j++ {
+			asym = math.Max(asym, math.Abs(m.At(i, j)-m.At(j, i)))
+		}
+	}
+	if scale > 0 {
+		g.health.MaxAsymmetry = math.Max(g.health.MaxAsymmetry, asym/scale)
+	}
+
+	p := mat.NewSymDense(n, nil)
+	setSym(p, m)
+
+	shifted := mat.NewSymDense(n, nil)
+	shifted.CopySym(p)
+	for i := 0; i < n; i++ {
+		shifted.SetSym(i, i, p.At(i, i)-g.floor)
+	}
+	var chol mat.Cholesky
+	if ok := chol.Factorize(shifted); ok {
+		return p
+	}
+
+	var eig mat.EigenSym
+	if ok := eig.Factorize(p, false); ok {
+		values := eig.Values(nil)
+		if values[0] >= g.floor {
+			return p
+		}
+		g.health.MinEigenvalue = math.Min(g.health.MinEigenvalue, values[0])
+	}
+
+	return g.repair(p)
+}
+
+// repair возвращает ближайшую к p матрицу с собственными числами не ниже границы: V·max(Λ, floor)·Vᵀ
+func (g *covarianceGuard) repair(p mat.Symmetric) *mat.SymDense {
+	g.health.Repairs++
+	l := eigenFactor(p, g.floor)
+
+	r := &mat.SymDense{}
+	r.SymOuterK(1, l)
+	return r
+}
+
+// factor возвращает нижний треугольный фактор L ковариации p = L·Lᵀ. Если p не положительно определена,
+// фактор строится по собственным числам, ограниченным снизу (для ковариации состояния - с учетом в диагностике).
+func (g *covarianceGuard) factor(p mat.Symmetric, state bool) *mat.Dense {
+	var chol mat.Cholesky
+	if ok := chol.Factorize(p); ok {
+		l := &mat.TriDense{}
+		chol.LTo(l)
+		return mat.DenseCopyOf(l)
+	}
+
+	if !state {
+		return eigenFactor(p, 0)
+	}
+
+	g.health.Repairs++
+	var eig mat.EigenSym
+	if ok := eig.Factorize(p, false); ok {
+		g.health.MinEigenvalue = math.Min(g.health.MinEigenvalue, eig.Values(nil)[0])
+	}
+	return eigenFactor(p, g.floor)
+}
+
+// eigenFactor возвращает фактор V·√max(Λ, floor) симметричной матрицы p
+func eigenFactor(p mat.Symmetric, floor float64) *mat.Dense {
+	n := p.SymmetricDim()
+
+	var eig mat.EigenSym
+	if ok := eig.Factorize(p, true); !ok {
+		// Разложение не сошлось - диагональ с ограничением снизу
+		l := mat.NewDense(n, n, nil)
+		for i := 0; i < n; i++ {
+			l.Set(i, i, math.Sqrt(math.Max(p.At(i, i), floor)))
+		}
+		return l
+	}
+
+	values := eig.Values(nil)
+	l := &mat.Dense{}
+	eig.VectorsTo(l)
+	for j, v := range values {
+		s := math.Sqrt(math.Max(v, floor))
+		for i := 0; i < n; i++ {
+			l.Set(i, j, l.At(i, j)*s)
+		}
+	}
+	return l
+}
+
+// choleskyFromColumns возвращает разложение Холецкого суммы M·Mᵀ матрицы M = [B₁, B₂, ...] из n строк:
+// верхний треугольный фактор - R из QR разложения Mᵀ
+func choleskyFromColumns(n int, blocks ...*mat.Dense) *mat.Cholesky {
+	cols := 0
+	for _, b := range blocks {
+		_, c := b.Dims()
+		cols += c
+	}
+	// QR требует не меньше строк, чем столбцов
+	mt := mat.NewDense(max(cols, n), n, nil)
+	row := 0
+	for _, b := range blocks {
+		_, c := b.Dims()
+		mt.Slice(row, row+c, 0, n).(*mat.Dense).Copy(b.T())
+		row += c
+	}
+
+	var qr mat.QR
+	qr.Factorize(mt)
+	r := &mat.Dense{}
+	qr.RTo(r)
+
+	// Знаки строк R не влияют на Rᵀ·R; положительная диагональ нужна для разложения Холецкого
+	u := mat.NewTriDense(n, mat.Upper, nil)
+	for i := 0; i < n; i++ {
+		sign := 1.0
+		if r.At(i, i) < 0 {
+			sign = -1
+		}
+		for j := i; j < n; j++ {
+			u.SetTri(i, j, sign*r.At(i, j))
+		}
+	}
+
+	chol := &mat.Cholesky{}
+	chol.SetFromU(u)
+	return chol
+}
+
+// downdate вычитает из разложения chol слагаемые uⱼ·uⱼᵀ по столбцам u; возвращает false,
+// если результат не положительно определен
+func downdate(chol *mat.Cholesky, u mat.Matrix) bool {
+	_, c := u.Dims()
+	for j := 0; j < c; j++ {
+		col := mat.Col(nil, j, u)
+		if ok := chol.SymRankOne(chol, -1, mat.NewVecDense(len(col), col)); !ok {
+			return false
+		}
+	}
+	return true
+}
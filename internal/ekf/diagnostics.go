@@ -0,0 +1,339 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat/distuv"
+
+	"main.go/internal/models"
+)
+
+// ErrNEESSkipped NEES не вычислен: ковариация оценки вырождена. Такие случаи учитываются в итогах диагностики.
+var ErrNEESSkipped = errors.New("NEES не вычислен")
+
+// Виды записей диагностики
+const (
+	DiagnosticNIS  = "nis"  // Нормированный квадрат невязки измерения
+	DiagnosticNEES = "nees" // Нормированный квадрат ошибки оценки (по эталонному состоянию)
+)
+
+// Consistency результат скользящего теста согласованности по критерию хи-квадрат: среднее по окну
+// из Samples значений с Dof степенями свободы в сумме и его двусторонние доверительные границы
+type Consistency struct {
+	Samples    int
+	Dof        int
+	Mean       float64
+	Lower      float64
+	Upper      float64
+	Consistent bool
+}
+
+// DiagnosticRecord диагностика одной коррекции (NIS) или одного сравнения с эталоном (NEES)
+type DiagnosticRecord struct {
+	Time          time.Time
+	Kind          string    // nis или nees
+	Type          string    // Тип измерения (для nees - пусто)
+	Action        string    // Решение проверки невязки (для nees - пусто)
+	Dim           int       // Число степеней свободы
+	Value         float64   // NIS или NEES
+	Innovation    []float64 // Невязка (для nis)
+	InnovationCov []float64 // Ковариация невязки по строкам (для nis)
+	Test          Consistency
+}
+
+// Diagnostics проверяет согласованность NIS коррекций по типам измерений и NEES оценок
+// в скользящем окне с выводом записей в таблицу CSV.
+type Diagnostics struct {
+	window      int
+	probability float64
+
+	out *models.CSVTable // Таблица записей (nil - записи не выводятся)
+
+	windows map[string]*chiWindow // Окна по типам измерений; NEES - под ключом DiagnosticNEES
+	stats   map[string]*summary
+	skipped int // Число сравнений с эталоном, для которых NEES не вычислен
+}
+
+// NewDiagnostics создает накопитель диагностики с окном теста window значений
+// и двусторонней доверительной вероятностью probability
+func NewDiagnostics(window int, probability float64) (*Diagnostics, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("неверное окно теста согласованности: %d", window)
+	}
+	if probability <= 0 || probability >= 1 {
+		return nil, fmt.Errorf("доверительная вероятность %v вне (0, 1)", probability)
+	}
+
+	return &Diagnostics{
+		window:      window,
+		probability: probability,
+		windows:     make(map[string]*chiWindow),
+		stats:       make(map[string]*summary),
+	}, nil
+}
+
+// newDiagnostics создает диагностику по конфигурации фильтра с выводом записей в cfg.DiagnosticsOutput
+func newDiagnostics(cfg *EKFConfig) (*Diagnostics, error) {
+	d, err := NewDiagnostics(cfg.DiagnosticsWindow, cfg.DiagnosticsProbability)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания диагностики: %w", err)
+	}
+	if cfg.DiagnosticsOutput != nil {
+		if err := d.SetOutput(cfg.DiagnosticsOutput); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// SetOutput задает таблицу CSV, в которую выводятся записи по мере поступления, и записывает ее заголовок
+func (d *Diagnostics) SetOutput(w io.Writer) error {
+	header := []string{
+		"time", "kind", "type", "action", "dim", "value",
+		"window_mean", "lower", "upper", "consistent",
+		"innovation", "innovation_cov",
+	}
+	out, err := models.NewCSVTable(w, "диагностики", header)
+	if err != nil {
+		return err
+	}
+	d.out = out
+	return nil
+}
+
+// Flush дописывает буферизованные записи в таблицу и возвращает первую ошибку вывода
+func (d *Diagnostics) Flush() error {
+	if d.out == nil {
+		return nil
+	}
+	return d.out.Flush()
+}
+
+// addNIS добавляет запись коррекции измерением типа typ размерности dim с невязкой inn
+// и ковариацией невязки s, использованной в коррекции. Отброшенные измерения (inn == nil)
+// записываются без невязки и не входят в тест согласованности.
+func (d *Diagnostics) addNIS(t time.Time, typ, action string, nis float64, dim int, inn mat.Vector, s mat.Symmetric) {
+	r := DiagnosticRecord{Time: t, Kind: DiagnosticNIS, Type: typ, Action: action, Dim: dim, Value: nis}
+	if inn == nil || s == nil {
+		d.write(r)
+		return
+	}
+
+	r.Innovation = mat.Col(nil, 0, inn)
+	r.InnovationCov = mat.DenseCopyOf(s).RawMatrix().Data
+	d.add(typ, r)
+}
+
+// addNEES добавляет запись сравнения с эталоном
+func (d *Diagnostics) addNEES(t time.Time, nees float64, dim int) {
+	d.add(DiagnosticNEES, DiagnosticRecord{Time: t, Kind: DiagnosticNEES, Dim: dim, Value: nees})
+}
+
+// skipNEES учитывает сравнение с эталоном, для которого NEES не вычислен
+func (d *Diagnostics) skipNEES() {
+	d.skipped++
+}
+
+// add добавляет запись и проверяет согласованность в окне типа key
+func (d *Diagnostics) add(key string, r DiagnosticRecord) {
+	w, ok := d.windows[key]
+	if !ok {
+		w = &chiWindow{size: d.window}
+		d.windows[key] = w
+	}
+	w.push(r.Value, r.Dim)
+	r.Test = w.test(d.probability)
+
+	s, ok := d.stats[key]
+	if !ok {
+		s = &summary{}
+		d.stats[key] = s
+	}
+	s.add(r)
+
+	d.write(r)
+}
+
+// write выводит запись в таблицу; ошибка сохраняется до Flush
+func (d *Diagnostics) write(r DiagnosticRecord) {
+	if d.out != nil {
+		d.out.Write(r.row())
+	}
+}
+
+// String возвращает итоги по типам: число значений, среднее и ожидаемое (число степеней свободы),
+// доля окон, вышедших за доверительные границы; число невычисленных NEES
+func (d *Diagnostics) String() string {
+	var b strings.Builder
+	for _, key := range slices.Sorted(maps.Keys(d.stats)) {
+		s := d.stats[key]
+		fmt.Fprintf(&b, "%s: %d значений, среднее %.3g (ожидается %.3g), вне границ %.1f%%\n",
+			key, s.n, s.sum/float64(s.n), float64(s.dof)/float64(s.n), 100*float64(s.outside)/float64(s.n))
+	}
+	if d.skipped > 0 {
+		fmt.Fprintf(&b, "%s: не вычислен %d раз (вырожденная ковариация)\n", DiagnosticNEES, d.skipped)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// row возвращает строку таблицы диагностики
+func (r DiagnosticRecord) row() []string {
+	return []string{
+		r.Time.Format(time.RFC3339Nano),
+		r.Kind,
+		r.Type,
+		r.Action,
+		strconv.Itoa(r.Dim),
+		formatFloat(r.Value),
+		formatFloat(r.Test.Mean),
+		formatFloat(r.Test.Lower),
+		formatFloat(r.Test.Upper),
+		strconv.FormatBool(r.Test.Consistent),
+		formatFloats(r.Innovation),
+		formatFloats(r.InnovationCov),
+	}
+}
+
+// RecordTruth сравнивает текущую оценку с эталонным состоянием truth (при моделировании)
+// и добавляет NEES в диагностику. Для ESKF ошибка ориентации считается в пространстве ошибки.
+// При вырожденной ковариации возвращает ErrNEESSkipped; такие случаи учитываются в диагностике.
+func (w *EKFWrapper) RecordTruth(truth mat.Vector) (float64, error) {
+	if w.diagnostics == nil {
+		return 0, fmt.Errorf("диагностика выключена")
+	}
+
+	est := w.lastEstimate.Val()
+	if truth.Len() != est.Len() {
+		return 0, fmt.Errorf("неверная размерность эталонного состояния: %d, ожидается %d", truth.Len(), est.Len())
+	}
+
+	e := w.difference(truth, est)
+	nees, err := mahalanobis(e, w.kf.Cov())
+	if err != nil {
+		w.diagnostics.skipNEES()
+		return 0, fmt.Errorf("%w: %v", ErrNEESSkipped, err)
+	}
+	w.diagnostics.addNEES(w.lastTime, nees, e.Len())
+
+	return nees, nil
+}
+
+// Diagnostics возвращает накопленную диагностику (nil - выключена)
+func (w *EKFWrapper) Diagnostics() *Diagnostics {
+	return w.diagnostics
+}
+
+// errorStater фильтр, ковариация которого задана в пространстве ошибки
+type errorStater interface {
+	stateError(truth, est mat.Vector) *mat.VecDense
+	inject(x mat.Vector, dx *mat.VecDense) *mat.VecDense
+	estimateCov(x mat.Vector, p mat.Symmetric) (filter.Estimate, error)
+}
+
+// stateError возвращает вектор ошибки оценки est относительно эталона truth: δθ = 2·vec(q̂⁻¹ ⊗ q)
+func (k *ESKF) stateError(truth, est mat.Vector) *mat.VecDense {
+	nx := est.Len()
+	e := mat.NewVecDense(nx-1, nil)
+
+	for i := 0; i < nx; i++ {
+		switch {
+		case i < k.att:
+			e.SetVec(i, truth.AtVec(i)-est.AtVec(i))
+		case i >= k.att+4:
+			e.SetVec(i-1, truth.AtVec(i)-est.AtVec(i))
+		}
+	}
+
+	q := normalize(k.quaternion(est))
+	dq := multiplyQuaternion([4]float64{q[0], -q[1], -q[2], -q[3]}, normalize(k.quaternion(truth)))
+	if dq[0] < 0 {
+		dq = [4]float64{-dq[0], -dq[1], -dq[2], -dq[3]}
+	}
+	for i := 0; i < 3; i++ {
+		e.SetVec(k.att+i, 2*dq[1+i])
+	}
+
+	return e
+}
+
+// chiWindow скользящее окно значений хи-квадрат
+type chiWindow struct {
+	size   int
+	values []float64
+	dofs   []int
+	sum    float64
+	dof    int
+}
+
+func (w *chiWindow) push(v float64, dof int) {
+	w.values = append(w.values, v)
+	w.dofs = append(w.dofs, dof)
+	w.sum += v
+	w.dof += dof
+
+	if len(w.values) > w.size {
+		w.sum -= w.values[0]
+		w.dof -= w.dofs[0]
+		w.values = w.values[1:]
+		w.dofs = w.dofs[1:]
+	}
+}
+
+// test проверяет, что сумма значений окна согласуется с распределением хи-квадрат
+// с суммарным числом степеней свободы; среднее и границы нормированы на размер окна
+func (w *chiWindow) test(probability float64) Consistency {
+	n := float64(len(w.values))
+	chi := distuv.ChiSquared{K: float64(w.dof)}
+	c := Consistency{
+		Samples: len(w.values),
+		Dof:     w.dof,
+		Mean:    w.sum / n,
+		Lower:   chi.Quantile((1-probability)/2) / n,
+		Upper:   chi.Quantile((1+probability)/2) / n,
+	}
+	c.Consistent = c.Mean >= c.Lower && c.Mean <= c.Upper
+
+	return c
+}
+
+// summary итоговая статистика по типу
+type summary struct {
+	n       int
+	sum     float64
+	dof     int
+	outside int
+}
+
+func (s *summary) add(r DiagnosticRecord) {
+	s.n++
+	s.sum += r.Value
+	s.dof += r.Dim
+	if !r.Test.Consistent {
+		s.outside++
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'g', 10, 64)
+}
+
+func formatFloats(v []float64) string {
+	s := make([]string, len(v))
+	for i, x := range v {
+		s[i] = formatFloat(x)
+	}
+	return strings.Join(s, " ")
+}
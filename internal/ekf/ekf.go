@@ -1,18 +1,27 @@
 package ekf
 
 import (
+	"errors"
 	"fmt"
 
 	filter "github.com/milosgajdos/go-estimate"
 	"github.com/milosgajdos/go-estimate/estimate"
 	"github.com/milosgajdos/go-estimate/noise"
-	"gonum.org/v1/gonum/diff/fd"
 	"gonum.org/v1/gonum/mat"
 )
 
 // JacFunc defines jacobian function to calculate Jacobian matrix
 type JacFunc func(u mat.Vector) func(y, x []float64)
 
+// JacobianModel is a model that provides analytic Jacobians of its propagation and observation functions.
+// EKF uses them instead of finite differences when the model implements this interface.
+type JacobianModel interface {
+	// StateJacobian returns the [nx x nx] Jacobian of Propagate with respect to x at state x and input u
+	StateJacobian(x, u mat.Vector) (*mat.Dense, error)
+	// ObservationJacobian returns the [ny x nx] Jacobian of Observe with respect to x at state x and input u
+	ObservationJacobian(x, u mat.Vector) (*mat.Dense, error)
+}
+
 // EKF is Extended Kalman Filter
 type EKF struct {
 	// m is EKF system model
@@ -35,8 +44,16 @@ type EKF struct {
 	pNext *mat.SymDense
 	// inn is innovation vector
 	inn *mat.VecDense
+	// s is innovation covariance
+	s *mat.SymDense
 	// k is Kalman gain
 	k *mat.Dense
+	// numeric forces finite-difference Jacobians even if the model provides analytic ones
+	numeric bool
+	// cov computes covariance in the configured form and keeps it symmetric and positive definite
+	cov *covarianceGuard
+	// jerr collects model errors from numerical Jacobian closures
+	jerr *jacErr
 }
 
 // New creates new EKF and returns it.
@@ -71,15 +88,18 @@ func New(m filter.Model, init filter.InitCond, q, r filter.Noise) (*EKF, error)
 		r, _ = noise.NewNone()
 	}
 
+	// errors raised by the model inside numerical Jacobian closures
+	jerr := &jacErr{}
+
 	// propagation Jacobian
 	fJacFn := func(u mat.Vector) func([]float64, []float64) {
-		q, _ := noise.NewZero(nx)
-
 		return func(xOut, xNow []float64) {
 			x := mat.NewVecDense(len(xNow), xNow)
-			xNext, err := m.Propagate(x, u, q.Sample())
+			xNext, err := m.Propagate(x, u, nil)
 			if err != nil {
-				panic(err)
+				jerr.set(err)
+				fillNaN(xOut)
+				return
 			}
 
 			for i := 0; i < len(xOut); i++ {
@@ -91,14 +111,14 @@ func New(m filter.Model, init filter.InitCond, q, r filter.Noise) (*EKF, error)
 
 	// observation Jacobian
 	hJacFn := func(u mat.Vector) func([]float64, []float64) {
-		r, _ := noise.NewZero(ny)
-
 		return func(y, xNow []float64) {
 			x := mat.NewVecDense(len(xNow), xNow)
 			// observe system output in the next step
-			yNext, err := m.Observe(x, u, r.Sample())
+			yNext, err := m.Observe(x, u, nil)
 			if err != nil {
-				panic(err)
+				jerr.set(err)
+				fillNaN(y)
+				return
 			}
 
 			for i := 0; i < len(y); i++ {
@@ -121,6 +141,11 @@ func New(m filter.Model, init filter.InitCond, q, r filter.Noise) (*EKF, error)
 	// kalman gain
 	k := mat.NewDense(nx, ny, nil)
 
+	cov, err := newCovarianceGuard(CovarianceJoseph, 0)
+	if err != nil {
+		return nil, err
+	}
+
 	return &EKF{
 		m:      m,
 		q:      q,
@@ -133,40 +158,37 @@ func New(m filter.Model, init filter.InitCond, q, r filter.Noise) (*EKF, error)
 		pNext:  pNext,
 		inn:    inn,
 		k:      k,
+		cov:    cov,
+		jerr:   jerr,
 	}, nil
 }
 
 // Predict calculates the next system state given the state x and input u and returns its estimate.
-// It first generates new sigma points around x and then attempts to propagate them to the next step.
-// It returns error if it either fails to generate or propagate the sigma points (and x) to the next step.
+// The state mean is propagated without noise; noise samples belong to Simulator.
+// It returns error if it fails to propagate x to the next step.
 func (k *EKF) Predict(x, u mat.Vector) (filter.Estimate, error) {
 	// propagate input state to the next step
-	xNext, err := k.m.Propagate(x, u, k.q.Sample())
+	xNext, err := k.m.Propagate(x, u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("system state propagation failed: %v", err)
 	}
 
 	// calculate propagation Jacobian matrix
-	fd.Jacobian(k.f, k.FJacFn(u), mat.Col(nil, 0, x), &fd.JacobianSettings{
-		Formula:    fd.Central,
-		Concurrent: true,
-	})
-
-	cov := &mat.Dense{}
-	cov.Mul(k.f, k.p)
-	cov.Mul(cov, k.f.T())
+	if err := k.stateJacobian(x, u); err != nil {
+		return nil, fmt.Errorf("propagation Jacobian failed: %v", err)
+	}
 
+	// F*P*F' + Q
+	var q mat.Symmetric
 	if _, ok := k.q.(*noise.None); !ok {
-		cov.Add(cov, k.q.Cov())
+		q = k.q.Cov()
 	}
+	cov := k.cov.congruence(x.Len(), covTerm{a: k.f, p: k.p, state: true}, covTerm{p: q})
 
 	// update EKF covariance matrix
-	n := k.pNext.SymmetricDim()
-	for i := 0; i < n; i++ {
-		for j := 0; j < n; j++ {
-			k.pNext.SetSym(i, j, cov.At(i, j))
-		}
-	}
+	k.pNext.CopySym(cov)
+	// predicted covariance becomes the current one so that consecutive predictions accumulate uncertainty
+	k.p.CopySym(k.pNext)
 
 	return estimate.NewBaseWithCov(xNext, k.pNext)
 }
@@ -174,36 +196,77 @@ func (k *EKF) Predict(x, u mat.Vector) (filter.Estimate, error) {
 // Update corrects state x using the measurement z, given control intput u and returns corrected estimate.
 // It returns error if either invalid state was supplied or if it fails to calculate system output estimate.
 func (k *EKF) Update(x, u, z mat.Vector) (filter.Estimate, error) {
-	nx, _, ny, _ := k.m.SystemDims()
+	_, _, ny, _ := k.m.SystemDims()
 
 	if z.Len() != ny {
 		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
 	}
 
 	// observe system output in the next step
-	y, err := k.m.Observe(x, u, k.r.Sample())
+	y, err := k.m.Observe(x, u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to observe system output: %v", err)
 	}
 
 	// calculate observation Jacobian matrix
-	fd.Jacobian(k.h, k.HJacFn(u), mat.Col(nil, 0, x), &fd.JacobianSettings{
-		Formula:    fd.Central,
-		Concurrent: true,
-	})
+	if err := k.observationJacobian(x, u); err != nil {
+		return nil, fmt.Errorf("observation Jacobian failed: %v", err)
+	}
+
+	// innovation vector
+	inn := &mat.VecDense{}
+	inn.SubVec(z, y)
+
+	return k.correct(x, inn, k.h, k.r, nil)
+}
+
+// UpdateMeasurement corrects state x using the measurement z of the measurement model m with output noise r
+// and returns corrected estimate. Unlike Update, z may have any dimension defined by m.
+// If gate is not nil, it decides on the measurement given its innovation; rejected measurement leaves EKF unchanged.
+// It returns error if either invalid measurement was supplied or if it fails to calculate measurement estimate.
+func (k *EKF) UpdateMeasurement(x, z mat.Vector, m MeasurementModel, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	if z.Len() != m.Dim() || r.Cov().SymmetricDim() != m.Dim() {
+		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
+	}
+
+	y, err := m.Observe(x)
+	if err != nil {
+		return nil, fmt.Errorf("failed to observe measurement: %v", err)
+	}
+
+	h, err := k.measurementJacobian(x, m)
+	if err != nil {
+		return nil, fmt.Errorf("measurement Jacobian failed: %v", err)
+	}
+
+	return k.correct(x, m.Residual(z, y), h, r, gate)
+}
+
+// correct corrects state x given innovation inn, observation matrix h, output noise r and optional gate
+// and returns corrected estimate.
+func (k *EKF) correct(x mat.Vector, inn *mat.VecDense, h *mat.Dense, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	nx := x.Len()
+	ny := inn.Len()
 
 	pxy := mat.NewDense(nx, ny, nil)
-	pyy := mat.NewDense(ny, ny, nil)
+	hph := mat.NewDense(ny, ny, nil)
 
 	// P*H'
-	pxy.Mul(k.pNext, k.h.T())
+	pxy.Mul(k.p, h.T())
 
 	// Note: pxy = P * H' so we reuse the result here
 	// H*P*H'
-	pyy.Mul(k.h, pxy)
-	// no measurement noise
-	if _, ok := k.r.(*noise.None); !ok {
-		pyy.Add(pyy, k.r.Cov())
+	hph.Mul(h, pxy)
+
+	// innovation covariance H*P*H' + R after gating
+	pyy, rCov, err := innovationCov(hph, inn, r, gate)
+	if errors.Is(err, ErrMeasurementRejected) {
+		k.inn = mat.VecDenseCopyOf(inn)
+		k.s = mat.NewSymDense(inn.Len(), nil)
+		setSym(k.s, pyy)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	// calculate Kalman gain
@@ -214,10 +277,6 @@ func (k *EKF) Update(x, u, z mat.Vector) (filter.Estimate, error) {
 	gain := &mat.Dense{}
 	gain.Mul(pxy, pyyInv)
 
-	// innovation vector
-	inn := &mat.VecDense{}
-	inn.SubVec(z, y)
-
 	// update state x
 	corr := &mat.Dense{}
 	corr.Mul(gain, inn)
@@ -230,38 +289,20 @@ func (k *EKF) Update(x, u, z mat.Vector) (filter.Estimate, error) {
 	}
 	a := &mat.Dense{}
 	// K*H
-	a.Mul(gain, k.h)
+	a.Mul(gain, h)
 	// eye - K*H
 	a.Sub(eye, a)
 
-	// K*R*K'
-	pkrk := &mat.Dense{}
-	// if there is some output noise
-	if _, ok := k.r.(*noise.None); !ok {
-		kr := &mat.Dense{}
-		kr.Mul(gain, k.r.Cov())
-		pkrk.Mul(kr, gain.T())
-	}
-
-	ap := &mat.Dense{}
-	ap.Mul(a, k.pNext)
-	apa := &mat.Dense{}
-	apa.Mul(ap, a.T())
-
-	pCorr := &mat.Dense{}
-	if !pkrk.IsEmpty() {
-		pCorr.Add(apa, pkrk)
-	}
+	// (I-K*H)*P*(I-K*H)' + K*R*K'; the noise term is skipped if there is no output noise
+	pCorr := k.cov.congruence(nx, covTerm{a: a, p: k.p, state: true}, covTerm{a: gain, p: rCov})
 
-	// update EKF innovation vector
-	k.inn.CopyVec(inn)
-	k.k.Copy(gain)
+	// update EKF innovation vector and gain; their size depends on the measurement
+	k.inn = mat.VecDenseCopyOf(inn)
+	k.s = mat.NewSymDense(inn.Len(), nil)
+	setSym(k.s, pyy)
+	k.k = mat.DenseCopyOf(gain)
 	// update EKF covariance matrix
-	for i := 0; i < nx; i++ {
-		for j := i; j < nx; j++ {
-			k.p.SetSym(i, j, pCorr.At(i, j))
-		}
-	}
+	k.p.CopySym(pCorr)
 
 	return estimate.NewBaseWithCov(x, k.p)
 }
@@ -293,11 +334,44 @@ func (k *EKF) StateNoise() filter.Noise {
 	return k.q
 }
 
+// SetStateNoise sets EKF state noise to q; it is used by all subsequent predictions.
+// It returns error if either q is nil or its dimension does not match the state dimension.
+func (k *EKF) SetStateNoise(q filter.Noise) error {
+	if q == nil {
+		return fmt.Errorf("invalid state noise: %v", q)
+	}
+
+	if q.Cov().SymmetricDim() != k.p.SymmetricDim() {
+		return fmt.Errorf("invalid state noise dimension: %d", q.Cov().SymmetricDim())
+	}
+
+	k.q = q
+
+	return nil
+}
+
 // OutputNoise retruns output noise
 func (k *EKF) OutputNoise() filter.Noise {
 	return k.r
 }
 
+// SetOutputNoise sets EKF output noise to r; it is used by all subsequent updates.
+// It returns error if either r is nil or its dimension does not match the model output dimension.
+func (k *EKF) SetOutputNoise(r filter.Noise) error {
+	if r == nil {
+		return fmt.Errorf("invalid output noise: %v", r)
+	}
+
+	_, _, ny, _ := k.m.SystemDims()
+	if r.Cov().SymmetricDim() != ny {
+		return fmt.Errorf("invalid output noise dimension: %d", r.Cov().SymmetricDim())
+	}
+
+	k.r = r
+
+	return nil
+}
+
 // Cov returns EKF covariance
 func (k *EKF) Cov() mat.Symmetric {
 	cov := mat.NewSymDense(k.p.SymmetricDim(), nil)
@@ -322,6 +396,16 @@ func (k *EKF) SetCov(cov mat.Symmetric) error {
 	return nil
 }
 
+// Innovation returns innovation vector of the last update (including a rejected one)
+func (k *EKF) Innovation() mat.Vector {
+	return mat.VecDenseCopyOf(k.inn)
+}
+
+// InnovationCov returns innovation covariance of the last update (including a rejected one)
+func (k *EKF) InnovationCov() mat.Symmetric {
+	return copySym(k.s)
+}
+
 // Gain returns Kalman gain
 func (k *EKF) Gain() mat.Matrix {
 	gain := &mat.Dense{}
@@ -329,3 +413,28 @@ func (k *EKF) Gain() mat.Matrix {
 
 	return gain
 }
+
+// SetCovarianceForm sets covariance computation form (joseph or sqrt) and the lowest eigenvalue
+// the covariance is repaired to when it is not positive definite
+func (k *EKF) SetCovarianceForm(form string, minEigenvalue float64) error {
+	cov, err := newCovarianceGuard(form, minEigenvalue)
+	if err != nil {
+		return err
+	}
+	k.cov = cov
+
+	return nil
+}
+
+// CovarianceHealth returns accumulated covariance diagnostics
+func (k *EKF) CovarianceHealth() CovarianceHealth {
+	return k.cov.health
+}
+
+// Transition returns propagation Jacobian of the last prediction
+func (k *EKF) Transition() mat.Matrix {
+	f := &mat.Dense{}
+	f.CloneFrom(k.f)
+
+	return f
+}
@@ -2,20 +2,83 @@ package ekf
 
 import (
 	"fmt"
+	"io"
 	"time"
 
 	filter "github.com/milosgajdos/go-estimate"
 	"github.com/milosgajdos/go-estimate/estimate"
-	"github.com/milosgajdos/go-estimate/noise"
 	"github.com/milosgajdos/go-estimate/sim"
 	"gonum.org/v1/gonum/mat"
 
 	"main.go/internal/models"
 )
 
+// FusionFilter фильтр комплексирования IMU и GNSS, которым пользуется Fuzzer.
+// Реализуется EKFWrapper, алгоритм оценивания (EKF, ESKF, UKF) которого выбирается в EKFConfig.Filter,
+// и IMM - набором таких оберток для режимов движения.
+type FusionFilter interface {
+	// Predict выполняет предсказание на момент t по входу u
+	Predict(t time.Time, u mat.Vector) (*models.EstimatedState, error)
+	// Update корректирует текущее состояние пришедшими измерениями
+	Update(z ...Measurement) (*models.EstimatedState, error)
+	// Run выполняет предсказание на момент t и коррекцию
+	Run(t time.Time, u mat.Vector, z ...Measurement) (*models.EstimatedState, error)
+	// UpdateAt корректирует состояние измерениями, полученными в момент t раньше текущего состояния
+	UpdateAt(t time.Time, z ...Measurement) (*models.EstimatedState, error)
+	// RegisterMeasurement регистрирует модель измерения типа typ с шумом r по умолчанию
+	RegisterMeasurement(typ string, m MeasurementModel, r []float64) error
+	// SetGate задает проверку невязки для измерений типа typ
+	SetGate(typ string, gate Gate) error
+	// Rejected возвращает число отброшенных измерений по типам
+	Rejected() map[string]int
+	// Time возвращает время текущего состояния
+	Time() time.Time
+	// GetState возвращает текущее состояние
+	GetState() *models.EstimatedState
+	// Cov возвращает ковариацию текущего состояния
+	Cov() mat.Symmetric
+	// RecordTruth добавляет в диагностику NEES текущей оценки относительно эталонного состояния
+	RecordTruth(truth mat.Vector) (float64, error)
+	// Diagnostics возвращает накопленную диагностику согласованности (nil - выключена)
+	Diagnostics() *Diagnostics
+	// Smooth возвращает состояния прямого прохода, сглаженные обратным проходом RTS
+	Smooth() ([]models.EstimatedState, error)
+	// CovarianceHealth возвращает диагностику симметричности и положительной определенности ковариации
+	CovarianceHealth() CovarianceHealth
+	// AdaptiveNoise возвращает адаптацию шумов Q и R (nil - выключена)
+	AdaptiveNoise() *NoiseAdapter
+	// Checkpoint возвращает состояние для возобновления обработки
+	Checkpoint() (*FilterState, error)
+	// Restore восстанавливает состояние, сохраненное Checkpoint
+	Restore(s *FilterState) error
+}
+
+// estimator фильтр, которым управляет обертка (EKF, ESKF, UKF)
+type estimator interface {
+	Predict(x, u mat.Vector) (filter.Estimate, error)
+	UpdateMeasurement(x, z mat.Vector, m MeasurementModel, r filter.Noise, gate GateFunc) (filter.Estimate, error)
+	Model() filter.Model
+	Cov() mat.Symmetric
+	SetCov(cov mat.Symmetric) error
+	Innovation() mat.Vector
+	InnovationCov() mat.Symmetric
+	Transition() mat.Matrix
+	SetCovarianceForm(form string, minEigenvalue float64) error
+	CovarianceHealth() CovarianceHealth
+	Gain() mat.Matrix
+	SetStateNoise(q filter.Noise) error
+}
+
+// Фильтры, доступные обертке
+const (
+	FilterEKF  = "ekf"  // EKF с аддитивной ковариацией кватерниона
+	FilterESKF = "eskf" // EKF по вектору ошибки с 3-параметрической ошибкой ориентации
+	FilterUKF  = "ukf"  // Сигма-точечный (unscented) фильтр Калмана
+)
+
 // EKFWrapper обертка для работы с EKF
 type EKFWrapper struct {
-	ekf      *EKF
+	kf       estimator
 	stateDim int
 	config   *EKFConfig // Конфигурация
 
@@ -24,22 +87,75 @@ type EKFWrapper struct {
 	lastTime     time.Time // Время последнего обновления
 	lastEstimate filter.Estimate
 
-	positionModel *models.PositionModel
+	history []historyEntry // История состояний для запаздывающих измерений
+
+	measurements map[string]measurementType // Модели измерений по типам датчиков
+	gating       []models.GateDecision      // Решения проверки невязок последней коррекции
+	rejected     map[string]int             // Число отброшенных измерений по типам
+	innovations  []innovation               // Невязки последней коррекции, в том числе отброшенные (для IMM)
+
+	diagnostics *Diagnostics // Диагностика согласованности (nil - выключена)
+
+	trajectory []smoothEntry // Прямой проход для сглаживания (весь при Smoother, окно задержки при SmootherLag)
+
+	adapter *NoiseAdapter // Адаптация шумов Q и R (nil - выключена)
+
+	layout *models.StateLayout // Блоки состояния модели
 }
 
 // EKFConfig конфигурация EKF
 type EKFConfig struct {
-	TimeStep         float64
+	Filter           string           // Тип фильтра: ekf (по умолчанию), eskf или ukf
+	SigmaPoints      SigmaPointConfig // Параметры сигма-точек (для ukf)
 	InitialState     []float64
-	InitialCov       []float64
-	ProcessNoise     []float64
+	InitialCov       []float64 // Для eskf - в пространстве ошибки (угол вместо кватерниона)
+	ProcessNoise     []float64 // Для eskf - в пространстве ошибки
 	MeasurementNoise []float64
+
+	MaxTimeStep float64 // Наибольший шаг интегрирования (с); более длинные разрывы данных ограничиваются
+
+	NumericJacobian bool // Якобианы конечными разностями даже при наличии аналитических
+
+	CovarianceForm string  // Форма вычисления ковариации: joseph (по умолчанию) или sqrt
+	MinEigenvalue  float64 // Нижняя граница собственных чисел при исправлении ковариации
+
+	Seed uint64 // Зерно генератора шумов Simulator для воспроизводимого моделирования
+
+	StartTime time.Time     // Время начального состояния
+	History   time.Duration // Глубина истории состояний для запаздывающих измерений
+
+	DiagnosticsWindow      int       // Окно теста согласованности NIS/NEES (0 - диагностика выключена)
+	DiagnosticsProbability float64   // Доверительная вероятность теста согласованности
+	DiagnosticsOutput      io.Writer // Таблица CSV записей диагностики (nil - не выводится)
+
+	Smoother    bool          // Сохранять весь прямой проход для сглаживания RTS
+	SmootherLag time.Duration // Задержка сглаживания с фиксированной задержкой (0 - выключено)
+
+	AdaptiveNoise *AdaptiveNoiseConfig // Адаптация Q и R по невязкам (nil - выключена)
+}
+
+// layoutModel модель с именованными блоками состояния
+type layoutModel interface {
+	Layout() *models.StateLayout
 }
 
 // NewEKFWrapper создает новый EKF
 // func NewEKFWrapper(model filter.Model, cfg *config.Config) (*EKFWrapper, error) {
 func NewEKFWrapper(model filter.Model, cfg *EKFConfig) (*EKFWrapper, error) {
 
+	if cfg.StartTime.IsZero() {
+		return nil, fmt.Errorf("не задано время начального состояния")
+	}
+
+	// Блоки состояния задает модель
+	layout := models.NavigationLayout()
+	if l, ok := model.(layoutModel); ok {
+		layout = l.Layout()
+	}
+	if len(cfg.InitialState) != layout.Dim() {
+		return nil, fmt.Errorf("размерность начального состояния %d не совпадает с блоками состояния (%d)", len(cfg.InitialState), layout.Dim())
+	}
+
 	// 1. Создаем вектор начального состояния
 	initState := mat.NewVecDense(len(cfg.InitialState), cfg.InitialState)
 
@@ -57,7 +173,7 @@ func NewEKFWrapper(model filter.Model, cfg *EKFConfig) (*EKFWrapper, error) {
 	for i := 0; i < len(cfg.ProcessNoise); i++ {
 		Q.SetSym(i, i, cfg.ProcessNoise[i])
 	}
-	processNoise, err := noise.NewGaussian(make([]float64, len(cfg.ProcessNoise)), Q)
+	processNoise, err := NewSeededGaussian(Q, nil)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка создания шума процесса: %w", err)
 	}
@@ -67,126 +183,228 @@ func NewEKFWrapper(model filter.Model, cfg *EKFConfig) (*EKFWrapper, error) {
 	for i := 0; i < len(cfg.MeasurementNoise); i++ {
 		R.SetSym(i, i, cfg.MeasurementNoise[i])
 	}
-	measNoise, err := noise.NewGaussian(make([]float64, len(cfg.MeasurementNoise)), R)
+	measNoise, err := NewSeededGaussian(R, nil)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка создания шума измерений: %w", err)
 	}
 
-	// 7. Создаем EKF с помощью New()
-	ekfFilter, err := New(model, initCond, processNoise, measNoise)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания EKF: %w", err)
+	// 7. Создаем фильтр
+	var kf estimator
+	var lastEstimate filter.Estimate
+	switch cfg.Filter {
+	case "", FilterEKF:
+		ekfFilter, err := New(model, initCond, processNoise, measNoise)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания EKF: %w", err)
+		}
+		ekfFilter.SetNumericJacobian(cfg.NumericJacobian)
+		kf = ekfFilter
+
+		// 8. Создаем lastEstimate из начальных условий
+		lastEstimate, err = estimate.NewBaseWithCov(initState, initCov)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания начального условия: %v", err)
+		}
+
+	case FilterESKF:
+		eskf, err := NewESKF(model, initCond, processNoise, measNoise, layout.Offset(models.BlockQuaternion))
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания ESKF: %w", err)
+		}
+		kf = eskf
+
+		lastEstimate, err = eskf.estimate(initState)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания начального условия: %v", err)
+		}
+
+	case FilterUKF:
+		ukfFilter, err := NewUKF(model, initCond, processNoise, measNoise, &cfg.SigmaPoints, layout.Offset(models.BlockQuaternion))
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания UKF: %w", err)
+		}
+		kf = ukfFilter
+
+		lastEstimate, err = estimate.NewBaseWithCov(initState, initCov)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания начального условия: %v", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("неизвестный тип фильтра %q (ожидается %s, %s или %s)", cfg.Filter, FilterEKF, FilterESKF, FilterUKF)
 	}
-
-	// 8. Создаем lastEstimate из начальных условий
-	lastEstimate, err := estimate.NewBaseWithCov(initState, initCov)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания начального условия: %v", err)
+	if err := kf.SetCovarianceForm(cfg.CovarianceForm, cfg.MinEigenvalue); err != nil {
+		return nil, fmt.Errorf("ошибка настройки ковариации: %w", err)
 	}
 
-	return &EKFWrapper{
-		ekf:          ekfFilter,
+	w := &EKFWrapper{
+		kf:           kf,
 		stateDim:     len(cfg.InitialState),
+		layout:       layout,
 		config:       cfg,
-		lastTime:     time.Now(),
+		lastTime:     cfg.StartTime,
 		initCond:     initCond,
 		lastEstimate: lastEstimate,
-	}, nil
+		measurements: make(map[string]measurementType),
+		rejected:     make(map[string]int),
+	}
+	if cfg.DiagnosticsWindow > 0 {
+		w.diagnostics, err = newDiagnostics(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AdaptiveNoise != nil {
+		w.adapter, err = NewNoiseAdapter(*cfg.AdaptiveNoise, cfg.ProcessNoise)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания адаптации шумов: %w", err)
+		}
+	}
+	w.record(nil, 0)
+	w.track(nil)
+
+	return w, nil
 }
 
-// Predict выполняет предсказание
+// Predict выполняет предсказание на момент t
 // func (w *EKFWrapper) Predict(acc *models.ACCData, gyro *models.GYROData) (*models.EstimatedState, error) {
-func (w *EKFWrapper) Predict(u mat.Vector) (*models.EstimatedState, error) {
-
-	w.lastTime = time.Now()
-
-	// Обновляем время в модели перед предсказанием
-	if model, ok := w.ekf.Model().(*models.PositionModel); ok {
-		model.UpdateData()
+func (w *EKFWrapper) Predict(t time.Time, u mat.Vector) (*models.EstimatedState, error) {
+
+	// Отсчет не продвигает время назад: повтор метки пропускается, более ранний отсчет отклоняется
+	if !t.After(w.lastTime) {
+		if t.Before(w.lastTime) {
+			return nil, fmt.Errorf("%w: %v раньше %v", ErrOutOfOrder, t, w.lastTime)
+		}
+		return w.state()
 	}
 
-	// 1. Получаем текущее состояние из оценки
-	x := w.lastEstimate.Val()
+	// Шаг интегрирования по временным меткам данных
+	dt := w.timeStep(t)
+	if model, ok := w.kf.Model().(StepModel); ok {
+		model.SetDT(dt)
+	}
 
-	// 2. Выполняем предсказание
-	estimate, err := w.ekf.Predict(x, u)
-	if err != nil {
+	if err := w.step(t, u, dt); err != nil {
 		return nil, fmt.Errorf("ошибка предсказания: %v", err)
 	}
 
-	w.lastEstimate = estimate
-
-	return w.estimateToState(estimate), nil
+	return w.state()
 }
 
-// Update выполняет коррекцию на основе GNSS данных
-func (w *EKFWrapper) Update(z mat.Vector) (*models.EstimatedState, error) {
+// Update выполняет коррекцию текущего состояния пришедшими измерениями (любым подмножеством зарегистрированных типов)
+func (w *EKFWrapper) Update(z ...Measurement) (*models.EstimatedState, error) {
 
-	// 1. Получаем текущее состояние
-	x := w.lastEstimate.Val()
-
-	// 2. Выполняем коррекцию
-	estimate, err := w.ekf.Update(x, nil, z)
-	if err != nil {
+	if err := w.correct(z...); err != nil {
 		return nil, fmt.Errorf("ошибка коррекции: %v", err)
 	}
 
-	w.lastEstimate = estimate
+	state, err := w.state()
+	if err != nil {
+		return nil, err
+	}
+	state.Gating = w.gating
 
-	return w.estimateToState(estimate), nil
+	return state, nil
 }
 
-// Run выполняет полный шаг (предсказание + коррекция)
+// Run выполняет полный шаг (предсказание на момент t + коррекция)
 // func (w *EKFWrapper) Run(acc *models.ACCData, gyro *models.GYROData, gnss *models.GNSSData) (*models.EstimatedState, error) {
-func (w *EKFWrapper) Run(u mat.Vector, z mat.Vector) (*models.EstimatedState, error) {
+func (w *EKFWrapper) Run(t time.Time, u mat.Vector, z ...Measurement) (*models.EstimatedState, error) {
 
-	// Получаем текущее состояние
-	x := w.lastEstimate.Val()
-
-	// Выполняем полный шаг
-	estimate, err := w.ekf.Run(x, u, z)
-	if err != nil {
+	if _, err := w.Predict(t, u); err != nil {
 		return nil, fmt.Errorf("ошибка выполнения шага EKF: %v", err)
 	}
 
-	w.lastEstimate = estimate
+	return w.Update(z...)
+}
+
+// timeStep возвращает шаг интегрирования от текущего состояния до более позднего момента t (с);
+// разрывы длиннее MaxTimeStep ограничиваются.
+func (w *EKFWrapper) timeStep(t time.Time) float64 {
+	dt := t.Sub(w.lastTime).Seconds()
+	if w.config.MaxTimeStep > 0 && dt > w.config.MaxTimeStep {
+		dt = w.config.MaxTimeStep
+	}
+
+	return dt
+}
 
-	return w.estimateToState(estimate), nil
+// Time возвращает время текущего состояния
+func (w *EKFWrapper) Time() time.Time {
+	return w.lastTime
 }
 
 // estimateToState преобразует оценку в EstimatedState
 func (w *EKFWrapper) estimateToState(est filter.Estimate) *models.EstimatedState {
 	state := &models.EstimatedState{
-		Timestamp: time.Now(), // В реальном приложении использовать временную метку данных
+		Timestamp: w.lastTime,
+	}
+	for _, n := range w.rejected {
+		state.Rejected += n
 	}
 
 	val := est.Val()
 	cov := est.Cov()
 
+	p := w.layout.Offset(models.BlockPosition)
+	q := w.layout.Offset(models.BlockQuaternion)
+
 	// Извлекаем состояние
-	state.PositionX = val.At(0, 0)
-	state.PositionY = val.At(1, 0)
-	state.PositionZ = val.At(2, 0)
+	state.PositionX = val.At(p, 0)
+	state.PositionY = val.At(p+1, 0)
+	state.PositionZ = val.At(p+2, 0)
 
-	state.QuaternionW = val.At(6, 0)
-	state.QuaternionX = val.At(7, 0)
-	state.QuaternionY = val.At(8, 0)
-	state.QuaternionZ = val.At(9, 0)
+	state.QuaternionW = val.At(q, 0)
+	state.QuaternionX = val.At(q+1, 0)
+	state.QuaternionY = val.At(q+2, 0)
+	state.QuaternionZ = val.At(q+3, 0)
 
 	// Извлекаем ковариации
-	state.CovarianceXX = cov.At(0, 0)
-	state.CovarianceYY = cov.At(1, 1)
-	state.CovarianceZZ = cov.At(2, 2)
+	state.CovarianceXX = cov.At(p, p)
+	state.CovarianceYY = cov.At(p+1, p+1)
+	state.CovarianceZZ = cov.At(p+2, p+2)
 
-	state.CovarianceQwQw = cov.At(6, 6)
-	state.CovarianceQxQx = cov.At(7, 7)
-	state.CovarianceQyQy = cov.At(8, 8)
-	state.CovarianceQzQz = cov.At(9, 9)
+	state.CovarianceQwQw = cov.At(q, q)
+	state.CovarianceQxQx = cov.At(q+1, q+1)
+	state.CovarianceQyQy = cov.At(q+2, q+2)
+	state.CovarianceQzQz = cov.At(q+3, q+3)
 
 	return state
 }
 
+// state возвращает текущее состояние со сглаженной оценкой с задержкой
+func (w *EKFWrapper) state() (*models.EstimatedState, error) {
+	state := w.estimateToState(w.lastEstimate)
+
+	lagged, err := w.lagged()
+	if err != nil {
+		return nil, err
+	}
+	state.Lagged = lagged
+
+	return state, nil
+}
+
+// newEstimate возвращает оценку с состоянием x и ковариацией фильтра p
+// (для eskf - пересчитанной из пространства ошибки)
+func (w *EKFWrapper) newEstimate(x mat.Vector, p mat.Symmetric) (filter.Estimate, error) {
+	if es, ok := w.kf.(errorStater); ok {
+		return es.estimateCov(x, p)
+	}
+	return estimate.NewBaseWithCov(x, p)
+}
+
 // GetState возвращает текущее состояние
 func (w *EKFWrapper) GetState() *models.EstimatedState {
 	return w.estimateToState(w.lastEstimate)
 }
+
+// CovarianceHealth возвращает диагностику ковариации фильтра
+func (w *EKFWrapper) CovarianceHealth() CovarianceHealth {
+	return w.kf.CovarianceHealth()
+}
+
+// Cov возвращает ковариацию текущего состояния (для eskf - пересчитанную в пространство состояния)
+func (w *EKFWrapper) Cov() mat.Symmetric {
+	return w.lastEstimate.Cov()
+}
@@ -0,0 +1,521 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"github.com/milosgajdos/go-estimate/estimate"
+	"github.com/milosgajdos/go-estimate/noise"
+	"gonum.org/v1/gonum/mat"
+)
+
+// ESKF фильтр Калмана по вектору ошибки (error-state EKF) с мультипликативной ошибкой ориентации.
+// Номинальное состояние модели содержит кватернион из 4 элементов, вектор ошибки вместо него -
+// малый угол поворота δθ из 3 элементов: q_true = q ⊗ [1, δθ/2]. Остальные компоненты ошибки аддитивны.
+// После коррекции ошибка переносится в номинальное состояние, ковариация пересчитывается шагом сброса.
+type ESKF struct {
+	// m модель номинального состояния; должна предоставлять аналитические якобианы
+	m  filter.Model
+	jm JacobianModel
+	// att индекс кватерниона в номинальном состоянии
+	att int
+	// q шум процесса в пространстве ошибки
+	q filter.Noise
+	// r шум измерений
+	r filter.Noise
+	// p ковариация вектора ошибки
+	p *mat.SymDense
+	// inn вектор невязки
+	inn *mat.VecDense
+	// s ковариация невязки
+	s *mat.SymDense
+	// k коэффициент усиления
+	k *mat.Dense
+	// f якобиан ошибки последнего предсказания
+	f *mat.Dense
+	// cov вычисление ковариации в заданной форме с проверкой положительной определенности
+	cov *covarianceGuard
+}
+
+// NewESKF создает фильтр по вектору ошибки.
+// - m:    модель номинального состояния (должна реализовывать JacobianModel)
+// - init: начальное номинальное состояние и ковариация ошибки размерности nx-1
+// - q:    шум процесса в пространстве ошибки (nx-1)
+// - r:    шум измерений (ny)
+// - att:  индекс первого элемента кватерниона (w, x, y, z) в номинальном состоянии
+func NewESKF(m filter.Model, init filter.InitCond, q, r filter.Noise, att int) (*ESKF, error) {
+	nx, _, ny, _ := m.SystemDims()
+	if nx <= 0 || ny <= 0 {
+		return nil, fmt.Errorf("invalid model dimensions: [%d x %d]", nx, ny)
+	}
+	if att < 0 || att+4 > nx {
+		return nil, fmt.Errorf("неверный индекс кватерниона %d для состояния размерности %d", att, nx)
+	}
+
+	jm, ok := m.(JacobianModel)
+	if !ok {
+		return nil, fmt.Errorf("ESKF требует модель с аналитическими якобианами")
+	}
+
+	ne := nx - 1
+	if init.Cov().SymmetricDim() != ne {
+		return nil, fmt.Errorf("неверная размерность ковариации ошибки: %d, ожидается %d", init.Cov().SymmetricDim(), ne)
+	}
+	if q == nil {
+		q, _ = noise.NewNone()
+	} else if q.Cov().SymmetricDim() != ne {
+		return nil, fmt.Errorf("неверная размерность шума процесса: %d, ожидается %d", q.Cov().SymmetricDim(), ne)
+	}
+	if r == nil {
+		r, _ = noise.NewNone()
+	} else if r.Cov().SymmetricDim() != ny {
+		return nil, fmt.Errorf("invalid output noise dimension: %d", r.Cov().SymmetricDim())
+	}
+
+	p := mat.NewSymDense(ne, nil)
+	p.CopySym(init.Cov())
+
+	cov, err := newCovarianceGuard(CovarianceJoseph, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ESKF{
+		m:   m,
+		jm:  jm,
+		att: att,
+		q:   q,
+		r:   r,
+		p:   p,
+		inn: mat.NewVecDense(ny, nil),
+		k:   mat.NewDense(ne, ny, nil),
+		cov: cov,
+	}, nil
+}
+
+// Predict распространяет номинальное состояние x без шума и ковариацию ошибки
+func (k *ESKF) Predict(x, u mat.Vector) (filter.Estimate, error) {
+	xNext, err := k.m.Propagate(x, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("system state propagation failed: %v", err)
+	}
+
+	fx, err := k.jm.StateJacobian(x, u)
+	if err != nil {
+		return nil, fmt.Errorf("propagation Jacobian failed: %v", err)
+	}
+
+	// Якобиан ошибки: δx_next = X⁺(x_next)·F·X(x)·δx
+	fxm := &mat.Dense{}
+	fxm.Mul(fx, k.stateFromError(x))
+	fe := &mat.Dense{}
+	fe.Mul(k.errorFromState(xNext), fxm)
+
+	var q mat.Symmetric
+	if _, ok := k.q.(*noise.None); !ok {
+		q = k.q.Cov()
+	}
+	k.p.CopySym(k.cov.congruence(k.p.SymmetricDim(), covTerm{a: fe, p: k.p, state: true}, covTerm{p: q}))
+	k.f = fe
+
+	return k.estimate(xNext)
+}
+
+// Update корректирует номинальное состояние x измерением z: оценивает вектор ошибки,
+// переносит его в номинальное состояние и выполняет сброс ковариации
+func (k *ESKF) Update(x, u, z mat.Vector) (filter.Estimate, error) {
+	_, _, ny, _ := k.m.SystemDims()
+	if z.Len() != ny {
+		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
+	}
+
+	y, err := k.m.Observe(x, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to observe system output: %v", err)
+	}
+
+	hx, err := k.jm.ObservationJacobian(x, u)
+	if err != nil {
+		return nil, fmt.Errorf("observation Jacobian failed: %v", err)
+	}
+
+	inn := &mat.VecDense{}
+	inn.SubVec(z, y)
+
+	return k.correct(x, inn, hx, k.r, nil)
+}
+
+// UpdateMeasurement корректирует номинальное состояние x измерением z модели измерения m с шумом r.
+// Если задан gate, измерение проверяется по невязке; отброшенное измерение не меняет фильтр.
+func (k *ESKF) UpdateMeasurement(x, z mat.Vector, m MeasurementModel, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	if z.Len() != m.Dim() || r.Cov().SymmetricDim() != m.Dim() {
+		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
+	}
+
+	y, err := m.Observe(x)
+	if err != nil {
+		return nil, fmt.Errorf("failed to observe measurement: %v", err)
+	}
+
+	hx, err := m.Jacobian(x)
+	if err != nil {
+		return nil, fmt.Errorf("measurement Jacobian failed: %v", err)
+	}
+
+	return k.correct(x, m.Residual(z, y), hx, r, gate)
+}
+
+// correct оценивает вектор ошибки по невязке inn с якобианом hx по номинальному состоянию и шумом r,
+// переносит ошибку в номинальное состояние и выполняет сброс ковариации
+func (k *ESKF) correct(x mat.Vector, inn *mat.VecDense, hx *mat.Dense, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	h := &mat.Dense{}
+	h.Mul(hx, k.stateFromError(x))
+
+	ne := k.p.SymmetricDim()
+
+	// S = H·P·Hᵀ + R с учетом проверки невязки
+	pht := &mat.Dense{}
+	pht.Mul(k.p, h.T())
+	hph := &mat.Dense{}
+	hph.Mul(h, pht)
+	s, rCov, err := innovationCov(hph, inn, r, gate)
+	if errors.Is(err, ErrMeasurementRejected) {
+		k.inn = mat.VecDenseCopyOf(inn)
+		k.s = mat.NewSymDense(inn.Len(), nil)
+		setSym(k.s, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sInv := &mat.Dense{}
+	if err := sInv.Inverse(s); err != nil {
+		return nil, fmt.Errorf("failed to calculat Pyy inverse: %v", err)
+	}
+	gain := &mat.Dense{}
+	gain.Mul(pht, sInv)
+
+	dx := &mat.VecDense{}
+	dx.MulVec(gain, inn)
+
+	a := &mat.Dense{}
+	a.Mul(gain, h)
+	a.Scale(-1, a)
+	for i := 0; i < ne; i++ {
+		a.Set(i, i, a.At(i, i)+1)
+	}
+
+	// Перенос ошибки в номинальное состояние
+	xCorr := k.inject(x, dx)
+
+	// Форма Джозефа со сбросом: P = G·(I-KH)·P·(I-KH)ᵀ·Gᵀ + G·K·R·Kᵀ·Gᵀ
+	g := k.resetJacobian(dx)
+	ga := &mat.Dense{}
+	ga.Mul(g, a)
+	gk := &mat.Dense{}
+	gk.Mul(g, gain)
+	k.p.CopySym(k.cov.congruence(ne, covTerm{a: ga, p: k.p, state: true}, covTerm{a: gk, p: rCov}))
+
+	k.inn = mat.VecDenseCopyOf(inn)
+	k.s = mat.NewSymDense(inn.Len(), nil)
+	setSym(k.s, s)
+	k.k = mat.DenseCopyOf(gain)
+
+	return k.estimate(xCorr)
+}
+
+// Run выполняет предсказание и коррекцию
+func (k *ESKF) Run(x, u, z mat.Vector) (filter.Estimate, error) {
+	pred, err := k.Predict(x, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Update(pred.Val(), u, z)
+}
+
+// Model возвращает модель номинального состояния
+func (k *ESKF) Model() filter.Model {
+	return k.m
+}
+
+// Cov возвращает ковариацию вектора ошибки
+func (k *ESKF) Cov() mat.Symmetric {
+	cov := mat.NewSymDense(k.p.SymmetricDim(), nil)
+	cov.CopySym(k.p)
+
+	return cov
+}
+
+// SetCov задает ковариацию вектора ошибки
+func (k *ESKF) SetCov(cov mat.Symmetric) error {
+	if cov == nil {
+		return fmt.Errorf("invalid covariance matrix: %v", cov)
+	}
+	if cov.SymmetricDim() != k.p.SymmetricDim() {
+		return fmt.Errorf("invalid covariance matrix dims: [%d x %d]", cov.SymmetricDim(), cov.SymmetricDim())
+	}
+
+	k.p.CopySym(cov)
+
+	return nil
+}
+
+// SetStateNoise задает шум процесса в пространстве ошибки для последующих предсказаний
+func (k *ESKF) SetStateNoise(q filter.Noise) error {
+	if q == nil {
+		return fmt.Errorf("invalid state noise: %v", q)
+	}
+	if q.Cov().SymmetricDim() != k.p.SymmetricDim() {
+		return fmt.Errorf("неверная размерность шума процесса: %d, ожидается %d", q.Cov().SymmetricDim(), k.p.SymmetricDim())
+	}
+
+	k.q = q
+
+	return nil
+}
+
+// SetOutputNoise задает шум измерений для последующих коррекций
+func (k *ESKF) SetOutputNoise(r filter.Noise) error {
+	if r == nil {
+		return fmt.Errorf("invalid output noise: %v", r)
+	}
+
+	_, _, ny, _ := k.m.SystemDims()
+	if r.Cov().SymmetricDim() != ny {
+		return fmt.Errorf("invalid output noise dimension: %d", r.Cov().SymmetricDim())
+	}
+
+	k.r = r
+
+	return nil
+}
+
+// Innovation возвращает невязку последней коррекции (в том числе отброшенного измерения)
+func (k *ESKF) Innovation() mat.Vector {
+	return mat.VecDenseCopyOf(k.inn)
+}
+
+// InnovationCov возвращает ковариацию невязки последней коррекции (в том числе отброшенного измерения)
+func (k *ESKF) InnovationCov() mat.Symmetric {
+	return copySym(k.s)
+}
+
+// Gain возвращает коэффициент усиления последней коррекции
+func (k *ESKF) Gain() mat.Matrix {
+	gain := &mat.Dense{}
+	gain.CloneFrom(k.k)
+
+	return gain
+}
+
+// SetCovarianceForm задает форму вычисления ковариации (joseph или sqrt) и нижнюю границу
+// собственных чисел, до которой исправляется не положительно определенная ковариация
+func (k *ESKF) SetCovarianceForm(form string, minEigenvalue float64) error {
+	cov, err := newCovarianceGuard(form, minEigenvalue)
+	if err != nil {
+		return err
+	}
+	k.cov = cov
+
+	return nil
+}
+
+// CovarianceHealth возвращает накопленную диагностику ковариации
+func (k *ESKF) CovarianceHealth() CovarianceHealth {
+	return k.cov.health
+}
+
+// Transition возвращает якобиан ошибки последнего предсказания (nil - предсказаний не было)
+func (k *ESKF) Transition() mat.Matrix {
+	if k.f == nil {
+		return nil
+	}
+	f := &mat.Dense{}
+	f.CloneFrom(k.f)
+
+	return f
+}
+
+// estimate возвращает оценку с номинальным состоянием x и ковариацией, пересчитанной
+// в пространство номинального состояния: X·P·Xᵀ (для кватерниона - вырожденная)
+func (k *ESKF) estimate(x mat.Vector) (filter.Estimate, error) {
+	return k.estimateCov(x, k.p)
+}
+
+// estimateCov возвращает оценку с номинальным состоянием x и ковариацией ошибки p,
+// пересчитанной в пространство номинального состояния
+func (k *ESKF) estimateCov(x mat.Vector, p mat.Symmetric) (filter.Estimate, error) {
+	xm := k.stateFromError(x)
+
+	xp := &mat.Dense{}
+	xp.Mul(xm, p)
+	cov := &mat.Dense{}
+	cov.Mul(xp, xm.T())
+
+	n := x.Len()
+	sym := mat.NewSymDense(n, nil)
+	setSym(sym, cov)
+
+	return estimate.NewBaseWithCov(x, sym)
+}
+
+// stateFromError возвращает X = ∂x/∂δx [nx x ne]: единичные блоки, для кватерниона ∂(q ⊗ [1, δθ/2])/∂δθ
+func (k *ESKF) stateFromError(x mat.Vector) *mat.Dense {
+	nx := x.Len()
+	xm := mat.NewDense(nx, nx-1, nil)
+
+	for i := 0; i < nx; i++ {
+		switch {
+		case i < k.att:
+			xm.Set(i, i, 1)
+		case i >= k.att+4:
+			xm.Set(i, i-1, 1)
+		}
+	}
+
+	lq := leftQuaternionMatrix(k.quaternion(x))
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 3; j++ {
+			xm.Set(k.att+i, k.att+j, 0.5*lq[i][1+j])
+		}
+	}
+
+	return xm
+}
+
+// errorFromState возвращает X⁺ = ∂δx/∂x [ne x nx]: для кватерниона δθ = 2·vec(q⁻¹ ⊗ δq)
+func (k *ESKF) errorFromState(x mat.Vector) *mat.Dense {
+	nx := x.Len()
+	xm := mat.NewDense(nx-1, nx, nil)
+
+	for i := 0; i < nx; i++ {
+		switch {
+		case i < k.att:
+			xm.Set(i, i, 1)
+		case i >= k.att+4:
+			xm.Set(i-1, i, 1)
+		}
+	}
+
+	q := k.quaternion(x)
+	norm2 := q[0]*q[0] + q[1]*q[1] + q[2]*q[2] + q[3]*q[3]
+	lq := leftQuaternionMatrix(q)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 4; j++ {
+			xm.Set(k.att+i, k.att+j, 2*lq[j][1+i]/norm2)
+		}
+	}
+
+	return xm
+}
+
+// inject переносит вектор ошибки dx в номинальное состояние x
+func (k *ESKF) inject(x mat.Vector, dx *mat.VecDense) *mat.VecDense {
+	nx := x.Len()
+	xCorr := mat.NewVecDense(nx, nil)
+
+	for i := 0; i < nx; i++ {
+		switch {
+		case i < k.att:
+			xCorr.SetVec(i, x.AtVec(i)+dx.AtVec(i))
+		case i >= k.att+4:
+			xCorr.SetVec(i, x.AtVec(i)+dx.AtVec(i-1))
+		}
+	}
+
+	dq := rotationVectorQuaternion(dx.AtVec(k.att), dx.AtVec(k.att+1), dx.AtVec(k.att+2))
+	q := normalize(multiplyQuaternion(k.quaternion(x), dq))
+	for i := 0; i < 4; i++ {
+		xCorr.SetVec(k.att+i, q[i])
+	}
+
+	return xCorr
+}
+
+// resetJacobian возвращает якобиан сброса G: единичный, для ориентации I - [δθ/2]×
+func (k *ESKF) resetJacobian(dx *mat.VecDense) *mat.Dense {
+	ne := dx.Len()
+	g := mat.NewDense(ne, ne, nil)
+	for i := 0; i < ne; i++ {
+		g.Set(i, i, 1)
+	}
+
+	a := k.att
+	hx, hy, hz := dx.AtVec(a)/2, dx.AtVec(a+1)/2, dx.AtVec(a+2)/2
+	g.Set(a, a+1, hz)
+	g.Set(a, a+2, -hy)
+	g.Set(a+1, a, -hz)
+	g.Set(a+1, a+2, hx)
+	g.Set(a+2, a, hy)
+	g.Set(a+2, a+1, -hx)
+
+	return g
+}
+
+// quaternion возвращает кватернион (w, x, y, z) номинального состояния
+func (k *ESKF) quaternion(x mat.Vector) [4]float64 {
+	return [4]float64{x.AtVec(k.att), x.AtVec(k.att + 1), x.AtVec(k.att + 2), x.AtVec(k.att + 3)}
+}
+
+// leftQuaternionMatrix матрица L(q): q ⊗ p = L(q)·p
+func leftQuaternionMatrix(q [4]float64) [4][4]float64 {
+	w, x, y, z := q[0], q[1], q[2], q[3]
+	return [4][4]float64{
+		{w, -x, -y, -z},
+		{x, w, -z, y},
+		{y, z, w, -x},
+		{z, -y, x, w},
+	}
+}
+
+// multiplyQuaternion произведение кватернионов p ⊗ q
+func multiplyQuaternion(p, q [4]float64) [4]float64 {
+	l := leftQuaternionMatrix(p)
+	var r [4]float64
+	for i := 0; i < 4; i++ {
+		r[i] = l[i][0]*q[0] + l[i][1]*q[1] + l[i][2]*q[2] + l[i][3]*q[3]
+	}
+	return r
+}
+
+// rotationVectorQuaternion кватернион поворота на вектор θ
+func rotationVectorQuaternion(x, y, z float64) [4]float64 {
+	angle := math.Sqrt(x*x + y*y + z*z)
+	if angle < 1e-12 {
+		return normalize([4]float64{1, x / 2, y / 2, z / 2})
+	}
+	s, c := math.Sincos(angle / 2)
+	return [4]float64{c, x / angle * s, y / angle * s, z / angle * s}
+}
+
+// normalize нормирует кватернион
+func normalize(q [4]float64) [4]float64 {
+	norm := math.Sqrt(q[0]*q[0] + q[1]*q[1] + q[2]*q[2] + q[3]*q[3])
+	if norm < 1e-12 {
+		return [4]float64{1, 0, 0, 0}
+	}
+	return [4]float64{q[0] / norm, q[1] / norm, q[2] / norm, q[3] / norm}
+}
+
+// copySym возвращает копию симметричной матрицы (пустую при nil)
+func copySym(s *mat.SymDense) mat.Symmetric {
+	if s == nil {
+		return &mat.SymDense{}
+	}
+	c := mat.NewSymDense(s.SymmetricDim(), nil)
+	c.CopySym(s)
+	return c
+}
+
+// setSym копирует симметричную часть квадратной матрицы m в sym
+func setSym(sym *mat.SymDense, m mat.Matrix) {
+	n := sym.SymmetricDim()
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			sym.SetSym(i, j, (m.At(i, j)+m.At(j, i))/2)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ekf
+
+import (
+	"main.go/internal/models"
+)
+
+// smoothLag отмечает коррекцию текущего шага: сглаженные оценки окна, вычисленные до нее, сбрасываются,
+// а скорректированный шаг становится началом обратного прохода. Сам проход выполняется в lagged
+// по запросу и только до запрошенного шага: несколько коррекций до запроса (повторный прогон истории)
+// дают один проход, и каждый шаг сглаживается не более одного раза на коррекцию.
+func (w *EKFWrapper) smoothLag() {
+	if w.config.SmootherLag <= 0 || len(w.trajectory) == 0 {
+		return
+	}
+
+	w.clearLag()
+	last := &w.trajectory[len(w.trajectory)-1]
+	last.xs, last.ps = last.x, last.p
+}
+
+// clearLag сбрасывает сглаженные оценки всех шагов прямого прохода
+func (w *EKFWrapper) clearLag() {
+	for i := range w.trajectory {
+		w.trajectory[i].xs, w.trajectory[i].ps = nil, nil
+	}
+}
+
+// lagged возвращает сглаженную оценку на момент lastTime - SmootherLag: последний шаг прямого прохода
+// не позже этого момента (nil - сглаживание с задержкой выключено или окно еще не заполнено).
+// Обратный проход идет от ближайшего более позднего шага со сглаженной оценкой; если такого нет,
+// после шага коррекций не было и сглаженная оценка совпадает с оценкой фильтра.
+func (w *EKFWrapper) lagged() (*models.EstimatedState, error) {
+	if w.config.SmootherLag <= 0 {
+		return nil, nil
+	}
+	k := w.lagIndex()
+	if k < 0 {
+		return nil, nil
+	}
+
+	j := k
+	for j < len(w.trajectory) && w.trajectory[j].xs == nil {
+		j++
+	}
+	if j == len(w.trajectory) {
+		e := w.trajectory[k]
+		return w.smoothedState(e.t, e.x, e.p)
+	}
+
+	xs, ps := w.trajectory[j].xs, w.trajectory[j].ps
+	for i := j - 1; i >= k; i-- {
+		var err error
+		xs, ps, err = w.smoothStep(i, xs, ps)
+		if err != nil {
+			return nil, err
+		}
+		w.trajectory[i].xs, w.trajectory[i].ps = xs, ps
+	}
+
+	return w.smoothedState(w.trajectory[k].t, xs, ps)
+}
+
+// lagIndex возвращает индекс последнего шага прямого прохода не позже lastTime - SmootherLag (-1 - нет такого)
+func (w *EKFWrapper) lagIndex() int {
+	t := w.lastTime.Add(-w.config.SmootherLag)
+	k := len(w.trajectory) - 1
+	for k >= 0 && w.trajectory[k].t.After(t) {
+		k--
+	}
+	return k
+}
+
+// trimLag удаляет шаги прямого прохода старше окна задержки и истории состояний
+// (весь проход сохраняется только для сглаживания RTS)
+func (w *EKFWrapper) trimLag() {
+	if w.config.Smoother || w.config.SmootherLag <= 0 {
+		return
+	}
+
+	// Сохраняем один шаг не позже начала окна
+	start := w.lastTime.Add(-w.config.SmootherLag - w.config.History)
+	n := 0
+	for n < len(w.trajectory)-1 && !w.trajectory[n+1].t.After(start) {
+		n++
+	}
+	if n > 0 {
+		w.trajectory = append(w.trajectory[:0], w.trajectory[n:]...)
+	}
+}
@@ -0,0 +1,188 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"github.com/milosgajdos/go-estimate/noise"
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat/distuv"
+
+	"main.go/internal/models"
+)
+
+// ErrMeasurementRejected измерение отброшено проверкой невязки
+var ErrMeasurementRejected = errors.New("измерение отброшено проверкой невязки")
+
+// GateFunc принимает решение по измерению с квадратом расстояния Махаланобиса невязки d2;
+// distance возвращает квадрат расстояния при ковариации шума измерения, умноженной на scale.
+// Возвращает множитель ковариации шума измерения (1 - без изменений) или false, если измерение отбрасывается
+type GateFunc func(d2 float64, distance func(scale float64) float64) (scale float64, accept bool)
+
+// Действия при превышении порога
+const (
+	GateOff     = "off"     // Проверка выключена
+	GateReject  = "reject"  // Измерение отбрасывается
+	GateInflate = "inflate" // Ковариация шума увеличивается так, чтобы квадрат расстояния стал равен порогу
+)
+
+// Gate проверка невязки измерения по критерию хи-квадрат
+type Gate struct {
+	Policy    string  // off, reject, inflate
+	Threshold float64 // Порог квадрата расстояния Махаланобиса
+}
+
+// NewGate создает проверку с порогом - квантилем хи-квадрат с dof степенями свободы
+// для доверительной вероятности probability
+func NewGate(policy string, probability float64, dof int) (Gate, error) {
+	switch policy {
+	case GateOff, GateReject, GateInflate:
+	default:
+		return Gate{}, fmt.Errorf("неизвестное действие проверки невязки %q", policy)
+	}
+	if probability <= 0 || probability >= 1 {
+		return Gate{}, fmt.Errorf("доверительная вероятность %v вне (0, 1)", probability)
+	}
+
+	return Gate{Policy: policy, Threshold: distuv.ChiSquared{K: float64(dof)}.Quantile(probability)}, nil
+}
+
+// SetGate задает проверку невязки для измерений типа typ
+func (w *EKFWrapper) SetGate(typ string, gate Gate) error {
+	mt, ok := w.measurements[typ]
+	if !ok {
+		return fmt.Errorf("тип измерения %q не зарегистрирован", typ)
+	}
+	switch gate.Policy {
+	case GateOff, GateReject, GateInflate:
+	default:
+		return fmt.Errorf("неизвестное действие проверки невязки %q", gate.Policy)
+	}
+	if gate.Policy != GateOff && gate.Threshold <= 0 {
+		return fmt.Errorf("неверный порог проверки невязки %v", gate.Threshold)
+	}
+
+	mt.gate = gate
+	w.measurements[typ] = mt
+
+	return nil
+}
+
+// Rejected возвращает число отброшенных измерений по типам
+func (w *EKFWrapper) Rejected() map[string]int {
+	rejected := make(map[string]int, len(w.rejected))
+	for typ, n := range w.rejected {
+		rejected[typ] = n
+	}
+	return rejected
+}
+
+// gateFunc возвращает функцию проверки невязки для измерения типа typ; решение записывается в decision.
+// Квадрат расстояния (NIS) записывается и при выключенной проверке.
+func (g Gate) gateFunc(typ string, decision *models.GateDecision) GateFunc {
+	*decision = models.GateDecision{Type: typ, Threshold: g.Threshold, Action: models.GateAccepted, Scale: 1}
+	off := g.Policy == "" || g.Policy == GateOff
+
+	return func(d2 float64, distance func(float64) float64) (float64, bool) {
+		decision.Distance2 = d2
+		if off || d2 <= g.Threshold {
+			return 1, true
+		}
+		if g.Policy == GateReject {
+			decision.Action = models.GateRejected
+			return 1, false
+		}
+		decision.Action = models.GateInflated
+		decision.Scale = inflateScale(d2, g.Threshold, distance)
+		return decision.Scale, true
+	}
+}
+
+// inflateScale находит множитель шума измерения, при котором квадрат расстояния не больше порога
+// и отличается от него не более чем на относительную точность поиска. Расстояние убывает с ростом
+// множителя; при множителе d2/threshold оно еще не меньше порога (увеличивается только R, а не S).
+func inflateScale(d2, threshold float64, distance func(float64) float64) float64 {
+	const iterations = 60
+
+	lo := d2 / threshold
+	hi := 2 * lo
+	for i := 0; distance(hi) > threshold; i++ {
+		if i == iterations {
+			// Расстояние не опускается до порога: невязка определяется ковариацией состояния
+			return hi
+		}
+		lo, hi = hi, 2*hi
+	}
+
+	for i := 0; i < iterations && hi-lo > 1e-9*hi; i++ {
+		mid := (lo + hi) / 2
+		if distance(mid) > threshold {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi
+}
+
+// innovationCov возвращает ковариацию невязки S = hph + R, применяя проверку gate.
+// Возвращает ковариацию шума измерения с учетом множителя (nil - без шума) или ErrMeasurementRejected
+// вместе с ковариацией невязки без множителя.
+func innovationCov(hph *mat.Dense, inn *mat.VecDense, r filter.Noise, gate GateFunc) (*mat.Dense, mat.Symmetric, error) {
+	var rCov mat.Symmetric
+	if _, ok := r.(*noise.None); !ok {
+		rCov = r.Cov()
+	}
+
+	s := mat.DenseCopyOf(hph)
+	if rCov != nil {
+		s.Add(s, rCov)
+	}
+	if gate == nil {
+		return s, rCov, nil
+	}
+
+	d2, err := mahalanobis(inn, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	distance := func(scale float64) float64 {
+		if rCov == nil {
+			return d2
+		}
+		scaled := mat.NewSymDense(rCov.SymmetricDim(), nil)
+		scaled.ScaleSym(scale, rCov)
+		sc := mat.DenseCopyOf(hph)
+		sc.Add(sc, scaled)
+		d, err := mahalanobis(inn, sc)
+		if err != nil {
+			return math.Inf(1)
+		}
+		return d
+	}
+	scale, ok := gate(d2, distance)
+	if !ok {
+		return s, nil, ErrMeasurementRejected
+	}
+	if scale != 1 && rCov != nil {
+		scaled := mat.NewSymDense(rCov.SymmetricDim(), nil)
+		scaled.ScaleSym(scale, rCov)
+		rCov = scaled
+
+		s = mat.DenseCopyOf(hph)
+		s.Add(s, rCov)
+	}
+
+	return s, rCov, nil
+}
+
+// mahalanobis возвращает квадрат расстояния Махаланобиса innᵀ·S⁻¹·inn
+func mahalanobis(inn *mat.VecDense, s mat.Matrix) (float64, error) {
+	y := &mat.VecDense{}
+	if err := y.SolveVec(s, inn); err != nil {
+		return 0, fmt.Errorf("failed to solve innovation covariance: %v", err)
+	}
+	return mat.Dot(inn, y), nil
+}
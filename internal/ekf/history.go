@@ -0,0 +1,242 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// ErrStaleMeasurement измерение старше хранимой истории состояний
+var ErrStaleMeasurement = errors.New("измерение старше истории состояний")
+
+// ErrOutOfOrder отсчет с меткой времени раньше текущего состояния
+var ErrOutOfOrder = errors.New("нарушен порядок меток времени")
+
+// StepModel модель с явно задаваемым шагом интегрирования; нужна для повторного прогона истории
+type StepModel interface {
+	DT() float64
+	SetDT(dt float64)
+}
+
+// historyEntry состояние фильтра на момент t
+type historyEntry struct {
+	t   time.Time
+	u   mat.Vector // Вход, с которым выполнен шаг к моменту t (nil - начальное состояние)
+	dt  float64    // Шаг интегрирования к моменту t (с)
+	est filter.Estimate
+	cov mat.Symmetric // Ковариация фильтра (для ESKF - в пространстве ошибки)
+
+	adaptive *AdaptiveState // Состояние адаптации шумов (nil - выключена)
+}
+
+// UpdateAt выполняет коррекцию измерениями z, полученными в момент t раньше текущего состояния:
+// фильтр возвращается к состоянию на момент t, выполняет коррекцию и заново прогоняет
+// предсказания по сохраненным входам IMU до текущего момента.
+func (w *EKFWrapper) UpdateAt(t time.Time, z ...Measurement) (*models.EstimatedState, error) {
+	if t.After(w.lastTime) {
+		return nil, fmt.Errorf("измерение на %v позже текущего состояния %v", t, w.lastTime)
+	}
+
+	// Последнее состояние не позже t
+	k := len(w.history) - 1
+	for k >= 0 && w.history[k].t.After(t) {
+		k--
+	}
+	if k < 0 {
+		return nil, fmt.Errorf("%w: %v", ErrStaleMeasurement, t)
+	}
+	if k == len(w.history)-1 {
+		return w.Update(z...)
+	}
+
+	model, ok := w.kf.Model().(StepModel)
+	if !ok {
+		return nil, fmt.Errorf("модель не поддерживает повторный прогон истории")
+	}
+	dt := model.DT()
+
+	// Возврат к состоянию на момент t_k
+	tail := append([]historyEntry(nil), w.history[k+1:]...)
+	if err := w.restore(k); err != nil {
+		return nil, err
+	}
+
+	// Шаг от t_k до t выполняется с входом следующего шага, остаток шага - после коррекции
+	if split := t.Sub(w.lastTime).Seconds(); split > 0 {
+		model.SetDT(split)
+		if err := w.step(t, tail[0].u, split); err != nil {
+			return nil, fmt.Errorf("ошибка повторного прогона: %v", err)
+		}
+		tail[0].dt -= split
+	}
+
+	if err := w.correct(z...); err != nil {
+		return nil, fmt.Errorf("ошибка коррекции: %v", err)
+	}
+
+	// Повторный прогон предсказаний до текущего момента
+	for _, e := range tail {
+		model.SetDT(e.dt)
+		if err := w.step(e.t, e.u, e.dt); err != nil {
+			return nil, fmt.Errorf("ошибка повторного прогона: %v", err)
+		}
+	}
+	model.SetDT(dt)
+
+	state, err := w.state()
+	if err != nil {
+		return nil, err
+	}
+	state.Gating = w.gating
+
+	return state, nil
+}
+
+// step выполняет предсказание на момент t с входом u и сохраняет состояние в истории
+func (w *EKFWrapper) step(t time.Time, u mat.Vector, dt float64) error {
+	est, err := w.kf.Predict(w.lastEstimate.Val(), u)
+	if err != nil {
+		return err
+	}
+
+	w.lastEstimate = est
+	w.lastTime = t
+	if w.adapter != nil {
+		w.adapter.predicted()
+	}
+	w.record(u, dt)
+	w.track(w.kf.Transition())
+
+	return nil
+}
+
+// correct последовательно корректирует текущее состояние измерениями и заменяет его в истории
+func (w *EKFWrapper) correct(z ...Measurement) error {
+	w.gating = nil
+	w.innovations = nil
+	for _, m := range z {
+		if err := w.applyMeasurement(m); err != nil {
+			return err
+		}
+	}
+	if w.adapter != nil {
+		w.adapter.epoch()
+	}
+
+	last := &w.history[len(w.history)-1]
+	last.est = w.lastEstimate
+	last.cov = w.kf.Cov()
+	if w.adapter != nil {
+		last.adaptive = w.adapter.state()
+	}
+	w.retrack()
+	w.smoothLag()
+
+	return nil
+}
+
+// record добавляет текущее состояние в историю и удаляет состояния старше глубины истории
+func (w *EKFWrapper) record(u mat.Vector, dt float64) {
+	var uCopy mat.Vector
+	if u != nil {
+		uCopy = mat.VecDenseCopyOf(u)
+	}
+
+	e := historyEntry{t: w.lastTime, u: uCopy, dt: dt, est: w.lastEstimate, cov: w.kf.Cov()}
+	if w.adapter != nil {
+		e.adaptive = w.adapter.state()
+	}
+	w.history = append(w.history, e)
+
+	// Сохраняем одно состояние не позже начала окна истории
+	start := w.lastTime.Add(-w.config.History)
+	n := 0
+	for n < len(w.history)-1 && !w.history[n+1].t.After(start) {
+		n++
+	}
+	if n > 0 {
+		w.history = append(w.history[:0], w.history[n:]...)
+	}
+}
+
+// restore возвращает фильтр к k-му состоянию истории и отбрасывает более поздние.
+// Адаптация шумов возвращается к оценкам Q̂, R̂ и счетчику предсказаний на тот же момент.
+func (w *EKFWrapper) restore(k int) error {
+	e := w.history[k]
+	if err := w.kf.SetCov(e.cov); err != nil {
+		return err
+	}
+	if w.adapter != nil && e.adaptive != nil {
+		if err := w.adapter.restore(e.adaptive); err != nil {
+			return err
+		}
+		if w.adapter.cfg.Q {
+			if err := w.setProcessNoise(w.adapter.ProcessNoise()); err != nil {
+				return err
+			}
+		}
+	}
+
+	w.lastEstimate = e.est
+	w.lastTime = e.t
+	w.untrack(len(w.history) - 1 - k)
+	w.history = w.history[:k+1]
+
+	return nil
+}
+
+// wrapperSnapshot состояние обертки до коррекции: по нему коррекция откатывается,
+// в том числе коррекция с повторным прогоном истории (прямой проход сглаживания не сохраняется - IMM его не использует)
+type wrapperSnapshot struct {
+	t           time.Time
+	est         filter.Estimate
+	cov         mat.Symmetric
+	dt          float64
+	history     []historyEntry
+	rejected    map[string]int
+	gating      []models.GateDecision
+	innovations []innovation
+}
+
+// snapshot сохраняет состояние обертки
+func (w *EKFWrapper) snapshot() wrapperSnapshot {
+	s := wrapperSnapshot{
+		t:           w.lastTime,
+		est:         w.lastEstimate,
+		cov:         w.kf.Cov(),
+		history:     slices.Clone(w.history),
+		rejected:    maps.Clone(w.rejected),
+		gating:      w.gating,
+		innovations: w.innovations,
+	}
+	if model, ok := w.kf.Model().(StepModel); ok {
+		s.dt = model.DT()
+	}
+	return s
+}
+
+// rollback возвращает обертку к сохраненному состоянию
+func (w *EKFWrapper) rollback(s wrapperSnapshot) error {
+	if err := w.kf.SetCov(s.cov); err != nil {
+		return err
+	}
+	if model, ok := w.kf.Model().(StepModel); ok {
+		model.SetDT(s.dt)
+	}
+
+	w.lastTime = s.t
+	w.lastEstimate = s.est
+	w.history = s.history
+	w.rejected = s.rejected
+	w.gating = s.gating
+	w.innovations = s.innovations
+
+	return nil
+}
@@ -0,0 +1,641 @@
+package ekf
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// IMMMode режим движения IMM
+type IMMMode struct {
+	Name              string
+	ProcessNoiseScale float64 // Множитель шума процесса режима относительно EKFConfig.ProcessNoise
+}
+
+// IMMConfig параметры IMM
+type IMMConfig struct {
+	Modes      []IMMMode
+	Transition [][]float64 // Матрица переходов Маркова: p_ij - вероятность перехода из режима i в режим j за цикл
+	Initial    []float64   // Начальные вероятности режимов (nil - равные)
+	Output     io.Writer   // Таблица CSV вероятностей режимов по коррекциям (nil - не выводится)
+}
+
+// IMM фильтр с взаимодействующими моделями (Interacting Multiple Model): фильтры режимов
+// с разными шумами процесса работают параллельно, вероятности режимов обновляются по цепи Маркова
+// и правдоподобию невязок. Цикл IMM - интервал между коррекциями:
+//
+//	смешивание перед первым предсказанием после коррекции:
+//	  cⱼ = Σᵢ p_ij·μᵢ,  μ_i|j = p_ij·μᵢ/cⱼ
+//	  x0ⱼ = Σᵢ μ_i|j·xᵢ,  P0ⱼ = Σᵢ μ_i|j·(Pᵢ + (xᵢ-x0ⱼ)(xᵢ-x0ⱼ)ᵀ)
+//	коррекция:  μⱼ ∝ Λⱼ·cⱼ,  Λⱼ = Πₖ N(νₖ; 0, Sₖ) по измерениям эпохи, в том числе отброшенным
+//	выход:  x = Σⱼ μⱼ·xⱼ,  P = Σⱼ μⱼ·(Pⱼ + (xⱼ-x)(xⱼ-x)ᵀ)
+//
+// Разности состояний берутся в пространстве ковариации фильтра относительно наиболее вероятного
+// режима (для eskf - в пространстве ошибки). Запаздывающие измерения применяются повторным прогоном
+// истории каждого режима; смешивание внутри прогоняемого интервала не повторяется.
+type IMM struct {
+	modes []*EKFWrapper
+	names []string
+	trans *mat.Dense
+	mu    []float64 // Вероятности режимов
+	mixed bool      // Режимы смешаны после последней коррекции
+
+	est filter.Estimate // Объединенная оценка
+	p   *mat.SymDense   // Объединенная ковариация в пространстве ковариации фильтра
+
+	gating      []models.GateDecision // Решения проверки невязок наиболее вероятного режима
+	rejected    map[string]int        // Число измерений, отброшенных всеми режимами
+	diagnostics *Diagnostics          // Диагностика объединенной оценки (nil - выключена)
+
+	// Итоги по коррекциям: сумма вероятностей и число коррекций, после которых режим наиболее вероятен
+	corrections int
+	sum         []float64
+	dominant    []int
+
+	out *models.CSVTable // Таблица вероятностей режимов (nil - не выводится)
+}
+
+// NewIMM создает IMM с режимами imm над конфигурацией фильтра cfg. Модель каждого режима создается
+// newModel: модели хранят шаг интегрирования и не разделяются между режимами.
+func NewIMM(newModel func() filter.Model, cfg *EKFConfig, imm *IMMConfig) (*IMM, error) {
+	n := len(imm.Modes)
+	if n < 2 {
+		return nil, fmt.Errorf("IMM требует не менее двух режимов, задано %d", n)
+	}
+	if cfg.Smoother || cfg.SmootherLag > 0 {
+		return nil, fmt.Errorf("сглаживание не поддерживается IMM")
+	}
+	if cfg.AdaptiveNoise != nil {
+		return nil, fmt.Errorf("адаптация шумов не поддерживается IMM: шум процесса задается режимами")
+	}
+
+	trans, err := transitionMatrix(imm.Transition, n)
+	if err != nil {
+		return nil, err
+	}
+	mu, err := initialProbabilities(imm.Initial, n)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &IMM{trans: trans, mu: mu, rejected: make(map[string]int), sum: make([]float64, n), dominant: make([]int, n)}
+	for _, mode := range imm.Modes {
+		if mode.ProcessNoiseScale <= 0 {
+			return nil, fmt.Errorf("режим %s: неверный множитель шума процесса %v", mode.Name, mode.ProcessNoiseScale)
+		}
+
+		c := *cfg
+		c.ProcessNoise = make([]float64, len(cfg.ProcessNoise))
+		for i, q := range cfg.ProcessNoise {
+			c.ProcessNoise[i] = mode.ProcessNoiseScale * q
+		}
+		c.DiagnosticsWindow, c.DiagnosticsOutput = 0, nil
+
+		w, err := NewEKFWrapper(newModel(), &c)
+		if err != nil {
+			return nil, fmt.Errorf("режим %s: %w", mode.Name, err)
+		}
+		m.modes = append(m.modes, w)
+		m.names = append(m.names, mode.Name)
+	}
+
+	if imm.Output != nil {
+		m.out, err = models.NewCSVTable(imm.Output, "вероятностей режимов", append([]string{"time", "mode"}, m.names...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DiagnosticsWindow > 0 {
+		m.diagnostics, err = newDiagnostics(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := m.combine(); err != nil {
+		return nil, fmt.Errorf("ошибка создания начального условия: %v", err)
+	}
+
+	return m, nil
+}
+
+// Predict выполняет предсказание всех режимов на момент t; после коррекции режимы предварительно смешиваются
+func (m *IMM) Predict(t time.Time, u mat.Vector) (*models.EstimatedState, error) {
+	if !t.After(m.Time()) {
+		if t.Before(m.Time()) {
+			return nil, fmt.Errorf("%w: %v раньше %v", ErrOutOfOrder, t, m.Time())
+		}
+		return m.state(), nil
+	}
+
+	if !m.mixed {
+		if err := m.mix(); err != nil {
+			return nil, fmt.Errorf("ошибка смешивания режимов: %v", err)
+		}
+	}
+
+	for i, w := range m.modes {
+		if _, err := w.Predict(t, u); err != nil {
+			return nil, fmt.Errorf("режим %s: %v", m.names[i], err)
+		}
+	}
+	if err := m.combine(); err != nil {
+		return nil, fmt.Errorf("ошибка объединения режимов: %v", err)
+	}
+
+	return m.state(), nil
+}
+
+// Update корректирует все режимы пришедшими измерениями и обновляет вероятности режимов
+func (m *IMM) Update(z ...Measurement) (*models.EstimatedState, error) {
+	return m.correct(func(w *EKFWrapper) error {
+		_, err := w.Update(z...)
+		return err
+	}, z)
+}
+
+// Run выполняет предсказание на момент t и коррекцию
+func (m *IMM) Run(t time.Time, u mat.Vector, z ...Measurement) (*models.EstimatedState, error) {
+	if _, err := m.Predict(t, u); err != nil {
+		return nil, fmt.Errorf("ошибка выполнения шага IMM: %v", err)
+	}
+
+	return m.Update(z...)
+}
+
+// UpdateAt корректирует режимы измерениями, полученными в момент t, с повторным прогоном истории каждого режима
+func (m *IMM) UpdateAt(t time.Time, z ...Measurement) (*models.EstimatedState, error) {
+	return m.correct(func(w *EKFWrapper) error {
+		_, err := w.UpdateAt(t, z...)
+		return err
+	}, z)
+}
+
+// RegisterMeasurement регистрирует модель измерения во всех режимах
+func (m *IMM) RegisterMeasurement(typ string, mm MeasurementModel, r []float64) error {
+	for _, w := range m.modes {
+		if err := w.RegisterMeasurement(typ, mm, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetGate задает проверку невязки во всех режимах
+func (m *IMM) SetGate(typ string, gate Gate) error {
+	for _, w := range m.modes {
+		if err := w.SetGate(typ, gate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rejected возвращает число измерений, отброшенных всеми режимами, по типам
+func (m *IMM) Rejected() map[string]int {
+	return maps.Clone(m.rejected)
+}
+
+// Time возвращает время текущего состояния
+func (m *IMM) Time() time.Time {
+	return m.modes[0].Time()
+}
+
+// GetState возвращает объединенное состояние
+func (m *IMM) GetState() *models.EstimatedState {
+	return m.state()
+}
+
+// Cov возвращает объединенную ковариацию в пространстве состояния
+func (m *IMM) Cov() mat.Symmetric {
+	return m.est.Cov()
+}
+
+// RecordTruth добавляет в диагностику NEES объединенной оценки
+func (m *IMM) RecordTruth(truth mat.Vector) (float64, error) {
+	if m.diagnostics == nil {
+		return 0, fmt.Errorf("диагностика выключена")
+	}
+
+	est := m.est.Val()
+	if truth.Len() != est.Len() {
+		return 0, fmt.Errorf("неверная размерность эталонного состояния: %d, ожидается %d", truth.Len(), est.Len())
+	}
+
+	e := m.modes[0].difference(truth, est)
+	nees, err := mahalanobis(e, m.p)
+	if err != nil {
+		m.diagnostics.skipNEES()
+		return 0, fmt.Errorf("%w: %v", ErrNEESSkipped, err)
+	}
+	m.diagnostics.addNEES(m.Time(), nees, e.Len())
+
+	return nees, nil
+}
+
+// Diagnostics возвращает диагностику объединенной оценки (nil - выключена)
+func (m *IMM) Diagnostics() *Diagnostics {
+	return m.diagnostics
+}
+
+// Smooth не поддерживается: прямой проход режимов не сохраняется
+func (m *IMM) Smooth() ([]models.EstimatedState, error) {
+	return nil, fmt.Errorf("сглаживание не поддерживается IMM")
+}
+
+// CovarianceHealth возвращает диагностику ковариации, накопленную по всем режимам
+func (m *IMM) CovarianceHealth() CovarianceHealth {
+	h := CovarianceHealth{MinEigenvalue: math.Inf(1)}
+	for _, w := range m.modes {
+		mh := w.CovarianceHealth()
+		h.Checks += mh.Checks
+		h.Repairs += mh.Repairs
+		h.MaxAsymmetry = math.Max(h.MaxAsymmetry, mh.MaxAsymmetry)
+		h.MinEigenvalue = math.Min(h.MinEigenvalue, mh.MinEigenvalue)
+	}
+	return h
+}
+
+// AdaptiveNoise возвращает nil: шум процесса задается режимами
+func (m *IMM) AdaptiveNoise() *NoiseAdapter {
+	return nil
+}
+
+// Names возвращает имена режимов
+func (m *IMM) Names() []string {
+	return slices.Clone(m.names)
+}
+
+// Probabilities возвращает текущие вероятности режимов
+func (m *IMM) Probabilities() []float64 {
+	return slices.Clone(m.mu)
+}
+
+// Mode возвращает наиболее вероятный режим
+func (m *IMM) Mode() string {
+	return m.names[argmax(m.mu)]
+}
+
+// String возвращает по режимам текущую и среднюю вероятность и долю коррекций, после которых режим наиболее вероятен
+func (m *IMM) String() string {
+	var b strings.Builder
+	for j, name := range m.names {
+		var mean, share float64
+		if n := m.corrections; n > 0 {
+			mean = m.sum[j] / float64(n)
+			share = 100 * float64(m.dominant[j]) / float64(n)
+		}
+		fmt.Fprintf(&b, "%s: вероятность %.3f, средняя %.3f, наиболее вероятен в %.1f%% коррекций\n", name, m.mu[j], mean, share)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// Flush дописывает буферизованные строки в таблицу вероятностей режимов и возвращает первую ошибку вывода
+func (m *IMM) Flush() error {
+	if m.out == nil {
+		return nil
+	}
+	return m.out.Flush()
+}
+
+// record учитывает вероятности режимов после коррекции в итогах и выводит их в таблицу:
+// наиболее вероятный режим и вероятности по режимам
+func (m *IMM) record() {
+	best := argmax(m.mu)
+	m.corrections++
+	m.dominant[best]++
+	for j, p := range m.mu {
+		m.sum[j] += p
+	}
+
+	if m.out == nil {
+		return
+	}
+	row := []string{m.Time().Format(time.RFC3339Nano), m.names[best]}
+	for _, p := range m.mu {
+		row = append(row, formatFloat(p))
+	}
+	m.out.Write(row)
+}
+
+// correct выполняет коррекцию apply во всех режимах и обновляет вероятности режимов по правдоподобию невязок.
+// Если коррекция не удалась в одном из режимов, все режимы возвращаются к состоянию до коррекции.
+func (m *IMM) correct(apply func(w *EKFWrapper) error, z []Measurement) (*models.EstimatedState, error) {
+	if len(z) == 0 {
+		return m.state(), nil
+	}
+
+	snapshots := make([]wrapperSnapshot, len(m.modes))
+	for i, w := range m.modes {
+		snapshots[i] = w.snapshot()
+	}
+	rollback := func(err error) error {
+		for i, w := range m.modes {
+			if rerr := w.rollback(snapshots[i]); rerr != nil {
+				return fmt.Errorf("%v; ошибка отката режима %s: %v", err, m.names[i], rerr)
+			}
+		}
+		return err
+	}
+
+	// Правдоподобие режима учитывает и невязки отброшенных измерений: фильтр режима сохраняет
+	// невязку отброшенного измерения, и большая невязка снижает вероятность режима
+	prior := slices.Clone(m.mu)
+	logL := make([]float64, len(m.modes))
+	for i, w := range m.modes {
+		if err := apply(w); err != nil {
+			return nil, rollback(fmt.Errorf("режим %s: %w", m.names[i], err))
+		}
+		for _, e := range w.innovations {
+			l, err := logLikelihood(e.inn, e.s)
+			if err != nil {
+				return nil, rollback(fmt.Errorf("режим %s: %v", m.names[i], err))
+			}
+			logL[i] += l
+		}
+	}
+
+	// μⱼ ∝ Λⱼ·cⱼ; логарифмы правдоподобия сдвигаются на наибольший, чтобы экспонента не обнулилась
+	best := slices.Max(logL)
+	var sum float64
+	for j := range m.mu {
+		m.mu[j] = prior[j] * math.Exp(logL[j]-best)
+		sum += m.mu[j]
+	}
+	if sum > 0 && !math.IsNaN(sum) {
+		for j := range m.mu {
+			m.mu[j] /= sum
+		}
+	} else {
+		copy(m.mu, prior)
+	}
+	m.mixed = false
+
+	if err := m.combine(); err != nil {
+		copy(m.mu, prior)
+		return nil, rollback(fmt.Errorf("ошибка объединения режимов: %v", err))
+	}
+	m.epoch(prior)
+	m.record()
+
+	state := m.state()
+	state.Gating = m.gating
+
+	return state, nil
+}
+
+// epoch обновляет решения проверки невязок, число отброшенных измерений и диагностику по невязкам режимов
+// с вероятностями режимов prior до коррекции. Измерение отброшено, если его отбросили все режимы;
+// решение берется у наиболее вероятного из режимов, применивших измерение.
+func (m *IMM) epoch(prior []float64) {
+	m.gating = slices.Clone(m.modes[argmax(m.mu)].gating)
+
+	for k, d := range m.gating {
+		action, best := models.GateRejected, -1.0
+		for j, w := range m.modes {
+			if a := w.gating[k].Action; a != models.GateRejected && m.mu[j] > best {
+				action, best = a, m.mu[j]
+			}
+		}
+		m.gating[k].Action = action
+		if action == models.GateRejected {
+			m.rejected[d.Type]++
+		}
+
+		if m.diagnostics == nil {
+			continue
+		}
+		inn, s := m.innovation(k, prior)
+		nis, err := mahalanobis(inn, s)
+		if err != nil {
+			continue
+		}
+		if action == models.GateRejected {
+			m.diagnostics.addNIS(m.Time(), d.Type, action, nis, inn.Len(), nil, nil)
+			continue
+		}
+		m.diagnostics.addNIS(m.Time(), d.Type, action, nis, inn.Len(), inn, s)
+	}
+}
+
+// innovation возвращает невязку k-го измерения эпохи, объединенную по режимам с вероятностями mu
+func (m *IMM) innovation(k int, mu []float64) (*mat.VecDense, *mat.SymDense) {
+	inn := make([]mat.Vector, len(m.modes))
+	s := make([]mat.Symmetric, len(m.modes))
+	for j, w := range m.modes {
+		inn[j], s[j] = w.innovations[k].inn, w.innovations[k].s
+	}
+	return moments(mu, inn, s)
+}
+
+// mix смешивает оценки режимов перед циклом и заменяет вероятности режимов прогнозом cⱼ
+func (m *IMM) mix() error {
+	ref := m.modes[argmax(m.mu)]
+	xRef := ref.lastEstimate.Val()
+	d, p := m.deviations(ref)
+
+	c := make([]float64, len(m.modes))
+	for j := range c {
+		for i := range m.mu {
+			c[j] += m.trans.At(i, j) * m.mu[i]
+		}
+	}
+
+	weights := make([]float64, len(m.modes))
+	for j, w := range m.modes {
+		if c[j] == 0 {
+			// Режим недостижим - оценка не меняется
+			continue
+		}
+		for i := range weights {
+			weights[i] = m.trans.At(i, j) * m.mu[i] / c[j]
+		}
+		dx, cov := moments(weights, d, p)
+		if err := w.setEstimate(ref.inject(xRef, dx), cov); err != nil {
+			return fmt.Errorf("режим %s: %v", m.names[j], err)
+		}
+	}
+
+	m.mu = c
+	m.mixed = true
+
+	return nil
+}
+
+// combine объединяет оценки режимов с текущими вероятностями
+func (m *IMM) combine() error {
+	ref := m.modes[argmax(m.mu)]
+	xRef := ref.lastEstimate.Val()
+	d, p := m.deviations(ref)
+
+	dx, cov := moments(m.mu, d, p)
+	est, err := ref.newEstimate(ref.inject(xRef, dx), cov)
+	if err != nil {
+		return err
+	}
+	m.est, m.p = est, cov
+
+	return nil
+}
+
+// deviations возвращает отклонения оценок режимов от оценки режима ref и их ковариации
+// в пространстве ковариации фильтра
+func (m *IMM) deviations(ref *EKFWrapper) ([]mat.Vector, []mat.Symmetric) {
+	xRef := ref.lastEstimate.Val()
+	d := make([]mat.Vector, len(m.modes))
+	p := make([]mat.Symmetric, len(m.modes))
+	for i, w := range m.modes {
+		d[i] = ref.difference(w.lastEstimate.Val(), xRef)
+		p[i] = w.kf.Cov()
+	}
+	return d, p
+}
+
+// state возвращает объединенное состояние с вероятностями режимов
+func (m *IMM) state() *models.EstimatedState {
+	state := m.modes[0].estimateToState(m.est)
+	state.Rejected = 0
+	for _, n := range m.rejected {
+		state.Rejected += n
+	}
+	state.Modes = slices.Clone(m.mu)
+
+	return state
+}
+
+// setEstimate заменяет текущую оценку состоянием x с ковариацией фильтра p, в том числе в истории
+func (w *EKFWrapper) setEstimate(x mat.Vector, p mat.Symmetric) error {
+	if err := w.kf.SetCov(p); err != nil {
+		return err
+	}
+	est, err := w.newEstimate(x, p)
+	if err != nil {
+		return err
+	}
+
+	w.lastEstimate = est
+	w.history[len(w.history)-1].est = est
+	w.history[len(w.history)-1].cov = w.kf.Cov()
+	w.retrack()
+
+	return nil
+}
+
+// moments возвращает среднее и ковариацию смеси гауссовых компонент (dᵢ, Pᵢ) с весами mu:
+// d = Σ μᵢ·dᵢ, P = Σ μᵢ·(Pᵢ + (dᵢ-d)(dᵢ-d)ᵀ)
+func moments(mu []float64, d []mat.Vector, p []mat.Symmetric) (*mat.VecDense, *mat.SymDense) {
+	n := d[0].Len()
+	mean := mat.NewVecDense(n, nil)
+	for i := range d {
+		mean.AddScaledVec(mean, mu[i], d[i])
+	}
+
+	cov := mat.NewSymDense(n, nil)
+	dev := mat.NewVecDense(n, nil)
+	for i := range d {
+		if mu[i] == 0 {
+			continue
+		}
+		for r := 0; r < n; r++ {
+			for c := r; c < n; c++ {
+				cov.SetSym(r, c, cov.At(r, c)+mu[i]*p[i].At(r, c))
+			}
+		}
+		dev.SubVec(d[i], mean)
+		cov.SymRankOne(cov, mu[i], dev)
+	}
+
+	return mean, cov
+}
+
+// logLikelihood возвращает логарифм плотности N(inn; 0, s)
+func logLikelihood(inn mat.Vector, s mat.Symmetric) (float64, error) {
+	var chol mat.Cholesky
+	if ok := chol.Factorize(s); !ok {
+		return 0, fmt.Errorf("ковариация невязки не положительно определена")
+	}
+
+	x := mat.NewVecDense(inn.Len(), nil)
+	if err := chol.SolveVecTo(x, inn); err != nil {
+		return 0, err
+	}
+
+	return -0.5 * (mat.Dot(inn, x) + chol.LogDet() + float64(inn.Len())*math.Log(2*math.Pi)), nil
+}
+
+// transitionMatrix проверяет матрицу переходов n режимов: строки - распределения вероятностей
+func transitionMatrix(rows [][]float64, n int) (*mat.Dense, error) {
+	if len(rows) != n {
+		return nil, fmt.Errorf("матрица переходов IMM: %d строк, ожидается %d", len(rows), n)
+	}
+
+	trans := mat.NewDense(n, n, nil)
+	for i, row := range rows {
+		if len(row) != n {
+			return nil, fmt.Errorf("строка %d матрицы переходов IMM: %d значений, ожидается %d", i, len(row), n)
+		}
+		var sum float64
+		for j, p := range row {
+			if p < 0 {
+				return nil, fmt.Errorf("отрицательная вероятность перехода %d -> %d: %v", i, j, p)
+			}
+			sum += p
+			trans.Set(i, j, p)
+		}
+		if math.Abs(sum-1) > 1e-6 {
+			return nil, fmt.Errorf("строка %d матрицы переходов IMM: сумма %v, ожидается 1", i, sum)
+		}
+	}
+
+	return trans, nil
+}
+
+// initialProbabilities возвращает нормированные начальные вероятности n режимов (nil - равные)
+func initialProbabilities(initial []float64, n int) ([]float64, error) {
+	if initial == nil {
+		mu := make([]float64, n)
+		for i := range mu {
+			mu[i] = 1 / float64(n)
+		}
+		return mu, nil
+	}
+	if len(initial) != n {
+		return nil, fmt.Errorf("начальные вероятности IMM: %d значений, ожидается %d", len(initial), n)
+	}
+
+	var sum float64
+	for _, p := range initial {
+		if p < 0 {
+			return nil, fmt.Errorf("отрицательная начальная вероятность режима: %v", p)
+		}
+		sum += p
+	}
+	if sum <= 0 {
+		return nil, fmt.Errorf("нулевые начальные вероятности IMM")
+	}
+
+	mu := make([]float64, n)
+	for i, p := range initial {
+		mu[i] = p / sum
+	}
+	return mu, nil
+}
+
+// argmax возвращает индекс наибольшего значения
+func argmax(v []float64) int {
+	k := 0
+	for i := range v {
+		if v[i] > v[k] {
+			k = i
+		}
+	}
+	return k
+}
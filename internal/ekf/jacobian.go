@@ -0,0 +1,214 @@
+package ekf
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"gonum.org/v1/gonum/diff/fd"
+	"gonum.org/v1/gonum/mat"
+)
+
+// SetNumericJacobian включает вычисление якобианов конечными разностями даже для моделей с аналитическими якобианами
+func (k *EKF) SetNumericJacobian(on bool) {
+	k.numeric = on
+}
+
+// stateJacobian вычисляет матрицу F в точке x
+func (k *EKF) stateJacobian(x, u mat.Vector) error {
+	if jm, ok := k.m.(JacobianModel); ok && !k.numeric {
+		f, err := jm.StateJacobian(x, u)
+		if err != nil {
+			return err
+		}
+		return copyJacobian(k.f, f)
+	}
+
+	fd.Jacobian(k.f, k.FJacFn(u), mat.Col(nil, 0, x), &fd.JacobianSettings{
+		Formula:    fd.Central,
+		Concurrent: true,
+	})
+	return k.jerr.take()
+}
+
+// observationJacobian вычисляет матрицу H в точке x
+func (k *EKF) observationJacobian(x, u mat.Vector) error {
+	if jm, ok := k.m.(JacobianModel); ok && !k.numeric {
+		h, err := jm.ObservationJacobian(x, u)
+		if err != nil {
+			return err
+		}
+		return copyJacobian(k.h, h)
+	}
+
+	fd.Jacobian(k.h, k.HJacFn(u), mat.Col(nil, 0, x), &fd.JacobianSettings{
+		Formula:    fd.Central,
+		Concurrent: true,
+	})
+	return k.jerr.take()
+}
+
+// measurementJacobian вычисляет якобиан модели измерения m в точке x
+func (k *EKF) measurementJacobian(x mat.Vector, m MeasurementModel) (*mat.Dense, error) {
+	if !k.numeric {
+		return m.Jacobian(x)
+	}
+
+	h := mat.NewDense(m.Dim(), x.Len(), nil)
+	fd.Jacobian(h, func(y, xs []float64) {
+		yNext, err := m.Observe(mat.NewVecDense(len(xs), xs))
+		if err != nil {
+			k.jerr.set(err)
+			fillNaN(y)
+			return
+		}
+		copy(y, mat.Col(nil, 0, yNext))
+	}, mat.Col(nil, 0, x), &fd.JacobianSettings{
+		Formula:    fd.Central,
+		Concurrent: true,
+	})
+	return h, k.jerr.take()
+}
+
+// copyJacobian копирует якобиан модели с проверкой размерности
+func copyJacobian(dst, src *mat.Dense) error {
+	dr, dc := dst.Dims()
+	sr, sc := src.Dims()
+	if dr != sr || dc != sc {
+		return fmt.Errorf("invalid Jacobian dims: [%d x %d], expected [%d x %d]", sr, sc, dr, dc)
+	}
+	dst.Copy(src)
+	return nil
+}
+
+// jacErr первая ошибка модели, возникшая при вычислении якобиана конечными разностями
+// (замыкания выполняются параллельно и не могут вернуть ошибку)
+type jacErr struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *jacErr) set(err error) {
+	e.mu.Lock()
+	if e.err == nil {
+		e.err = err
+	}
+	e.mu.Unlock()
+}
+
+func (e *jacErr) take() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	err := e.err
+	e.err = nil
+	return err
+}
+
+func fillNaN(v []float64) {
+	for i := range v {
+		v[i] = math.NaN()
+	}
+}
+
+// JacobianCheck результат сравнения аналитических и численных якобианов
+type JacobianCheck struct {
+	States int     // Число проверенных состояний
+	MaxF   float64 // Наибольшее относительное расхождение F
+	MaxH   float64 // Наибольшее относительное расхождение H
+	RowF   int     // Элемент F с наибольшим расхождением
+	ColF   int
+	RowH   int // Элемент H с наибольшим расхождением
+	ColH   int
+}
+
+func (c JacobianCheck) String() string {
+	return fmt.Sprintf("якобианы: %d состояний, расхождение F %.2e (%d,%d), H %.2e (%d,%d)",
+		c.States, c.MaxF, c.RowF, c.ColF, c.MaxH, c.RowH, c.ColH)
+}
+
+// ValidateJacobians сравнивает аналитические якобианы модели с центральными разностями
+// в states случайных точках (компоненты состояния и входа ~ N(0, 1), зерно seed).
+// Расхождение считается как |a - n| / max(1, |n|).
+func ValidateJacobians(m filter.Model, states int, seed uint64) (JacobianCheck, error) {
+	jm, ok := m.(JacobianModel)
+	if !ok {
+		return JacobianCheck{}, fmt.Errorf("модель не предоставляет аналитические якобианы")
+	}
+
+	nx, nu, ny, _ := m.SystemDims()
+	rng := rand.New(NewRandSource(seed))
+	check := JacobianCheck{States: states}
+
+	random := func(n int) *mat.VecDense {
+		v := mat.NewVecDense(n, nil)
+		for i := 0; i < n; i++ {
+			v.SetVec(i, rng.NormFloat64())
+		}
+		return v
+	}
+
+	for s := 0; s < states; s++ {
+		x, u := random(nx), random(nu)
+
+		f, err := jm.StateJacobian(x, u)
+		if err != nil {
+			return check, err
+		}
+		h, err := jm.ObservationJacobian(x, u)
+		if err != nil {
+			return check, err
+		}
+
+		fNum := mat.NewDense(nx, nx, nil)
+		var ferr error
+		fd.Jacobian(fNum, func(y, xs []float64) {
+			xNext, err := m.Propagate(mat.NewVecDense(nx, xs), u, nil)
+			if err != nil {
+				ferr = err
+				fillNaN(y)
+				return
+			}
+			copy(y, mat.Col(nil, 0, xNext))
+		}, x.RawVector().Data, &fd.JacobianSettings{Formula: fd.Central})
+
+		hNum := mat.NewDense(ny, nx, nil)
+		fd.Jacobian(hNum, func(y, xs []float64) {
+			yNext, err := m.Observe(mat.NewVecDense(nx, xs), u, nil)
+			if err != nil {
+				ferr = err
+				fillNaN(y)
+				return
+			}
+			copy(y, mat.Col(nil, 0, yNext))
+		}, x.RawVector().Data, &fd.JacobianSettings{Formula: fd.Central})
+		if ferr != nil {
+			return check, ferr
+		}
+
+		if d, i, j := maxRelDiff(f, fNum); d > check.MaxF {
+			check.MaxF, check.RowF, check.ColF = d, i, j
+		}
+		if d, i, j := maxRelDiff(h, hNum); d > check.MaxH {
+			check.MaxH, check.RowH, check.ColH = d, i, j
+		}
+	}
+
+	return check, nil
+}
+
+// maxRelDiff наибольшее относительное расхождение матриц и его положение
+func maxRelDiff(a, n mat.Matrix) (float64, int, int) {
+	r, c := n.Dims()
+	maxD, mi, mj := 0.0, 0, 0
+	for i := 0; i < r; i++ {
+		for j := 0; j < c; j++ {
+			d := math.Abs(a.At(i, j)-n.At(i, j)) / math.Max(1, math.Abs(n.At(i, j)))
+			if d > maxD || math.IsNaN(d) {
+				maxD, mi, mj = d, i, j
+			}
+		}
+	}
+	return maxD, mi, mj
+}
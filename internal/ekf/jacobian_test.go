@@ -0,0 +1,45 @@
+package ekf
+
+import (
+	"testing"
+
+	"main.go/config"
+	"main.go/internal/models"
+)
+
+func TestValidateJacobiansPositionModel(t *testing.T) {
+	const tolerance = 1e-6
+
+	cfg := &config.Config{}
+	cfg.EKF.MeasurementSize = 4
+
+	layouts := []struct {
+		name   string
+		blocks []string
+	}{
+		{"все блоки", nil},
+		{"без смещений акселерометров", []string{models.BlockPosition, models.BlockVelocity, models.BlockQuaternion, models.BlockBiasGyro}},
+		{"без смещений гироскопов", []string{models.BlockPosition, models.BlockVelocity, models.BlockQuaternion, models.BlockBiasAcc}},
+		{"без смещений", []string{models.BlockPosition, models.BlockVelocity, models.BlockQuaternion}},
+	}
+
+	for _, l := range layouts {
+		layout, err := models.NewPositionLayout(l.blocks)
+		if err != nil {
+			t.Fatalf("%s: %v", l.name, err)
+		}
+
+		for _, dt := range []float64{0.001, 0.01, 0.1, 0.5} {
+			model := models.NewPositionModel(cfg, layout)
+			model.SetDT(dt)
+
+			check, err := ValidateJacobians(model, 50, 7)
+			if err != nil {
+				t.Fatalf("%s, dt %v: %v", l.name, dt, err)
+			}
+			if check.MaxF > tolerance || check.MaxH > tolerance {
+				t.Errorf("%s, dt %v: %v, допуск %.0e", l.name, dt, check, tolerance)
+			}
+		}
+	}
+}
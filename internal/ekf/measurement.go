@@ -0,0 +1,126 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// MeasurementModel модель измерения одного типа датчика со своей размерностью.
+// Фильтр применяет такие измерения по отдельности, поэтому в эпоху можно использовать
+// любое подмножество пришедших измерений.
+type MeasurementModel interface {
+	// Dim возвращает размерность измерения
+	Dim() int
+	// Observe возвращает ожидаемое измерение в состоянии x
+	Observe(x mat.Vector) (mat.Vector, error)
+	// Jacobian возвращает якобиан [Dim x nx] функции Observe в состоянии x
+	Jacobian(x mat.Vector) (*mat.Dense, error)
+	// Residual возвращает невязку z - y (для углов - приведенную к (-π, π])
+	Residual(z, y mat.Vector) *mat.VecDense
+}
+
+// Measurement измерение датчика, поступившее в эпоху
+type Measurement struct {
+	Type string     // Тип измерения, зарегистрированный в RegisterMeasurement
+	Z    mat.Vector // Значение измерения
+	R    []float64  // Диагональ ковариации шума; nil - шум, заданный при регистрации
+}
+
+// innovation невязка измерения и ее ковариация
+type innovation struct {
+	inn mat.Vector
+	s   mat.Symmetric
+}
+
+// measurementType модель измерения, зарегистрированная в обертке
+type measurementType struct {
+	model MeasurementModel
+	noise []float64 // Диагональ ковариации шума по умолчанию
+	gate  Gate      // Проверка невязки
+}
+
+// RegisterMeasurement регистрирует модель измерения типа typ с диагональю ковариации шума r по умолчанию
+func (w *EKFWrapper) RegisterMeasurement(typ string, m MeasurementModel, r []float64) error {
+	if m == nil || m.Dim() <= 0 {
+		return fmt.Errorf("неверная модель измерения %q", typ)
+	}
+	if len(r) != m.Dim() {
+		return fmt.Errorf("размерность шума измерения %q: %d, ожидается %d", typ, len(r), m.Dim())
+	}
+
+	w.measurements[typ] = measurementType{model: m, noise: append([]float64(nil), r...), gate: w.measurements[typ].gate}
+
+	return nil
+}
+
+// applyMeasurement корректирует текущее состояние одним измерением и добавляет решение проверки невязки
+// в записи эпохи; отброшенное измерение не меняет состояние
+func (w *EKFWrapper) applyMeasurement(m Measurement) error {
+	mt, ok := w.measurements[m.Type]
+	if !ok {
+		return fmt.Errorf("тип измерения %q не зарегистрирован", m.Type)
+	}
+	if m.Z == nil || m.Z.Len() != mt.model.Dim() {
+		return fmt.Errorf("неверная размерность измерения %q", m.Type)
+	}
+
+	diag := mt.noise
+	if m.R != nil {
+		if len(m.R) != mt.model.Dim() {
+			return fmt.Errorf("размерность шума измерения %q: %d, ожидается %d", m.Type, len(m.R), mt.model.Dim())
+		}
+		diag = m.R
+	}
+	if w.adapter != nil {
+		diag = w.adapter.measurementNoise(m.Type, diag)
+	}
+
+	R := mat.NewSymDense(len(diag), nil)
+	for i := 0; i < len(diag); i++ {
+		R.SetSym(i, i, diag[i])
+	}
+	r, err := NewSeededGaussian(R, nil)
+	if err != nil {
+		return fmt.Errorf("ошибка создания шума измерения %q: %w", m.Type, err)
+	}
+
+	var decision models.GateDecision
+	est, err := w.kf.UpdateMeasurement(w.lastEstimate.Val(), m.Z, mt.model, r, mt.gate.gateFunc(m.Type, &decision))
+	w.gating = append(w.gating, decision)
+	if errors.Is(err, ErrMeasurementRejected) {
+		w.rejected[m.Type]++
+		w.innovations = append(w.innovations, innovation{inn: w.kf.Innovation(), s: w.kf.InnovationCov()})
+		if w.diagnostics != nil {
+			w.diagnostics.addNIS(w.lastTime, m.Type, decision.Action, decision.Distance2, mt.model.Dim(), nil, nil)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("измерение %q: %v", m.Type, err)
+	}
+	w.lastEstimate = est
+	w.innovations = append(w.innovations, innovation{inn: w.kf.Innovation(), s: w.kf.InnovationCov()})
+
+	if w.diagnostics != nil {
+		w.diagnostics.addNIS(w.lastTime, m.Type, decision.Action, decision.Distance2, mt.model.Dim(), w.kf.Innovation(), w.kf.InnovationCov())
+	}
+
+	if w.adapter != nil {
+		// Шум, с которым выполнена коррекция (с учетом множителя проверки невязки)
+		used := make([]float64, len(diag))
+		for i := range diag {
+			used[i] = decision.Scale * diag[i]
+		}
+		if w.adapter.observe(w.lastTime, m.Type, w.kf.Innovation(), w.kf.InnovationCov(), used, w.kf.Gain()) {
+			if err := w.setProcessNoise(w.adapter.ProcessNoise()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
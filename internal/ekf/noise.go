@@ -0,0 +1,66 @@
+package ekf
+
+import (
+	"fmt"
+	"math/rand/v2"
+
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat/distmv"
+)
+
+// SeededGaussian гауссов шум с воспроизводимым генератором случайных чисел.
+// В отличие от noise.Gaussian (зерно от текущего времени) последовательность выборок
+// определяется зерном, поэтому моделирование повторяется от запуска к запуску.
+type SeededGaussian struct {
+	mean []float64
+	cov  *mat.SymDense
+	src  rand.Source
+	dist *distmv.Normal
+}
+
+// NewSeededGaussian создает гауссов шум с нулевым средним, ковариацией cov и источником src.
+// Один источник можно разделять между несколькими шумами; src = nil - глобальный генератор
+// (для шумов фильтра, от которых нужна только ковариация).
+func NewSeededGaussian(cov mat.Symmetric, src rand.Source) (*SeededGaussian, error) {
+	mean := make([]float64, cov.SymmetricDim())
+
+	dist, ok := distmv.NewNormal(mean, cov, src)
+	if !ok {
+		return nil, fmt.Errorf("ковариация шума не является положительно определенной")
+	}
+
+	c := mat.NewSymDense(cov.SymmetricDim(), nil)
+	c.CopySym(cov)
+
+	return &SeededGaussian{mean: mean, cov: c, src: src, dist: dist}, nil
+}
+
+// NewRandSource создает источник случайных чисел с заданным зерном
+func NewRandSource(seed uint64) rand.Source {
+	return rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)
+}
+
+// Sample возвращает выборку шума
+func (g *SeededGaussian) Sample() mat.Vector {
+	return mat.NewVecDense(len(g.mean), g.dist.Rand(nil))
+}
+
+// Cov возвращает ковариацию шума
+func (g *SeededGaussian) Cov() mat.Symmetric {
+	cov := mat.NewSymDense(g.cov.SymmetricDim(), nil)
+	cov.CopySym(g.cov)
+
+	return cov
+}
+
+// Mean возвращает среднее шума
+func (g *SeededGaussian) Mean() []float64 {
+	return append([]float64(nil), g.mean...)
+}
+
+// Reset ничего не делает: состояние генератора определяется общим источником
+func (g *SeededGaussian) Reset() {}
+
+func (g *SeededGaussian) String() string {
+	return fmt.Sprintf("SeededGaussian{\nMean=%v\nCov=%v\n}", g.mean, mat.Formatted(g.cov, mat.Prefix("    "), mat.Squeeze()))
+}
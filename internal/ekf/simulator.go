@@ -0,0 +1,283 @@
+package ekf
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// Simulator фильтр комплексирования в режиме моделирования. Эталонная траектория продвигается
+// по входам IMU моделью с выборкой шума процесса Q, измерения синтезируются из эталона с выборкой
+// шума измерений R и передаются фильтру вместо пришедших. Оцениватели (EKF, ESKF, UKF) шумов
+// не добавляют: выборки и воспроизводимый генератор случайных чисел есть только здесь.
+type Simulator struct {
+	FusionFilter
+
+	model   filter.Model
+	q       *SeededGaussian                                   // Шум процесса (для eskf - в пространстве ошибки)
+	inject  func(x mat.Vector, w *mat.VecDense) *mat.VecDense // Перенос выборки шума процесса в состояние
+	rng     rand.Source
+	maxStep float64       // Наибольший шаг интегрирования (с)
+	depth   time.Duration // Глубина истории эталона для запаздывающих измерений
+
+	truth   *mat.VecDense
+	t       time.Time
+	history []truthEntry
+
+	measurements map[string]measurementType
+}
+
+// truthEntry эталонное состояние на момент t
+type truthEntry struct {
+	t time.Time
+	x *mat.VecDense
+}
+
+// NewSimulator создает моделирование для фильтра f, созданного с конфигурацией cfg.
+// Модель эталона model создается отдельно от модели фильтра: модели хранят шаг интегрирования.
+func NewSimulator(model filter.Model, f FusionFilter, cfg *EKFConfig) (*Simulator, error) {
+	layout := models.NavigationLayout()
+	if l, ok := model.(layoutModel); ok {
+		layout = l.Layout()
+	}
+	if len(cfg.InitialState) != layout.Dim() {
+		return nil, fmt.Errorf("размерность начального состояния %d не совпадает с блоками состояния (%d)", len(cfg.InitialState), layout.Dim())
+	}
+
+	Q := mat.NewSymDense(len(cfg.ProcessNoise), nil)
+	for i, q := range cfg.ProcessNoise {
+		Q.SetSym(i, i, q)
+	}
+	rng := NewRandSource(cfg.Seed)
+	q, err := NewSeededGaussian(Q, rng)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания шума процесса моделирования: %w", err)
+	}
+
+	s := &Simulator{
+		FusionFilter: f,
+		model:        model,
+		q:            q,
+		rng:          rng,
+		maxStep:      cfg.MaxTimeStep,
+		depth:        cfg.History,
+		truth:        mat.NewVecDense(len(cfg.InitialState), slices.Clone(cfg.InitialState)),
+		t:            cfg.StartTime,
+		measurements: make(map[string]measurementType),
+	}
+
+	att := layout.Offset(models.BlockQuaternion)
+	s.inject = func(x mat.Vector, w *mat.VecDense) *mat.VecDense {
+		xn := mat.VecDenseCopyOf(x)
+		xn.AddVec(xn, w)
+		q := normalize([4]float64{xn.AtVec(att), xn.AtVec(att + 1), xn.AtVec(att + 2), xn.AtVec(att + 3)})
+		for i := range q {
+			xn.SetVec(att+i, q[i])
+		}
+		return xn
+	}
+	dim := layout.Dim()
+	if cfg.Filter == FilterESKF {
+		// Шум процесса ESKF задан в пространстве ошибки: угол ориентации переносится поворотом кватерниона
+		s.inject = (&ESKF{att: att}).inject
+		dim--
+	}
+	if Q.SymmetricDim() != dim {
+		return nil, fmt.Errorf("размерность шума процесса %d, ожидается %d", Q.SymmetricDim(), dim)
+	}
+
+	s.history = []truthEntry{{t: s.t, x: s.truth}}
+
+	return s, nil
+}
+
+// Predict выполняет предсказание фильтра, продвигает эталон на момент t с выборкой шума процесса
+// и добавляет в диагностику NEES оценки относительно эталона
+func (s *Simulator) Predict(t time.Time, u mat.Vector) (*models.EstimatedState, error) {
+	state, err := s.FusionFilter.Predict(t, u)
+	if err != nil || !t.After(s.t) {
+		return state, err
+	}
+
+	dt := t.Sub(s.t).Seconds()
+	if s.maxStep > 0 && dt > s.maxStep {
+		dt = s.maxStep
+	}
+	if model, ok := s.model.(StepModel); ok {
+		model.SetDT(dt)
+	}
+
+	x, err := s.model.Propagate(s.truth, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка прогноза эталонного состояния: %v", err)
+	}
+	s.truth = s.inject(x, mat.VecDenseCopyOf(s.q.Sample()))
+	s.t = t
+	s.record()
+
+	// NEES оценки относительно эталона; случаи вырожденной ковариации учитываются диагностикой
+	if s.Diagnostics() != nil {
+		if _, err := s.RecordTruth(s.truth); err != nil && !errors.Is(err, ErrNEESSkipped) {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+// Update корректирует фильтр измерениями, синтезированными из текущего эталона
+func (s *Simulator) Update(z ...Measurement) (*models.EstimatedState, error) {
+	zs, err := s.measure(s.truth, z)
+	if err != nil {
+		return nil, err
+	}
+	return s.FusionFilter.Update(zs...)
+}
+
+// Run выполняет предсказание на момент t и коррекцию синтезированными измерениями
+func (s *Simulator) Run(t time.Time, u mat.Vector, z ...Measurement) (*models.EstimatedState, error) {
+	if _, err := s.Predict(t, u); err != nil {
+		return nil, fmt.Errorf("ошибка выполнения шага моделирования: %v", err)
+	}
+
+	return s.Update(z...)
+}
+
+// UpdateAt корректирует фильтр измерениями, синтезированными из эталона на момент t
+func (s *Simulator) UpdateAt(t time.Time, z ...Measurement) (*models.EstimatedState, error) {
+	k := len(s.history) - 1
+	for k > 0 && s.history[k].t.After(t) {
+		k--
+	}
+
+	zs, err := s.measure(s.history[k].x, z)
+	if err != nil {
+		return nil, err
+	}
+	return s.FusionFilter.UpdateAt(t, zs...)
+}
+
+// RegisterMeasurement регистрирует модель измерения в фильтре и для синтеза измерений
+func (s *Simulator) RegisterMeasurement(typ string, m MeasurementModel, r []float64) error {
+	if err := s.FusionFilter.RegisterMeasurement(typ, m, r); err != nil {
+		return err
+	}
+	s.measurements[typ] = measurementType{model: m, noise: slices.Clone(r)}
+	return nil
+}
+
+// Truth возвращает текущее эталонное состояние
+func (s *Simulator) Truth() mat.Vector {
+	return mat.VecDenseCopyOf(s.truth)
+}
+
+// Checkpoint возвращает состояние фильтра вместе с эталоном и состоянием генератора шумов
+func (s *Simulator) Checkpoint() (*FilterState, error) {
+	state, err := s.FusionFilter.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+
+	if m, ok := s.rng.(encoding.BinaryMarshaler); ok {
+		rng, err := m.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка сохранения генератора шумов: %v", err)
+		}
+		state.RNG = rng
+	}
+	state.Truth = mat.Col(nil, 0, s.truth)
+
+	return state, nil
+}
+
+// Restore восстанавливает фильтр, эталон и состояние генератора шумов
+func (s *Simulator) Restore(state *FilterState) error {
+	if err := s.FusionFilter.Restore(state); err != nil {
+		return err
+	}
+
+	if len(state.RNG) > 0 {
+		u, ok := s.rng.(encoding.BinaryUnmarshaler)
+		if !ok {
+			return fmt.Errorf("генератор шумов не поддерживает восстановление")
+		}
+		if err := u.UnmarshalBinary(state.RNG); err != nil {
+			return fmt.Errorf("ошибка восстановления генератора шумов: %v", err)
+		}
+	}
+	if len(state.Truth) > 0 {
+		if len(state.Truth) != s.truth.Len() {
+			return fmt.Errorf("неверная размерность эталонного состояния: %d, ожидается %d", len(state.Truth), s.truth.Len())
+		}
+		s.truth = mat.NewVecDense(len(state.Truth), slices.Clone(state.Truth))
+	}
+	if model, ok := s.model.(StepModel); ok && state.DT > 0 {
+		model.SetDT(state.DT)
+	}
+
+	s.t = state.Time
+	s.history = []truthEntry{{t: s.t, x: s.truth}}
+
+	return nil
+}
+
+// record добавляет текущий эталон в историю и удаляет состояния старше глубины истории
+func (s *Simulator) record() {
+	s.history = append(s.history, truthEntry{t: s.t, x: s.truth})
+
+	start := s.t.Add(-s.depth)
+	n := 0
+	for n < len(s.history)-1 && !s.history[n+1].t.After(start) {
+		n++
+	}
+	if n > 0 {
+		s.history = append(s.history[:0], s.history[n:]...)
+	}
+}
+
+// measure синтезирует измерения z в эталонном состоянии x с выборкой шума измерений.
+// Шум берется из измерения, а если он не задан - заданный при регистрации.
+func (s *Simulator) measure(x mat.Vector, z []Measurement) ([]Measurement, error) {
+	out := make([]Measurement, len(z))
+	for i, m := range z {
+		mt, ok := s.measurements[m.Type]
+		if !ok {
+			return nil, fmt.Errorf("тип измерения %q не зарегистрирован", m.Type)
+		}
+
+		diag := mt.noise
+		if m.R != nil {
+			diag = m.R
+		}
+		if len(diag) != mt.model.Dim() {
+			return nil, fmt.Errorf("размерность шума измерения %q: %d, ожидается %d", m.Type, len(diag), mt.model.Dim())
+		}
+		R := mat.NewSymDense(len(diag), nil)
+		for j, r := range diag {
+			R.SetSym(j, j, r)
+		}
+		v, err := NewSeededGaussian(R, s.rng)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания шума измерения %q: %w", m.Type, err)
+		}
+
+		y, err := mt.model.Observe(x)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка синтеза измерения %q: %v", m.Type, err)
+		}
+		zs := mat.VecDenseCopyOf(y)
+		zs.AddVec(zs, v.Sample())
+
+		out[i] = Measurement{Type: m.Type, Z: zs, R: m.R}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,214 @@
+package ekf
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gonum.org/v1/gonum/mat"
+
+	"main.go/internal/models"
+)
+
+// smoothEntry шаг прямого прохода, сохраняемый для сглаживания
+type smoothEntry struct {
+	t     time.Time
+	x     *mat.VecDense // Оценка после коррекции
+	p     mat.Symmetric // Ковариация после коррекции (для ESKF - в пространстве ошибки)
+	xPred *mat.VecDense // Прогноз на момент t (nil - начальное состояние)
+	pPred mat.Symmetric // Ковариация прогноза
+	f     mat.Matrix    // Якобиан перехода от предыдущего шага
+	gt    *mat.Dense    // Транспонированный коэффициент сглаживания Gᵀ (nil - еще не вычислен)
+
+	xs *mat.VecDense // Сглаженная оценка в окне задержки (nil - совпадает с оценкой после коррекции)
+	ps mat.Symmetric
+}
+
+// track добавляет текущее состояние в прямой проход; f - якобиан перехода предсказания (nil - начальное состояние)
+func (w *EKFWrapper) track(f mat.Matrix) {
+	if !w.config.Smoother && w.config.SmootherLag <= 0 {
+		return
+	}
+
+	x := mat.VecDenseCopyOf(w.lastEstimate.Val())
+	p := w.kf.Cov()
+	e := smoothEntry{t: w.lastTime, x: x, p: p}
+	if f != nil {
+		e.xPred, e.pPred, e.f = x, p, f
+	}
+	w.trajectory = append(w.trajectory, e)
+	w.trimLag()
+}
+
+// retrack заменяет оценку последнего шага прямого прохода скорректированной
+func (w *EKFWrapper) retrack() {
+	if len(w.trajectory) == 0 {
+		return
+	}
+
+	e := &w.trajectory[len(w.trajectory)-1]
+	e.x = mat.VecDenseCopyOf(w.lastEstimate.Val())
+	e.p = w.kf.Cov()
+}
+
+// untrack отбрасывает n последних шагов прямого прохода (при возврате к истории).
+// Сглаженные оценки оставшихся шагов могли учитывать отброшенные коррекции и сбрасываются.
+func (w *EKFWrapper) untrack(n int) {
+	if n > len(w.trajectory) {
+		n = len(w.trajectory)
+	}
+	w.trajectory = w.trajectory[:len(w.trajectory)-n]
+	w.clearLag()
+	if len(w.trajectory) > 0 {
+		// Следующий шаг будет выполнен заново
+		w.trajectory[len(w.trajectory)-1].gt = nil
+	}
+}
+
+// Smooth выполняет обратный проход Рауха-Тунга-Штрибеля по сохраненному прямому проходу
+// и возвращает сглаженные состояния на все его моменты:
+//
+//	G_k = P_k·F_{k+1}ᵀ·P⁻_{k+1}⁻¹
+//	x̂_k = x_k ⊞ G_k·(x̂_{k+1} ⊟ x⁻_{k+1})
+//	P̂_k = P_k + G_k·(P̂_{k+1} - P⁻_{k+1})·G_kᵀ
+//
+// Для ESKF разность и перенос выполняются в пространстве ошибки.
+func (w *EKFWrapper) Smooth() ([]models.EstimatedState, error) {
+	if !w.config.Smoother {
+		return nil, fmt.Errorf("сглаживание выключено")
+	}
+
+	n := len(w.trajectory)
+	if n == 0 {
+		return nil, nil
+	}
+	states := make([]models.EstimatedState, n)
+
+	last := w.trajectory[n-1]
+	xs, ps := last.x, last.p
+	state, err := w.smoothedState(last.t, xs, ps)
+	if err != nil {
+		return nil, err
+	}
+	states[n-1] = *state
+
+	for k := n - 2; k >= 0; k-- {
+		xs, ps, err = w.smoothStep(k, xs, ps)
+		if err != nil {
+			return nil, err
+		}
+
+		state, err := w.smoothedState(w.trajectory[k].t, xs, ps)
+		if err != nil {
+			return nil, err
+		}
+		states[k] = *state
+	}
+
+	return states, nil
+}
+
+// smoothStep выполняет шаг обратного прохода: сглаженная оценка k-го шага по сглаженной оценке (xs, ps)
+// следующего шага. Коэффициент сглаживания зависит только от оценок фильтра и сохраняется в шаге.
+func (w *EKFWrapper) smoothStep(k int, xs *mat.VecDense, ps mat.Symmetric) (*mat.VecDense, mat.Symmetric, error) {
+	e, next := &w.trajectory[k], w.trajectory[k+1]
+
+	// Gᵀ = P⁻⁻¹·F·P
+	if e.gt == nil {
+		fp := &mat.Dense{}
+		fp.Mul(next.f, e.p)
+		gt, err := solveScaled(next.pPred, fp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("ошибка сглаживания на %v: %v", e.t, err)
+		}
+		e.gt = gt
+	}
+	gt := e.gt
+
+	dx := mat.NewVecDense(e.p.SymmetricDim(), nil)
+	dx.MulVec(gt.T(), w.difference(xs, next.xPred))
+
+	dp := &mat.Dense{}
+	dp.Sub(ps, next.pPred)
+	gdp := &mat.Dense{}
+	gdp.Mul(gt.T(), dp)
+	cov := &mat.Dense{}
+	cov.Mul(gdp, gt)
+	cov.Add(cov, e.p)
+
+	sym := mat.NewSymDense(e.p.SymmetricDim(), nil)
+	setSym(sym, cov)
+
+	return w.inject(e.x, dx), sym, nil
+}
+
+// smoothedState преобразует сглаженную оценку на момент t в EstimatedState
+func (w *EKFWrapper) smoothedState(t time.Time, x *mat.VecDense, p mat.Symmetric) (*models.EstimatedState, error) {
+	est, err := w.newEstimate(x, p)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка сглаживания на %v: %v", t, err)
+	}
+
+	state := w.estimateToState(est)
+	state.Timestamp = t
+
+	return state, nil
+}
+
+// difference возвращает разность состояний a ⊟ b в пространстве ковариации фильтра
+func (w *EKFWrapper) difference(a, b mat.Vector) *mat.VecDense {
+	if es, ok := w.kf.(errorStater); ok {
+		return es.stateError(a, b)
+	}
+
+	d := mat.NewVecDense(a.Len(), nil)
+	d.SubVec(a, b)
+	return d
+}
+
+// inject возвращает состояние x ⊞ dx
+func (w *EKFWrapper) inject(x mat.Vector, dx *mat.VecDense) *mat.VecDense {
+	if es, ok := w.kf.(errorStater); ok {
+		return es.inject(x, dx)
+	}
+
+	xs := mat.NewVecDense(x.Len(), nil)
+	xs.AddVec(x, dx)
+	return xs
+}
+
+// solveScaled решает P·X = B для симметричной положительно определенной P с диагональным
+// масштабированием: дисперсии компонент состояния различаются на много порядков
+func solveScaled(p mat.Symmetric, b *mat.Dense) (*mat.Dense, error) {
+	n := p.SymmetricDim()
+	d := make([]float64, n)
+	for i := 0; i < n; i++ {
+		if p.At(i, i) <= 0 {
+			return nil, fmt.Errorf("неположительная дисперсия %d-й компоненты: %v", i, p.At(i, i))
+		}
+		d[i] = 1 / math.Sqrt(p.At(i, i))
+	}
+
+	ps := mat.NewSymDense(n, nil)
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			ps.SetSym(i, j, d[i]*p.At(i, j)*d[j])
+		}
+	}
+	dm := mat.NewDiagDense(n, d)
+
+	bs := &mat.Dense{}
+	bs.Mul(dm, b)
+	var chol mat.Cholesky
+	if !chol.Factorize(ps) {
+		return nil, fmt.Errorf("ковариация не положительно определена")
+	}
+	y := &mat.Dense{}
+	if err := chol.SolveTo(y, bs); err != nil {
+		return nil, err
+	}
+	x := &mat.Dense{}
+	x.Mul(dm, y)
+
+	return x, nil
+}
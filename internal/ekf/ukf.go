@@ -0,0 +1,583 @@
+package ekf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	filter "github.com/milosgajdos/go-estimate"
+	"github.com/milosgajdos/go-estimate/estimate"
+	"github.com/milosgajdos/go-estimate/noise"
+	"gonum.org/v1/gonum/mat"
+)
+
+// SigmaPointConfig безразмерные параметры сигма-точек UKF
+type SigmaPointConfig struct {
+	// Alpha разброс точек (0, 1]
+	Alpha float64
+	// Beta учет распределения (2 - оптимально для гауссова)
+	Beta float64
+	// Kappa дополнительный масштаб (неотрицательный)
+	Kappa float64
+}
+
+// UKF сигма-точечный (unscented) фильтр Калмана.
+// В отличие от UKF go-estimate шумы состояния и измерений аддитивны: сигма-точки строятся
+// только по ковариации состояния, поэтому шум измерений можно менять между коррекциями.
+// Сигма-точки строятся заново вокруг переданного состояния на каждом шаге, что позволяет
+// вернуть фильтр к более раннему состоянию и ковариации.
+// Кватернион ориентации в состоянии нормируется после усреднения и коррекции.
+type UKF struct {
+	// m модель системы
+	m filter.Model
+	// q шум состояния (процесса)
+	q filter.Noise
+	// r шум выхода (измерений)
+	r filter.Noise
+	// gamma множитель квадратного корня ковариации для сигма-точек
+	gamma float64
+	// Wm0 вес центральной сигма-точки в среднем
+	Wm0 float64
+	// Wc0 вес центральной сигма-точки в ковариации
+	Wc0 float64
+	// W вес остальных сигма-точек в среднем и ковариации
+	W float64
+	// att индекс кватерниона (w, x, y, z) в состоянии (-1 - кватерниона нет)
+	att int
+	// p ковариация состояния
+	p *mat.SymDense
+	// inn невязка
+	inn *mat.VecDense
+	// s ковариация невязки
+	s *mat.SymDense
+	// k коэффициент усиления
+	k *mat.Dense
+	// f статистически линеаризованная матрица перехода последнего предсказания
+	f *mat.Dense
+	// cov вычисляет ковариацию в заданной форме и поддерживает ее симметричной и положительно определенной
+	cov *covarianceGuard
+}
+
+// NewUKF создает UKF.
+// Параметры:
+// - m:    модель системы
+// - init: начальные условия фильтра
+// - q:    шум состояния (процесса)
+// - r:    шум выхода (измерений)
+// - c:    параметры сигма-точек
+// - att:  индекс первого элемента кватерниона (w, x, y, z) в состоянии (-1 - кватерниона нет)
+// Возвращает ошибку, если размерности модели не положительны, ковариации шумов не совпадают
+// с размерностями модели, неверны параметры сигма-точек (alpha, beta, kappa) или индекс кватерниона.
+func NewUKF(m filter.Model, init filter.InitCond, q, r filter.Noise, c *SigmaPointConfig, att int) (*UKF, error) {
+	// размерности состояния и выхода
+	nx, _, ny, _ := m.SystemDims()
+	if nx <= 0 || ny <= 0 {
+		return nil, fmt.Errorf("invalid model dimensions: [%d x %d]", nx, ny)
+	}
+	if att >= 0 && att+4 > nx {
+		return nil, fmt.Errorf("неверный индекс кватерниона %d для состояния размерности %d", att, nx)
+	}
+
+	if c == nil || c.Alpha <= 0 || c.Alpha > 1 || c.Kappa < 0 {
+		return nil, fmt.Errorf("invalid sigma point parameters: %+v", c)
+	}
+
+	if init.Cov().SymmetricDim() != nx {
+		return nil, fmt.Errorf("invalid initial covariance dimension: %d", init.Cov().SymmetricDim())
+	}
+
+	if q != nil {
+		if q.Cov().SymmetricDim() != nx {
+			return nil, fmt.Errorf("invalid state noise dimension: %d", q.Cov().SymmetricDim())
+		}
+	} else {
+		q, _ = noise.NewNone()
+	}
+
+	if r != nil {
+		if r.Cov().SymmetricDim() != ny {
+			return nil, fmt.Errorf("invalid output noise dimension: %d", r.Cov().SymmetricDim())
+		}
+	} else {
+		r, _ = noise.NewNone()
+	}
+
+	n := float64(nx)
+
+	// lambda - безразмерный параметр UKF, вычисляемый по параметрам сигма-точек
+	lambda := c.Alpha*c.Alpha*(n+c.Kappa) - n
+
+	// начальная ковариация из начальных условий
+	p := mat.NewSymDense(nx, nil)
+	p.CopySym(init.Cov())
+
+	cov, err := newCovarianceGuard(CovarianceJoseph, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UKF{
+		m:     m,
+		q:     q,
+		r:     r,
+		gamma: math.Sqrt(n + lambda),
+		Wm0:   lambda / (n + lambda),
+		Wc0:   lambda/(n+lambda) + (1 - c.Alpha*c.Alpha + c.Beta),
+		W:     1 / (2 * (n + lambda)),
+		att:   att,
+		p:     p,
+		inn:   mat.NewVecDense(ny, nil),
+		k:     mat.NewDense(nx, ny, nil),
+		cov:   cov,
+	}, nil
+}
+
+// GenSigmaPoints строит 2*nx+1 сигма-точек вокруг x и возвращает их в столбцах матрицы.
+// Возвращает ошибку, если ковариацию не удается разложить.
+func (k *UKF) GenSigmaPoints(x mat.Vector) (*mat.Dense, error) {
+	nx := x.Len()
+
+	// в форме квадратного корня - фактор, перенесенный с предыдущего шага
+	var sqrtCov mat.Matrix
+	if k.cov.form == CovarianceSqrt {
+		sqrtCov = k.cov.stateFactor(k.p)
+	} else {
+		var chol mat.Cholesky
+		if ok := chol.Factorize(k.p); !ok {
+			return nil, fmt.Errorf("covariance is not positive definite")
+		}
+		l := &mat.TriDense{}
+		chol.LTo(l)
+		sqrtCov = l
+	}
+
+	sp := mat.NewDense(nx, 2*nx+1, nil)
+	for j := 0; j < 2*nx+1; j++ {
+		sp.Slice(0, nx, j, j+1).(*mat.Dense).Copy(x)
+	}
+
+	// столбцы масштабированного квадратного корня ковариации прибавляются к x и вычитаются из x
+	for j := 0; j < nx; j++ {
+		for i := 0; i < nx; i++ {
+			d := k.gamma * sqrtCov.At(i, j)
+			sp.Set(i, 1+j, sp.At(i, 1+j)+d)
+			sp.Set(i, 1+nx+j, sp.At(i, 1+nx+j)-d)
+		}
+	}
+
+	return sp, nil
+}
+
+// Predict вычисляет следующее состояние по состоянию x и входу u и возвращает его оценку.
+// Состояние - взвешенное среднее предсказанных сигма-точек с нормированным кватернионом;
+// шум состояния добавляется к ковариации.
+// Возвращает ошибку, если не удается построить или предсказать сигма-точки.
+func (k *UKF) Predict(x, u mat.Vector) (filter.Estimate, error) {
+	nx := x.Len()
+
+	sp, err := k.GenSigmaPoints(x)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sigma points: %v", err)
+	}
+
+	// предсказание всех сигма-точек без шума
+	_, cols := sp.Dims()
+	xPred := mat.NewDense(nx, cols, nil)
+	for c := 0; c < cols; c++ {
+		spNext, err := k.m.Propagate(sp.ColView(c), u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to propagate sigma point: %v", err)
+		}
+		xPred.Slice(0, nx, c, c+1).(*mat.Dense).Copy(spNext)
+	}
+
+	xMean := k.mean(xPred)
+
+	// статистически линеаризованная матрица перехода F = Cᵀ·P⁻¹ по взаимной ковариации
+	// сигма-точек до и после предсказания
+	c := k.covariance(sp, k.mean(sp), xPred, xMean)
+	ft, err := solveScaled(k.p, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to linearize propagation: %v", err)
+	}
+	k.f = mat.DenseCopyOf(ft.T())
+
+	k.p.CopySym(k.predictCov(xPred, xMean))
+
+	k.normalizeAttitude(xMean)
+
+	return estimate.NewBaseWithCov(xMean, k.p)
+}
+
+// Update корректирует состояние x измерением z при входе u и возвращает скорректированную оценку.
+// Возвращает ошибку при неверном измерении или если не удается вычислить выход системы.
+func (k *UKF) Update(x, u, z mat.Vector) (filter.Estimate, error) {
+	_, _, ny, _ := k.m.SystemDims()
+
+	if z.Len() != ny {
+		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
+	}
+
+	observe := func(x mat.Vector) (mat.Vector, error) {
+		return k.m.Observe(x, u, nil)
+	}
+	residual := func(z, y mat.Vector) *mat.VecDense {
+		r := mat.NewVecDense(z.Len(), nil)
+		r.SubVec(z, y)
+		return r
+	}
+
+	return k.update(x, z, observe, residual, k.r, nil)
+}
+
+// UpdateMeasurement корректирует состояние x измерением z модели m с шумом r и возвращает
+// скорректированную оценку. В отличие от Update, размерность z задается моделью m.
+// Если gate не nil, он решает судьбу измерения по невязке; отброшенное измерение не меняет UKF.
+func (k *UKF) UpdateMeasurement(x, z mat.Vector, m MeasurementModel, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	if z.Len() != m.Dim() || r.Cov().SymmetricDim() != m.Dim() {
+		return nil, fmt.Errorf("invalid measurement supplied: %v", z)
+	}
+
+	return k.update(x, z, m.Observe, m.Residual, r, gate)
+}
+
+// update корректирует состояние x измерением z, наблюдаемым функцией observe, с шумом r.
+// Разности выходов вычисляются residual, поэтому угловые выходы усредняются правильно.
+func (k *UKF) update(x, z mat.Vector, observe func(mat.Vector) (mat.Vector, error),
+	residual func(z, y mat.Vector) *mat.VecDense, r filter.Noise, gate GateFunc) (filter.Estimate, error) {
+	nx := x.Len()
+	ny := z.Len()
+
+	sp, err := k.GenSigmaPoints(x)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate sigma points: %v", err)
+	}
+
+	// выходы сигма-точек
+	_, cols := sp.Dims()
+	y := mat.NewDense(ny, cols, nil)
+	for c := 0; c < cols; c++ {
+		spOut, err := observe(sp.ColView(c))
+		if err != nil {
+			return nil, fmt.Errorf("failed to observe sigma point output: %v", err)
+		}
+		if spOut.Len() != ny {
+			return nil, fmt.Errorf("invalid sigma point output dimension: %d", spOut.Len())
+		}
+		y.Slice(0, ny, c, c+1).(*mat.Dense).Copy(spOut)
+	}
+
+	// средний выход накапливается как взвешенные невязки относительно выхода центральной сигма-точки
+	y0 := y.ColView(0)
+	yMean := mat.NewVecDense(ny, nil)
+	for c := 1; c < cols; c++ {
+		yMean.AddScaledVec(yMean, k.W, residual(y.ColView(c), y0))
+	}
+	yMean.AddVec(y0, yMean)
+
+	// взаимная ковариация состояния и выхода сигма-точек
+	pxy := mat.NewDense(nx, ny, nil)
+	// ковариация выхода сигма-точек
+	syy := mat.NewDense(ny, ny, nil)
+
+	xMean := k.mean(sp)
+	dx := mat.NewVecDense(nx, nil)
+	outerxy := mat.NewDense(nx, ny, nil)
+	outeryy := mat.NewDense(ny, ny, nil)
+	for c := 0; c < cols; c++ {
+		dx.SubVec(sp.ColView(c), xMean)
+		dy := residual(y.ColView(c), yMean)
+
+		w := k.W
+		if c == 0 {
+			w = k.Wc0
+		}
+		outerxy.Outer(w, dx, dy)
+		outeryy.Outer(w, dy, dy)
+		pxy.Add(pxy, outerxy)
+		syy.Add(syy, outeryy)
+	}
+
+	// невязка
+	inn := residual(z, yMean)
+
+	// ковариация невязки Syy + R после проверки
+	pyy, _, err := innovationCov(syy, inn, r, gate)
+	if errors.Is(err, ErrMeasurementRejected) {
+		k.inn = mat.VecDenseCopyOf(inn)
+		k.s = mat.NewSymDense(inn.Len(), nil)
+		setSym(k.s, pyy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// коэффициент усиления
+	pyyInv := &mat.Dense{}
+	if err := pyyInv.Inverse(pyy); err != nil {
+		return nil, fmt.Errorf("failed to calculat Pyy inverse: %v", err)
+	}
+	gain := &mat.Dense{}
+	gain.Mul(pxy, pyyInv)
+
+	// коррекция состояния x
+	corr := &mat.VecDense{}
+	corr.MulVec(gain, inn)
+	xCorr := mat.NewVecDense(nx, nil)
+	xCorr.AddVec(x, corr)
+	k.normalizeAttitude(xCorr)
+
+	// коррекция ковариации: P - K*Pyy*K'
+	pCorr := k.correctCov(gain, pyy)
+
+	// невязка и коэффициент усиления; их размерность зависит от измерения
+	k.inn = mat.VecDenseCopyOf(inn)
+	k.s = mat.NewSymDense(inn.Len(), nil)
+	setSym(k.s, pyy)
+	k.k = mat.DenseCopyOf(gain)
+	// ковариация состояния
+	k.p.CopySym(pCorr)
+
+	return estimate.NewBaseWithCov(xCorr, k.p)
+}
+
+// Run выполняет шаг UKF для состояния x, входа u и измерения z и возвращает новую оценку.
+// Возвращает ошибку, если не удается предсказать или скорректировать состояние.
+func (k *UKF) Run(x, u, z mat.Vector) (filter.Estimate, error) {
+	pred, err := k.Predict(x, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.Update(pred.Val(), u, z)
+}
+
+// mean возвращает взвешенное среднее сигма-точек из столбцов sp
+func (k *UKF) mean(sp *mat.Dense) *mat.VecDense {
+	rows, cols := sp.Dims()
+	m := mat.NewVecDense(rows, nil)
+	for c := 0; c < cols; c++ {
+		w := k.W
+		if c == 0 {
+			w = k.Wm0
+		}
+		m.AddScaledVec(m, w, sp.ColView(c))
+	}
+
+	return m
+}
+
+// normalizeAttitude нормирует кватернион состояния x: аддитивное среднее сигма-точек
+// и коррекция выводят его с единичной сферы
+func (k *UKF) normalizeAttitude(x *mat.VecDense) {
+	if k.att < 0 {
+		return
+	}
+	q := normalize([4]float64{x.AtVec(k.att), x.AtVec(k.att + 1), x.AtVec(k.att + 2), x.AtVec(k.att + 3)})
+	for i := range q {
+		x.SetVec(k.att+i, q[i])
+	}
+}
+
+// covariance возвращает взвешенную взаимную ковариацию сигма-точек a и b относительно их средних
+func (k *UKF) covariance(a *mat.Dense, aMean *mat.VecDense, b *mat.Dense, bMean *mat.VecDense) *mat.Dense {
+	na, cols := a.Dims()
+	nb, _ := b.Dims()
+
+	cov := mat.NewDense(na, nb, nil)
+	da := mat.NewVecDense(na, nil)
+	db := mat.NewVecDense(nb, nil)
+	outer := mat.NewDense(na, nb, nil)
+	for c := 0; c < cols; c++ {
+		da.SubVec(a.ColView(c), aMean)
+		db.SubVec(b.ColView(c), bMean)
+		outer.Outer(1, da, db)
+
+		w := k.W
+		if c == 0 {
+			w = k.Wc0
+		}
+		outer.Scale(w, outer)
+		cov.Add(cov, outer)
+	}
+
+	return cov
+}
+
+// predictCov возвращает ковариацию предсказанных сигма-точек sp относительно среднего с шумом состояния.
+// В форме квадратного корня множитель находится QR-разложением взвешенных отклонений сигма-точек
+// и множителя шума с поправкой ранга 1 по отклонению центральной точки, вес которой может быть отрицательным.
+func (k *UKF) predictCov(sp *mat.Dense, mean *mat.VecDense) *mat.SymDense {
+	var q mat.Symmetric
+	if _, ok := k.q.(*noise.None); !ok {
+		q = k.q.Cov()
+	}
+
+	if k.cov.form == CovarianceSqrt {
+		nx, cols := sp.Dims()
+		sw := math.Sqrt(k.W)
+		dev := mat.NewDense(nx, cols-1, nil)
+		for c := 1; c < cols; c++ {
+			for i := 0; i < nx; i++ {
+				dev.Set(i, c-1, sw*(sp.At(i, c)-mean.AtVec(i)))
+			}
+		}
+		blocks := []*mat.Dense{dev}
+		if q != nil {
+			blocks = append(blocks, k.cov.factor(q, false))
+		}
+
+		chol := choleskyFromColumns(nx, blocks...)
+		d0 := mat.NewVecDense(nx, nil)
+		d0.SubVec(sp.ColView(0), mean)
+		if ok := chol.SymRankOne(chol, k.Wc0, d0); ok {
+			k.cov.health.Checks++
+			return k.cov.keep(chol)
+		}
+		// поправка нарушила положительную определенность - полная матрица проверяется и исправляется
+	}
+
+	cov := k.covariance(sp, mean, sp, mean)
+	if q != nil {
+		cov.Add(cov, q)
+	}
+
+	return k.cov.enforce(cov)
+}
+
+// correctCov возвращает скорректированную ковариацию P - K*Pyy*K'.
+// В форме квадратного корня из множителя P вычитаются столбцы K, умноженного на множитель Pyy.
+func (k *UKF) correctCov(gain *mat.Dense, pyy *mat.Dense) *mat.SymDense {
+	nx := k.p.SymmetricDim()
+
+	if k.cov.form == CovarianceSqrt {
+		syy := mat.NewSymDense(pyy.RawMatrix().Rows, nil)
+		setSym(syy, pyy)
+		u := &mat.Dense{}
+		u.Mul(gain, k.cov.factor(syy, false))
+
+		chol := choleskyFromColumns(nx, k.cov.stateFactor(k.p))
+		if ok := downdate(chol, u); ok {
+			k.cov.health.Checks++
+			return k.cov.keep(chol)
+		}
+		// поправка нарушила положительную определенность - полная матрица проверяется и исправляется
+	}
+
+	kp := &mat.Dense{}
+	kp.Mul(gain, pyy)
+	pCorr := &mat.Dense{}
+	pCorr.Mul(kp, gain.T())
+	pCorr.Sub(k.p, pCorr)
+
+	return k.cov.enforce(pCorr)
+}
+
+// SetCovarianceForm задает форму вычисления ковариации (joseph или sqrt) и нижнюю границу
+// собственных чисел при исправлении не положительно определенной ковариации
+func (k *UKF) SetCovarianceForm(form string, minEigenvalue float64) error {
+	cov, err := newCovarianceGuard(form, minEigenvalue)
+	if err != nil {
+		return err
+	}
+	k.cov = cov
+
+	return nil
+}
+
+// CovarianceHealth возвращает накопленную диагностику ковариации
+func (k *UKF) CovarianceHealth() CovarianceHealth {
+	return k.cov.health
+}
+
+// Model возвращает модель UKF
+func (k *UKF) Model() filter.Model {
+	return k.m
+}
+
+// SetStateNoise задает шум состояния q для последующих предсказаний.
+// Возвращает ошибку, если q равен nil или его размерность не совпадает с размерностью состояния.
+func (k *UKF) SetStateNoise(q filter.Noise) error {
+	if q == nil {
+		return fmt.Errorf("invalid state noise: %v", q)
+	}
+
+	if q.Cov().SymmetricDim() != k.p.SymmetricDim() {
+		return fmt.Errorf("invalid state noise dimension: %d", q.Cov().SymmetricDim())
+	}
+
+	k.q = q
+
+	return nil
+}
+
+// SetOutputNoise задает шум выхода r для последующих коррекций.
+// Возвращает ошибку, если r равен nil или его размерность не совпадает с размерностью выхода модели.
+func (k *UKF) SetOutputNoise(r filter.Noise) error {
+	if r == nil {
+		return fmt.Errorf("invalid output noise: %v", r)
+	}
+
+	_, _, ny, _ := k.m.SystemDims()
+	if r.Cov().SymmetricDim() != ny {
+		return fmt.Errorf("invalid output noise dimension: %d", r.Cov().SymmetricDim())
+	}
+
+	k.r = r
+
+	return nil
+}
+
+// Cov возвращает ковариацию UKF
+func (k *UKF) Cov() mat.Symmetric {
+	cov := mat.NewSymDense(k.p.SymmetricDim(), nil)
+	cov.CopySym(k.p)
+
+	return cov
+}
+
+// SetCov задает ковариацию UKF.
+// Возвращает ошибку, если cov равна nil или ее размерность не совпадает с размерностью ковариации UKF.
+func (k *UKF) SetCov(cov mat.Symmetric) error {
+	if cov == nil {
+		return fmt.Errorf("invalid covariance matrix: %v", cov)
+	}
+
+	if cov.SymmetricDim() != k.p.SymmetricDim() {
+		return fmt.Errorf("invalid covariance matrix dims: [%d x %d]", cov.SymmetricDim(), cov.SymmetricDim())
+	}
+
+	k.p.CopySym(cov)
+
+	return nil
+}
+
+// Innovation возвращает невязку последней коррекции (в том числе отброшенной)
+func (k *UKF) Innovation() mat.Vector {
+	return mat.VecDenseCopyOf(k.inn)
+}
+
+// InnovationCov возвращает ковариацию невязки последней коррекции (в том числе отброшенной)
+func (k *UKF) InnovationCov() mat.Symmetric {
+	return copySym(k.s)
+}
+
+// Gain возвращает коэффициент усиления
+func (k *UKF) Gain() mat.Matrix {
+	gain := &mat.Dense{}
+	gain.CloneFrom(k.k)
+
+	return gain
+}
+
+// Transition возвращает статистически линеаризованную матрицу перехода последнего предсказания
+// (nil - предсказаний не было)
+func (k *UKF) Transition() mat.Matrix {
+	if k.f == nil {
+		return nil
+	}
+	f := &mat.Dense{}
+	f.CloneFrom(k.f)
+
+	return f
+}
@@ -0,0 +1,176 @@
+package fuzzer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"main.go/internal/ekf"
+)
+
+// CheckpointVersion версия формата контрольной точки
+const CheckpointVersion = 1
+
+// Checkpoint контрольная точка обработки: фаза инициализации и состояние фильтра
+type Checkpoint struct {
+	Version int              `json:"version"`
+	Fuzzer  FuzzerState      `json:"fuzzer"`
+	Filter  *ekf.FilterState `json:"filter,omitempty"` // nil - фильтр еще не инициализирован
+}
+
+// FuzzerState состояние обработки до фильтра
+type FuzzerState struct {
+	LastSample   time.Time  `json:"last_sample"` // Метка последнего обработанного отсчета
+	CountGNSS    int        `json:"count_gnss"`
+	CalcBias     bool       `json:"calc_bias"`
+	Initialized  bool       `json:"initialized"`
+	LastTimeGNSS time.Time  `json:"last_time_gnss"`
+	Reference    [3]float64 `json:"reference"` // Начало ENU: широта, долгота, высота
+
+	// Начальное состояние фильтра, оцененное при инициализации
+	Position   []float64 `json:"position"`
+	Velocity   []float64 `json:"velocity"`
+	Quaternion []float64 `json:"quaternion"`
+	BiasAcc    []float64 `json:"bias_acc"`
+	BiasGyro   []float64 `json:"bias_gyro"`
+
+	// Буферы усреднения смещений
+	BufBiasAcc  [3][]float64 `json:"buf_bias_acc"`
+	BufBiasGyro [3][]float64 `json:"buf_bias_gyro"`
+}
+
+// Checkpoint возвращает контрольную точку текущего состояния обработки
+func (f *Fuzzer) Checkpoint() (*Checkpoint, error) {
+	is := f.cfg.EKF.InitialState
+	gnss := f.cfg.Sensors.GNSS
+	c := &Checkpoint{
+		Version: CheckpointVersion,
+		Fuzzer: FuzzerState{
+			LastSample:   f.lastSample,
+			CountGNSS:    f.countGNSS,
+			CalcBias:     f.calcBias,
+			Initialized:  f.initialized,
+			LastTimeGNSS: f.lastTimeGNSS,
+			Reference:    [3]float64{gnss.ReferenceLatitude, gnss.ReferenceLongitude, gnss.ReferenceAltitude},
+			Position:     slices.Clone(is.Position),
+			Velocity:     slices.Clone(is.Velocity),
+			Quaternion:   slices.Clone(is.Quaternion),
+			BiasAcc:      slices.Clone(is.Bias_acc),
+			BiasGyro:     slices.Clone(is.Bias_gyro),
+			BufBiasAcc:   [3][]float64{slices.Clone(f.BufBiasAccX), slices.Clone(f.BufBiasAccY), slices.Clone(f.BufBiasAccZ)},
+			BufBiasGyro:  [3][]float64{slices.Clone(f.BufBiasGyroX), slices.Clone(f.BufBiasGyroY), slices.Clone(f.BufBiasGyroZ)},
+		},
+	}
+
+	if f.ekf != nil {
+		state, err := f.ekf.Checkpoint()
+		if err != nil {
+			return nil, err
+		}
+		c.Filter = state
+	}
+
+	return c, nil
+}
+
+// Restore восстанавливает обработку из контрольной точки: отсчеты до ее метки
+// при следующей обработке пропускаются
+func (f *Fuzzer) Restore(c *Checkpoint) error {
+	if c.Version != CheckpointVersion {
+		return fmt.Errorf("неподдерживаемая версия контрольной точки %d (ожидается %d)", c.Version, CheckpointVersion)
+	}
+	s := c.Fuzzer
+	if s.Initialized && c.Filter == nil {
+		return fmt.Errorf("в контрольной точке нет состояния фильтра")
+	}
+	for _, buf := range append(s.BufBiasAcc[:], s.BufBiasGyro[:]...) {
+		if len(buf) != f.sizeBufBias {
+			return fmt.Errorf("неверный размер буфера смещений: %d, ожидается %d", len(buf), f.sizeBufBias)
+		}
+	}
+
+	f.countGNSS = s.CountGNSS
+	f.calcBias = s.CalcBias
+	f.initialized = s.Initialized
+	f.lastSample = s.LastSample
+	f.resumeAfter = s.LastSample
+	f.lastTimeGNSS = s.LastTimeGNSS
+
+	gnss := &f.cfg.Sensors.GNSS
+	gnss.ReferenceLatitude, gnss.ReferenceLongitude, gnss.ReferenceAltitude = s.Reference[0], s.Reference[1], s.Reference[2]
+
+	is := &f.cfg.EKF.InitialState
+	is.Position, is.Velocity, is.Quaternion = s.Position, s.Velocity, s.Quaternion
+	is.Bias_acc, is.Bias_gyro = s.BiasAcc, s.BiasGyro
+
+	f.BufBiasAccX, f.BufBiasAccY, f.BufBiasAccZ = s.BufBiasAcc[0], s.BufBiasAcc[1], s.BufBiasAcc[2]
+	f.BufBiasGyroX, f.BufBiasGyroY, f.BufBiasGyroZ = s.BufBiasGyro[0], s.BufBiasGyro[1], s.BufBiasGyro[2]
+
+	f.ekf = nil
+	if !s.Initialized {
+		return nil
+	}
+
+	if err := f.initEKF(c.Filter.Time); err != nil {
+		return err
+	}
+	if err := f.ekf.Restore(c.Filter); err != nil {
+		return fmt.Errorf("ошибка восстановления фильтра: %v", err)
+	}
+
+	return nil
+}
+
+// SaveCheckpoint сохраняет контрольную точку в файл JSON; файл заменяется целиком
+func (f *Fuzzer) SaveCheckpoint(file string) error {
+	c, err := f.Checkpoint()
+	if err != nil {
+		return fmt.Errorf("ошибка создания контрольной точки: %v", err)
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка кодирования контрольной точки: %v", err)
+	}
+
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+// LoadCheckpoint восстанавливает обработку из файла контрольной точки
+func (f *Fuzzer) LoadCheckpoint(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var c Checkpoint
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("ошибка чтения контрольной точки %s: %v", file, err)
+	}
+
+	return f.Restore(&c)
+}
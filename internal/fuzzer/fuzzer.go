@@ -1,11 +1,15 @@
 package fuzzer
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"math"
 
-	"time" // для реального случая
+	"time"
 
+	filter "github.com/milosgajdos/go-estimate"
 	"gonum.org/v1/gonum/mat"
 	"main.go/config"
 	"main.go/internal/ekf"
@@ -15,12 +19,17 @@ import (
 // Fuzzer обрабатывает данные датчиков
 type Fuzzer struct {
 	cfg *config.Config
-	ekf *ekf.EKFWrapper
+	ekf ekf.FusionFilter
 	p   *models.PositionModel
 
-	lastTimeGNSS time.Time //в реальности
-	//lastTimeGNSS float64 // для отладки
-	//nextTimeGNSS float64 // для отладки
+	// Фаза инициализации: число решений GNSS до инициализации, накопление смещений, фильтр создан
+	countGNSS   int
+	calcBias    bool
+	initialized bool
+
+	lastSample   time.Time // Метка последнего обработанного отсчета
+	resumeAfter  time.Time // Отсчеты не позже этой метки пропускаются при возобновлении с контрольной точки
+	lastTimeGNSS time.Time // Время первого решения GNSS (по меткам данных)
 	sizeBufBias  int
 	BufBiasAccX  []float64
 	BufBiasAccY  []float64
@@ -30,6 +39,10 @@ type Fuzzer struct {
 	BufBiasGyroZ []float64
 
 	gravity float64
+
+	diagnosticsOutput   io.Writer // Таблица CSV записей диагностики (nil - не выводится)
+	adaptiveNoiseOutput io.Writer // Таблица CSV адаптированных шумов (nil - не выводится)
+	immOutput           io.Writer // Таблица CSV вероятностей режимов IMM (nil - не выводится)
 }
 
 // NewDataProcessor создает новый процессор
@@ -38,9 +51,6 @@ func NewFuzzer(cfg *config.Config) *Fuzzer {
 		cfg:     cfg,
 		gravity: 9.81,
 
-		lastTimeGNSS: time.Now(),
-		//lastTimeGNSS: 0.0,
-		//nextTimeGNSS: 0.0,
 		sizeBufBias:  10,
 		BufBiasAccX:  make([]float64, 10),
 		BufBiasAccY:  make([]float64, 10),
@@ -51,200 +61,232 @@ func NewFuzzer(cfg *config.Config) *Fuzzer {
 	}
 }
 
-// Process обрабатывает данные датчиков
+// Process обрабатывает данные датчиков; при включенном сглаживании возвращает сглаженные состояния
 func (f *Fuzzer) Process(syncedData []models.SynchronizedData,
 ) ([]models.EstimatedState, error) {
 
-	count_GNSS := 0
-	initialization_on := false
-
-	calc_bias_on := false
+	stream := func(yield func(models.SynchronizedData, error) bool) {
+		for _, data := range syncedData {
+			if !yield(data, nil) {
+				return
+			}
+		}
+	}
 
 	// Обрабатываем синхронизированные данные
 	var results []models.EstimatedState
 
-	for i, data := range syncedData {
-		var state *models.EstimatedState
-		var err error
+	for state, err := range f.ProcessStream(stream) {
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, state)
+	}
 
-		data.AccelX *= -f.gravity
-		data.AccelY *= -f.gravity
-		data.AccelZ *= -f.gravity
-		// DegreesToRadians преобразует градусы/с в радианы/c
-		data.GyroX = DegreesToRadians(data.GyroX)
-		data.GyroY = DegreesToRadians(data.GyroY)
-		data.GyroZ = DegreesToRadians(data.GyroZ)
+	if f.cfg.EKF.Smoother.Enabled {
+		return f.Smooth()
+	}
 
-		if initialization_on == false {
+	return results, nil
+}
 
-			if data.HasGNSS {
+// Smooth возвращает состояния всего прямого прохода, сглаженные обратным проходом RTS
+func (f *Fuzzer) Smooth() ([]models.EstimatedState, error) {
+	if f.ekf == nil {
+		return nil, fmt.Errorf("фильтр не инициализирован")
+	}
+	return f.ekf.Smooth()
+}
 
-				//f.nextTimeGNSS += 1 / f.cfg.Sensors.GNSS.Frequency // для отладки
-				count_GNSS++
-				if count_GNSS == 2 {
-					initialization_on = true
+// ProcessStream обрабатывает поток синхронизированных данных по мере поступления и выдает оценки состояния
+func (f *Fuzzer) ProcessStream(syncedData iter.Seq2[models.SynchronizedData, error],
+) iter.Seq2[models.EstimatedState, error] {
+	return func(yield func(models.EstimatedState, error) bool) {
 
-					// ИНИЦИАЛИЗАЦИЯ
+		i := -1
+		for data, err := range syncedData {
+			i++
+			if err != nil {
+				yield(models.EstimatedState{}, err)
+				return
+			}
 
-					// Инициализируем насальные параметры
-					err = f.initState(data)
-					// Инициализируем EKF
-					if err := f.initEKF(); err != nil {
-						return nil, err
-					}
+			if !f.resumeAfter.IsZero() {
+				if !data.Timestamp.After(f.resumeAfter) {
+					continue
+				}
+				f.resumeAfter = time.Time{}
+			}
+			f.lastSample = data.Timestamp
 
-				} else {
-					f.lastTimeGNSS = time.Now() // на реальном эксперименте
-					//f.lastTimeGNSS = f.nextTimeGNSS // для отладки
+			var state *models.EstimatedState
 
-					f.cfg.Sensors.GNSS.ReferenceLatitude = data.Latitude
-					f.cfg.Sensors.GNSS.ReferenceLongitude = data.Longitude
-					f.cfg.Sensors.GNSS.ReferenceAltitude = data.Altitude
+			data.AccelX *= -f.gravity
+			data.AccelY *= -f.gravity
+			data.AccelZ *= -f.gravity
+			// DegreesToRadians преобразует градусы/с в радианы/c
+			data.GyroX = DegreesToRadians(data.GyroX)
+			data.GyroY = DegreesToRadians(data.GyroY)
+			data.GyroZ = DegreesToRadians(data.GyroZ)
 
-					//E, N, U := GeodeticToENU(data.Latitude, data.Longitude, data.Altitude, f.cfg)
-					//fmt.Print("\nE = ", E, "; N = ", N, "; U = ", U)
+			if !f.initialized {
 
-					//lat, lon, alt := ENUToGeodetic(0, 0, 0, f.cfg)
-					//fmt.Print("\nLat = ", lat, "; Lon = ", lon, "; Alt = ", alt)
+				if data.HasGNSS {
 
-					calc_bias_on = true
+					f.countGNSS++
+					if f.countGNSS == 2 {
+						f.initialized = true
 
-				}
-			} else {
+						// ИНИЦИАЛИЗАЦИЯ
 
-				if calc_bias_on {
-					f.calcAverageData(data)
-				}
+						// Инициализируем насальные параметры
+						err = f.initState(data)
+						// Инициализируем EKF
+						if err := f.initEKF(data.Timestamp); err != nil {
+							yield(models.EstimatedState{}, err)
+							return
+						}
 
-			}
-		} else {
+					} else {
+						f.lastTimeGNSS = data.Timestamp
 
-			if data.HasGNSS {
-				// Есть GNSS данные - полный шаг EKF
+						f.cfg.Sensors.GNSS.ReferenceLatitude = data.Latitude
+						f.cfg.Sensors.GNSS.ReferenceLongitude = data.Longitude
+						f.cfg.Sensors.GNSS.ReferenceAltitude = f.altitude(data)
 
-				// если пришли данные IMU, преобразуем поворот осей Ox, Oy к направлению движения из 45* в 90* и записываем в новый влияющий вектор
-				// у тебя эти преобразования будут только в каналах Acc и Gyro
-				accXCorrect, accYCorrect, accZCorrect := IMUTransformation_2(data.AccelX, data.AccelY, data.AccelZ)
-				gyroXCorrect, gyroYCorrect, gyroZCorrect := IMUTransformation_2(data.GyroX, data.GyroY, data.GyroZ)
+						//E, N, U := GeodeticToENU(data.Latitude, data.Longitude, data.Altitude, f.cfg)
+						//fmt.Print("\nE = ", E, "; N = ", N, "; U = ", U)
 
-				// Входной вектор
-				u := mat.NewVecDense(6, []float64{
-					accXCorrect, accYCorrect, accZCorrect,
-					gyroXCorrect, gyroYCorrect, gyroZCorrect,
-				})
+						//lat, lon, alt := ENUToGeodetic(0, 0, 0, f.cfg)
+						//fmt.Print("\nLat = ", lat, "; Lon = ", lon, "; Alt = ", alt)
 
-				gnssX_ENU, gnssY_ENU, gnssZ_ENU := GeodeticToENU(data.Latitude, data.Longitude, data.Altitude, f.cfg)
+						f.calcBias = true
 
-				// Вектор измерений
-				z := mat.NewVecDense(4, []float64{
-					gnssX_ENU, gnssY_ENU, gnssZ_ENU,
-					data.Speed,
-				})
+					}
+				} else {
 
-				state, err = f.ekf.Run(u, z)
+					if f.calcBias {
+						f.calcAverageData(data)
+					}
 
+				}
 			} else {
-				// Только IMU данные - только предсказание
 
-				// если пришли данные IMU, преобразуем поворот осей Ox, Oy к направлению движения из 45* в 90* и записываем в новый влияющий вектор
-				accXCorrect, accYCorrect, accZCorrect := IMUTransformation_2(data.AccelX, data.AccelY, data.AccelZ)
-				gyroXCorrect, gyroYCorrect, gyroZCorrect := IMUTransformation_2(data.GyroX, data.GyroY, data.GyroZ)
+				if data.HasGNSS {
+					// Есть GNSS данные - полный шаг EKF
+
+					// если пришли данные IMU, преобразуем поворот осей Ox, Oy к направлению движения из 45* в 90* и записываем в новый влияющий вектор
+					// у тебя эти преобразования будут только в каналах Acc и Gyro
+					accXCorrect, accYCorrect, accZCorrect := IMUTransformation_2(data.AccelX, data.AccelY, data.AccelZ)
+					gyroXCorrect, gyroYCorrect, gyroZCorrect := IMUTransformation_2(data.GyroX, data.GyroY, data.GyroZ)
+
+					// Входной вектор
+					u := mat.NewVecDense(6, []float64{
+						accXCorrect, accYCorrect, accZCorrect,
+						gyroXCorrect, gyroYCorrect, gyroZCorrect,
+					})
+
+					// Измерения, пришедшие в эпоху GNSS
+					z := f.measurements(data)
+
+					switch {
+					case data.Timestamp.After(f.ekf.Time()) && data.HasIMU:
+						state, err = f.ekf.Run(data.Timestamp, u, z...)
+					case data.Timestamp.After(f.ekf.Time()):
+						// Разрыв в потоке IMU - прогноз до эпохи GNSS невозможен, корректируем текущее состояние
+						state, err = f.ekf.Update(z...)
+					default:
+						// Решение GNSS пришло с задержкой - коррекция в эпоху измерения с повторным прогоном IMU
+						state, err = f.ekf.UpdateAt(data.Timestamp, z...)
+						if errors.Is(err, ekf.ErrStaleMeasurement) {
+							// Эпоха старше истории состояний - корректируем текущее состояние
+							state, err = f.ekf.Update(z...)
+						}
+					}
 
-				// Входной вектор
-				u := mat.NewVecDense(6, []float64{
-					accXCorrect, accYCorrect, accZCorrect,
-					gyroXCorrect, gyroYCorrect, gyroZCorrect,
-				})
+				} else {
+					// Только IMU данные - только предсказание
 
-				// если канал acc - копируем в вектор gyro предыдущие значения
-				// если канал gyro - копируем в вектор acc предыдущие значения
+					// если пришли данные IMU, преобразуем поворот осей Ox, Oy к направлению движения из 45* в 90* и записываем в новый влияющий вектор
+					accXCorrect, accYCorrect, accZCorrect := IMUTransformation_2(data.AccelX, data.AccelY, data.AccelZ)
+					gyroXCorrect, gyroYCorrect, gyroZCorrect := IMUTransformation_2(data.GyroX, data.GyroY, data.GyroZ)
 
-				state, err = f.ekf.Predict(u)
+					// Входной вектор
+					u := mat.NewVecDense(6, []float64{
+						accXCorrect, accYCorrect, accZCorrect,
+						gyroXCorrect, gyroYCorrect, gyroZCorrect,
+					})
 
-				fmt.Printf("\nX_ENU: %f, Y_ENU: %f, Z_ENU: %f\n", state.PositionX, state.PositionY, state.PositionZ)
-			}
+					// если канал acc - копируем в вектор gyro предыдущие значения
+					// если канал gyro - копируем в вектор acc предыдущие значения
 
-			if err != nil {
-				return nil, fmt.Errorf("ошибка на шаге %d: %v", i, err)
-			}
+					state, err = f.ekf.Predict(data.Timestamp, u)
+					if errors.Is(err, ekf.ErrOutOfOrder) {
+						// Отсчет раньше текущего состояния отбрасывается
+						continue
+					}
+				}
 
-			// Устанавливаем временную метку
-			state.Timestamp = data.Timestamp
+				if err != nil {
+					yield(models.EstimatedState{}, fmt.Errorf("ошибка на шаге %d: %v", i, err))
+					return
+				}
 
-			// тут добавим преобразования gnss_ENU в геодезические координаты и перевод кватернионов в углы Эйлера
-			// все формулы уже имеются - ENUToGeodetic и QuaternionToEuler
-			results = append(results, *state)
+				// тут добавим преобразования gnss_ENU в геодезические координаты и перевод кватернионов в углы Эйлера
+				// все формулы уже имеются - ENUToGeodetic и QuaternionToEuler
+				if !yield(*state, nil) {
+					return
+				}
+			}
 		}
 	}
+}
 
-	return results, nil
+// initEKF инициализирует Extended Kalman Filter с начальным состоянием на момент t
+func (f *Fuzzer) initEKF(t time.Time) error {
 
-}
+	// 1. Создаем модель с блоками состояния из конфигурации
+	layout, err := models.NewPositionLayout(f.cfg.EKF.StateBlocks)
+	if err != nil {
+		return fmt.Errorf("ошибка блоков состояния: %v", err)
+	}
+	model := models.NewPositionModel(f.cfg, layout)
 
-// initEKF инициализирует Extended Kalman Filter
-func (f *Fuzzer) initEKF() error {
+	// Проверка аналитических якобианов модели
+	if f.cfg.EKF.JacobianCheck > 0 && f.cfg.EKF.Jacobian != "numeric" {
+		check, err := ekf.ValidateJacobians(model, f.cfg.EKF.JacobianCheck, 1)
+		if err != nil {
+			return fmt.Errorf("ошибка проверки якобианов: %v", err)
+		}
+		if check.MaxF > f.cfg.EKF.JacobianTolerance || check.MaxH > f.cfg.EKF.JacobianTolerance {
+			return fmt.Errorf("аналитические якобианы расходятся с численными: %v", check)
+		}
+	}
 
-	// 1. Создаем модель
-	model := models.NewPositionModel(f.cfg)
+	// Начальное состояние, ковариация и шум процесса по именам блоков;
+	// ESKF: ошибка ориентации - угол из 3 элементов вместо кватерниона
+	initialState, err := layout.Vector(f.cfg.EKF.InitialState.Blocks())
+	if err != nil {
+		return fmt.Errorf("ошибка начального состояния: %v", err)
+	}
+	covariance := layout.Vector
+	if f.cfg.EKF.Filter == ekf.FilterESKF {
+		covariance = layout.ErrorVector
+	}
+	initialCov, err := covariance(f.cfg.EKF.InitialCov.Blocks())
+	if err != nil {
+		return fmt.Errorf("ошибка начальной ковариации: %v", err)
+	}
+	processNoise, err := covariance(f.cfg.EKF.ProcessNoise.Blocks())
+	if err != nil {
+		return fmt.Errorf("ошибка шума процесса: %v", err)
+	}
 
 	// 2. Конфигурация EKF
 	ekfConfig := &ekf.EKFConfig{
-		TimeStep: f.cfg.EKF.TimeStep,
-		InitialState: []float64{
-			f.cfg.EKF.InitialState.Position[0],   // X
-			f.cfg.EKF.InitialState.Position[1],   // Y
-			f.cfg.EKF.InitialState.Position[2],   // Z
-			f.cfg.EKF.InitialState.Velocity[0],   // Vx
-			f.cfg.EKF.InitialState.Velocity[1],   // Vy
-			f.cfg.EKF.InitialState.Velocity[2],   // Vz
-			f.cfg.EKF.InitialState.Quaternion[0], // Qw
-			f.cfg.EKF.InitialState.Quaternion[1], // Qx
-			f.cfg.EKF.InitialState.Quaternion[2], // Qy
-			f.cfg.EKF.InitialState.Quaternion[3], // Qz
-			f.cfg.EKF.InitialState.Bias_acc[0],   // Bias_ax
-			f.cfg.EKF.InitialState.Bias_acc[1],   // Bias_ay
-			f.cfg.EKF.InitialState.Bias_acc[2],   // Bias_az
-			f.cfg.EKF.InitialState.Bias_gyro[0],  // Bias_wx
-			f.cfg.EKF.InitialState.Bias_gyro[1],  // Bias_wy
-			f.cfg.EKF.InitialState.Bias_gyro[2],  // Bias_wz
-		},
-		InitialCov: []float64{
-			f.cfg.EKF.InitialCov.Position[0],   // X
-			f.cfg.EKF.InitialCov.Position[1],   // Y
-			f.cfg.EKF.InitialCov.Position[2],   // Z
-			f.cfg.EKF.InitialCov.Velocity[0],   // Vx
-			f.cfg.EKF.InitialCov.Velocity[1],   // Vy
-			f.cfg.EKF.InitialCov.Velocity[2],   // Vz
-			f.cfg.EKF.InitialCov.Quaternion[0], // Qw
-			f.cfg.EKF.InitialCov.Quaternion[1], // Qx
-			f.cfg.EKF.InitialCov.Quaternion[2], // Qy
-			f.cfg.EKF.InitialCov.Quaternion[3], // Qz
-			f.cfg.EKF.InitialCov.Bias_acc[0],   // Bias_ax
-			f.cfg.EKF.InitialCov.Bias_acc[1],   // Bias_ay
-			f.cfg.EKF.InitialCov.Bias_acc[2],   // Bias_az
-			f.cfg.EKF.InitialCov.Bias_gyro[0],  // Bias_wx
-			f.cfg.EKF.InitialCov.Bias_gyro[1],  // Bias_wy
-			f.cfg.EKF.InitialCov.Bias_gyro[2],  // Bias_wz
-		},
-
-		ProcessNoise: []float64{
-			f.cfg.EKF.ProcessNoise.Position[0],   // X
-			f.cfg.EKF.ProcessNoise.Position[1],   // Y
-			f.cfg.EKF.ProcessNoise.Position[2],   // Z
-			f.cfg.EKF.ProcessNoise.Velocity,      // Vx
-			f.cfg.EKF.ProcessNoise.Velocity,      // Vy
-			f.cfg.EKF.ProcessNoise.Velocity,      // Vz
-			f.cfg.EKF.ProcessNoise.Quaternion[0], // Qw
-			f.cfg.EKF.ProcessNoise.Quaternion[1], // Qx
-			f.cfg.EKF.ProcessNoise.Quaternion[2], // Qy
-			f.cfg.EKF.ProcessNoise.Quaternion[3], // Qz
-			f.cfg.EKF.ProcessNoise.Bias_acc,      // Bias_ax
-			f.cfg.EKF.ProcessNoise.Bias_acc,      // Bias_ay
-			f.cfg.EKF.ProcessNoise.Bias_acc,      // Bias_az
-			f.cfg.EKF.ProcessNoise.Bias_gyro,     // Bias_wx
-			f.cfg.EKF.ProcessNoise.Bias_gyro,     // Bias_wy
-			f.cfg.EKF.ProcessNoise.Bias_gyro,     // Bias_wz
-		},
+		InitialState: initialState,
+		InitialCov:   initialCov,
+		ProcessNoise: processNoise,
 
 		MeasurementNoise: []float64{
 			f.cfg.EKF.MeasurementNoise.Position_GNSS[0], // GNSS_X
@@ -254,13 +296,69 @@ func (f *Fuzzer) initEKF() error {
 		},
 	}
 
-	// 3. Создаем EKF
-	ekfWrapper, err := ekf.NewEKFWrapper(model, ekfConfig)
+	ekfConfig.MaxTimeStep = f.cfg.EKF.MaxTimeStep
+	ekfConfig.Filter = f.cfg.EKF.Filter
+
+	ekfConfig.SigmaPoints = ekf.SigmaPointConfig{
+		Alpha: f.cfg.EKF.UKF.Alpha,
+		Beta:  f.cfg.EKF.UKF.Beta,
+		Kappa: f.cfg.EKF.UKF.Kappa,
+	}
+
+	ekfConfig.NumericJacobian = f.cfg.EKF.Jacobian == "numeric"
+	ekfConfig.CovarianceForm = f.cfg.EKF.Covariance.Form
+	ekfConfig.MinEigenvalue = f.cfg.EKF.Covariance.MinEigenvalue
+	ekfConfig.Seed = f.cfg.EKF.Simulation.Seed
+	ekfConfig.StartTime = t
+	ekfConfig.History = f.cfg.EKF.History
+	if f.cfg.EKF.Diagnostics.Enabled {
+		ekfConfig.DiagnosticsWindow = f.cfg.EKF.Diagnostics.Window
+		ekfConfig.DiagnosticsProbability = f.cfg.EKF.Diagnostics.Probability
+		ekfConfig.DiagnosticsOutput = f.diagnosticsOutput
+	}
+	ekfConfig.Smoother = f.cfg.EKF.Smoother.Enabled
+	ekfConfig.SmootherLag = f.cfg.EKF.Smoother.Lag
+	if an := f.cfg.EKF.AdaptiveNoise; an.Enabled {
+		ekfConfig.AdaptiveNoise = &ekf.AdaptiveNoiseConfig{
+			Forgetting: an.Forgetting,
+			Q:          an.Q,
+			R:          an.R,
+			QBounds:    an.QBounds,
+			RBounds:    an.RBounds,
+			Output:     f.adaptiveNoiseOutput,
+		}
+	}
+
+	// 3. Создаем EKF (с IMM - фильтр для каждого режима движения)
+	var fusion ekf.FusionFilter
+	if imm := f.cfg.EKF.IMM; imm.Enabled {
+		immConfig := &ekf.IMMConfig{Transition: imm.Transition, Initial: imm.Initial, Output: f.immOutput}
+		for _, mode := range imm.Modes {
+			immConfig.Modes = append(immConfig.Modes, ekf.IMMMode{Name: mode.Name, ProcessNoiseScale: mode.ProcessNoiseScale})
+		}
+		newModel := func() filter.Model { return models.NewPositionModel(f.cfg, layout) }
+		fusion, err = ekf.NewIMM(newModel, ekfConfig, immConfig)
+	} else {
+		fusion, err = ekf.NewEKFWrapper(model, ekfConfig)
+	}
 	if err != nil {
 		return fmt.Errorf("ошибка инициализации EKF: %v", err)
 	}
 
-	f.ekf = ekfWrapper
+	// Моделирование: фильтр работает по эталону с шумом процесса и синтезированным измерениям
+	if f.cfg.EKF.Simulation.Enabled {
+		fusion, err = ekf.NewSimulator(models.NewPositionModel(f.cfg, layout), fusion, ekfConfig)
+		if err != nil {
+			return fmt.Errorf("ошибка инициализации моделирования: %v", err)
+		}
+	}
+
+	// 4. Регистрируем модели измерений
+	if err := f.registerMeasurements(fusion, layout); err != nil {
+		return fmt.Errorf("ошибка инициализации EKF: %v", err)
+	}
+
+	f.ekf = fusion
 
 	return nil
 }
@@ -270,7 +368,7 @@ func (f *Fuzzer) initState(data models.SynchronizedData) error {
 
 	// Инициализировать начальное состояние
 
-	gnssX_ENU, gnssY_ENU, gnssZ_ENU := GeodeticToENU(data.Latitude, data.Longitude, data.Altitude, f.cfg)
+	gnssX_ENU, gnssY_ENU, gnssZ_ENU := GeodeticToENU(data.Latitude, data.Longitude, f.altitude(data), f.cfg)
 
 	// Оценка перемещения
 	f.cfg.EKF.InitialState.Position[0] = gnssX_ENU
@@ -278,12 +376,21 @@ func (f *Fuzzer) initState(data models.SynchronizedData) error {
 	f.cfg.EKF.InitialState.Position[2] = gnssZ_ENU
 
 	// Оценка скорости (только по координатам GNSS)
-	dt := float64(time.Since(f.lastTimeGNSS).Nanoseconds()) / 1e9
-	//dt := f.nextTimeGNSS - f.lastTimeGNSS // для отладки
+	dt := data.Timestamp.Sub(f.lastTimeGNSS).Seconds()
+	if dt <= 0 && f.cfg.Sensors.GNSS.Frequency > 0 {
+		dt = 1 / f.cfg.Sensors.GNSS.Frequency
+	}
 
-	f.cfg.EKF.InitialState.Velocity[0] = gnssX_ENU / dt
-	f.cfg.EKF.InitialState.Velocity[1] = gnssY_ENU / dt
-	f.cfg.EKF.InitialState.Velocity[2] = gnssZ_ENU / dt
+	if dt > 0 {
+		f.cfg.EKF.InitialState.Velocity[0] = gnssX_ENU / dt
+		f.cfg.EKF.InitialState.Velocity[1] = gnssY_ENU / dt
+		f.cfg.EKF.InitialState.Velocity[2] = gnssZ_ENU / dt
+	} else {
+		// Интервал между отсчетами GNSS неизвестен - начальная скорость нулевая
+		f.cfg.EKF.InitialState.Velocity[0] = 0
+		f.cfg.EKF.InitialState.Velocity[1] = 0
+		f.cfg.EKF.InitialState.Velocity[2] = 0
+	}
 
 	// Оценка кватерниона
 	// усредненое ускорение или ускорения из последних отсчетов
@@ -0,0 +1,55 @@
+package fuzzer
+
+import (
+	"main.go/internal/models"
+)
+
+// positionNoise формирует диагональ R для позиции GNSS (E, N, U) по оценкам точности приемника.
+// СКО ограничивается границами из конфигурации; при неизвестной точности берется фиксированный шум.
+func (f *Fuzzer) positionNoise(data models.SynchronizedData) []float64 {
+	mn := f.cfg.EKF.MeasurementNoise
+
+	return []float64{
+		adaptiveVariance(data.HorizontalAccuracy, sigmaBound(mn.Position_Sigma_Min, 0), sigmaBound(mn.Position_Sigma_Max, 0), mn.Position_GNSS[0]),
+		adaptiveVariance(data.HorizontalAccuracy, sigmaBound(mn.Position_Sigma_Min, 1), sigmaBound(mn.Position_Sigma_Max, 1), mn.Position_GNSS[1]),
+		adaptiveVariance(data.VerticalAccuracy, sigmaBound(mn.Position_Sigma_Min, 2), sigmaBound(mn.Position_Sigma_Max, 2), mn.Position_GNSS[2]),
+	}
+}
+
+// speedNoise возвращает дисперсию скорости GNSS по оценке точности приемника
+func (f *Fuzzer) speedNoise(data models.SynchronizedData) []float64 {
+	mn := f.cfg.EKF.MeasurementNoise
+
+	return []float64{adaptiveVariance(data.SpeedAccuracy, mn.Speed_Sigma_Min, mn.Speed_Sigma_Max, mn.Speed)}
+}
+
+// headingNoise возвращает дисперсию курса GNSS (рад²) по оценке точности направления (градусы)
+func (f *Fuzzer) headingNoise(data models.SynchronizedData) []float64 {
+	mn := f.cfg.EKF.MeasurementNoise
+
+	return []float64{adaptiveVariance(DegreesToRadians(data.BearingAccuracy),
+		DegreesToRadians(mn.Heading_Min), DegreesToRadians(mn.Heading_Max), mn.Heading)}
+}
+
+// adaptiveVariance возвращает дисперсию по СКО sigma, ограниченному [min, max] (0 - без границы).
+// Если СКО неизвестно (не положительно), возвращается fallback.
+func adaptiveVariance(sigma, min, max, fallback float64) float64 {
+	if sigma <= 0 {
+		return fallback
+	}
+	if min > 0 && sigma < min {
+		sigma = min
+	}
+	if max > 0 && sigma > max {
+		sigma = max
+	}
+	return sigma * sigma
+}
+
+// sigmaBound возвращает i-ю границу СКО или 0, если она не задана
+func sigmaBound(bounds []float64, i int) float64 {
+	if i < len(bounds) {
+		return bounds[i]
+	}
+	return 0
+}
@@ -0,0 +1,162 @@
+package fuzzer
+
+import (
+	"io"
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+	"main.go/internal/ekf"
+	"main.go/internal/models"
+)
+
+// registerMeasurements регистрирует в фильтре модели измерений GNSS для блоков состояния layout
+// с шумом и проверкой невязки из конфигурации
+func (f *Fuzzer) registerMeasurements(filter ekf.FusionFilter, layout *models.StateLayout) error {
+	mn := f.cfg.EKF.MeasurementNoise
+
+	measurements := []struct {
+		typ   string
+		model ekf.MeasurementModel
+		noise []float64
+	}{
+		{models.MeasurementPosition, models.NewPositionMeasurement(layout), mn.Position_GNSS},
+		{models.MeasurementHorizontalPosition, models.NewHorizontalPositionMeasurement(layout), mn.Position_GNSS[:2]},
+		{models.MeasurementSpeed, models.NewSpeedMeasurement(layout), []float64{mn.Speed}},
+		{models.MeasurementHeading, models.NewHeadingMeasurement(layout), []float64{mn.Heading}},
+	}
+
+	gating := f.cfg.EKF.Gating
+	for _, m := range measurements {
+		if err := filter.RegisterMeasurement(m.typ, m.model, m.noise); err != nil {
+			return err
+		}
+
+		if gating.Policy == "" || gating.Policy == ekf.GateOff {
+			continue
+		}
+		gate, err := ekf.NewGate(gating.Policy, gating.Probability, m.model.Dim())
+		if err != nil {
+			return err
+		}
+		if threshold, ok := gating.Thresholds[m.typ]; ok {
+			gate.Threshold = threshold
+		}
+		if err := filter.SetGate(m.typ, gate); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rejected возвращает число измерений, отброшенных проверкой невязки, по типам
+func (f *Fuzzer) Rejected() map[string]int {
+	if f.ekf == nil {
+		return nil
+	}
+	return f.ekf.Rejected()
+}
+
+// CovarianceHealth возвращает диагностику ковариации фильтра
+func (f *Fuzzer) CovarianceHealth() (ekf.CovarianceHealth, bool) {
+	if f.ekf == nil {
+		return ekf.CovarianceHealth{}, false
+	}
+	return f.ekf.CovarianceHealth(), true
+}
+
+// AdaptiveNoise возвращает адаптацию шумов фильтра (nil - выключена)
+func (f *Fuzzer) AdaptiveNoise() *ekf.NoiseAdapter {
+	if f.ekf == nil {
+		return nil
+	}
+	return f.ekf.AdaptiveNoise()
+}
+
+// IMM возвращает фильтр с взаимодействующими моделями (nil - IMM выключен)
+func (f *Fuzzer) IMM() *ekf.IMM {
+	filter := f.ekf
+	if sim, ok := filter.(*ekf.Simulator); ok {
+		filter = sim.FusionFilter
+	}
+	imm, _ := filter.(*ekf.IMM)
+	return imm
+}
+
+// Diagnostics возвращает диагностику согласованности фильтра (nil - выключена)
+func (f *Fuzzer) Diagnostics() *ekf.Diagnostics {
+	if f.ekf == nil {
+		return nil
+	}
+	return f.ekf.Diagnostics()
+}
+
+// SetDiagnosticsOutput задает таблицу CSV, в которую диагностика выводит записи по мере обработки.
+// Вызывается до создания фильтра (до обработки и загрузки контрольной точки).
+func (f *Fuzzer) SetDiagnosticsOutput(w io.Writer) {
+	f.diagnosticsOutput = w
+}
+
+// SetAdaptiveNoiseOutput задает таблицу CSV, в которую адаптация шумов выводит значения по мере обработки.
+// Вызывается до создания фильтра.
+func (f *Fuzzer) SetAdaptiveNoiseOutput(w io.Writer) {
+	f.adaptiveNoiseOutput = w
+}
+
+// SetIMMOutput задает таблицу CSV, в которую IMM выводит вероятности режимов по мере обработки.
+// Вызывается до создания фильтра.
+func (f *Fuzzer) SetIMMOutput(w io.Writer) {
+	f.immOutput = w
+}
+
+// measurements формирует измерения эпохи GNSS, включенные в конфигурации, только из пришедших полей.
+// Без высоты позиция используется в плане; курс - только при известной скорости не ниже heading_min_speed.
+func (f *Fuzzer) measurements(data models.SynchronizedData) []ekf.Measurement {
+	enabled := f.cfg.EKF.Measurements
+	adaptive := f.cfg.EKF.MeasurementNoise.Adaptive
+
+	var z []ekf.Measurement
+
+	if enabled.Position {
+		e, n, u := GeodeticToENU(data.Latitude, data.Longitude, f.altitude(data), f.cfg)
+		m := ekf.Measurement{Type: models.MeasurementPosition, Z: mat.NewVecDense(3, []float64{e, n, u})}
+		if adaptive {
+			m.R = f.positionNoise(data)
+		}
+		if !data.HasAltitude {
+			m.Type, m.Z = models.MeasurementHorizontalPosition, mat.NewVecDense(2, []float64{e, n})
+			if m.R != nil {
+				m.R = m.R[:2]
+			}
+		}
+		z = append(z, m)
+	}
+
+	if enabled.Speed && data.HasSpeed {
+		m := ekf.Measurement{Type: models.MeasurementSpeed, Z: mat.NewVecDense(1, []float64{data.Speed})}
+		if adaptive {
+			m.R = f.speedNoise(data)
+		}
+		z = append(z, m)
+	}
+
+	moving := data.HasSpeed && math.Abs(data.Speed) >= enabled.HeadingMinSpeed
+	if enabled.Heading && data.HasHeading && (moving || enabled.HeadingMinSpeed <= 0) {
+		heading := models.WrapAngle(DegreesToRadians(data.Heading))
+		m := ekf.Measurement{Type: models.MeasurementHeading, Z: mat.NewVecDense(1, []float64{heading})}
+		if adaptive {
+			m.R = f.headingNoise(data)
+		}
+		z = append(z, m)
+	}
+
+	return z
+}
+
+// altitude возвращает высоту отсчета GNSS, а если высота не пришла - высоту опорной точки
+func (f *Fuzzer) altitude(data models.SynchronizedData) float64 {
+	if data.HasAltitude {
+		return data.Altitude
+	}
+	return f.cfg.Sensors.GNSS.ReferenceAltitude
+}
@@ -0,0 +1,218 @@
+package models
+
+import "fmt"
+
+// Блоки вектора состояния навигации (имена совпадают с ключами initial_state, initial_covariance, process_noise)
+const (
+	BlockPosition   = "position"   // Позиция ENU (м)
+	BlockVelocity   = "velocity"   // Скорость ENU (м/с)
+	BlockQuaternion = "quaternion" // Ориентация объекта (w, x, y, z)
+	BlockBiasAcc    = "bias_acc"   // Смещения акселерометров (м/с²)
+	BlockBiasGyro   = "bias_gyro"  // Смещения гироскопов (рад/с)
+
+	BlockAngle = "angle" // Ошибка ориентации в пространстве ошибки (eskf) вместо кватерниона
+)
+
+// StateBlock именованный блок вектора состояния
+type StateBlock struct {
+	Name      string
+	Size      int
+	ErrorName string // Имя блока в пространстве ошибки (пусто - совпадает с Name)
+	ErrorSize int    // Размерность в пространстве ошибки (0 - равна Size)
+}
+
+// navigationBlocks блоки состояния навигации в порядке по умолчанию
+var navigationBlocks = []StateBlock{
+	{Name: BlockPosition, Size: 3},
+	{Name: BlockVelocity, Size: 3},
+	{Name: BlockQuaternion, Size: 4, ErrorName: BlockAngle, ErrorSize: 3},
+	{Name: BlockBiasAcc, Size: 3},
+	{Name: BlockBiasGyro, Size: 3},
+}
+
+// StateLayout расположение именованных блоков в векторе состояния и в пространстве ошибки
+type StateLayout struct {
+	blocks       []StateBlock
+	offsets      []int
+	errorOffsets []int
+	dim          int
+	errorDim     int
+}
+
+// NewStateLayout создает расположение состояния из блоков в заданном порядке
+func NewStateLayout(blocks ...StateBlock) (*StateLayout, error) {
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("состояние без блоков")
+	}
+
+	l := &StateLayout{}
+	for _, b := range blocks {
+		if b.Name == "" || b.Size <= 0 || b.ErrorSize < 0 {
+			return nil, fmt.Errorf("неверный блок состояния %q размерности %d", b.Name, b.Size)
+		}
+		if l.Has(b.Name) {
+			return nil, fmt.Errorf("повторный блок состояния %q", b.Name)
+		}
+		if b.ErrorName == "" {
+			b.ErrorName = b.Name
+		}
+		if b.ErrorSize == 0 {
+			b.ErrorSize = b.Size
+		}
+
+		l.blocks = append(l.blocks, b)
+		l.offsets = append(l.offsets, l.dim)
+		l.errorOffsets = append(l.errorOffsets, l.errorDim)
+		l.dim += b.Size
+		l.errorDim += b.ErrorSize
+	}
+
+	return l, nil
+}
+
+// NavigationLayout возвращает состояние навигации по умолчанию:
+// [x, y, z, vx, vy, vz, qw, qx, qy, qz, bias_ax, bias_ay, bias_az, bias_wx, bias_wy, bias_wz]
+func NavigationLayout() *StateLayout {
+	l, _ := NewStateLayout(navigationBlocks...)
+	return l
+}
+
+// NavigationLayoutOf возвращает состояние из блоков навигации с заданными именами (пусто - все блоки)
+func NavigationLayoutOf(names []string) (*StateLayout, error) {
+	if len(names) == 0 {
+		return NavigationLayout(), nil
+	}
+
+	blocks := make([]StateBlock, 0, len(names))
+	for _, name := range names {
+		b, ok := navigationBlock(name)
+		if !ok {
+			return nil, fmt.Errorf("неизвестный блок состояния %q", name)
+		}
+		blocks = append(blocks, b)
+	}
+	return NewStateLayout(blocks...)
+}
+
+func navigationBlock(name string) (StateBlock, bool) {
+	for _, b := range navigationBlocks {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return StateBlock{}, false
+}
+
+// Dim возвращает размерность состояния
+func (l *StateLayout) Dim() int {
+	return l.dim
+}
+
+// ErrorDim возвращает размерность пространства ошибки
+func (l *StateLayout) ErrorDim() int {
+	return l.errorDim
+}
+
+// Blocks возвращает блоки состояния по порядку
+func (l *StateLayout) Blocks() []StateBlock {
+	return append([]StateBlock(nil), l.blocks...)
+}
+
+// Has сообщает, есть ли в состоянии блок name
+func (l *StateLayout) Has(name string) bool {
+	return l.find(name) >= 0
+}
+
+// Offset возвращает индекс первого элемента блока в состоянии (-1 - блока нет)
+func (l *StateLayout) Offset(name string) int {
+	if i := l.find(name); i >= 0 {
+		return l.offsets[i]
+	}
+	return -1
+}
+
+// ErrorOffset возвращает индекс первого элемента блока в пространстве ошибки (-1 - блока нет)
+func (l *StateLayout) ErrorOffset(name string) int {
+	if i := l.find(name); i >= 0 {
+		return l.errorOffsets[i]
+	}
+	return -1
+}
+
+// With возвращает состояние с блоками, добавленными в конец
+func (l *StateLayout) With(blocks ...StateBlock) (*StateLayout, error) {
+	return NewStateLayout(append(l.Blocks(), blocks...)...)
+}
+
+// Without возвращает состояние без блоков с заданными именами
+func (l *StateLayout) Without(names ...string) (*StateLayout, error) {
+	blocks := l.Blocks()
+	for _, name := range names {
+		i := l.find(name)
+		if i < 0 {
+			return nil, fmt.Errorf("нет блока состояния %q", name)
+		}
+		blocks[i].Name = ""
+	}
+
+	kept := blocks[:0]
+	for _, b := range blocks {
+		if b.Name != "" {
+			kept = append(kept, b)
+		}
+	}
+	return NewStateLayout(kept...)
+}
+
+// Vector собирает вектор состояния из значений по именам блоков.
+// Одно значение задает все элементы блока.
+func (l *StateLayout) Vector(values map[string][]float64) ([]float64, error) {
+	v := make([]float64, 0, l.dim)
+	for _, b := range l.blocks {
+		block, err := blockValues(values, b.Name, b.Size)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, block...)
+	}
+	return v, nil
+}
+
+// ErrorVector собирает вектор в пространстве ошибки из значений по именам блоков ошибки
+func (l *StateLayout) ErrorVector(values map[string][]float64) ([]float64, error) {
+	v := make([]float64, 0, l.errorDim)
+	for _, b := range l.blocks {
+		block, err := blockValues(values, b.ErrorName, b.ErrorSize)
+		if err != nil {
+			return nil, err
+		}
+		v = append(v, block...)
+	}
+	return v, nil
+}
+
+func (l *StateLayout) find(name string) int {
+	for i, b := range l.blocks {
+		if b.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func blockValues(values map[string][]float64, name string, size int) ([]float64, error) {
+	v, ok := values[name]
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("нет значений блока %q", name)
+	case len(v) == 1 && size > 1:
+		block := make([]float64, size)
+		for i := range block {
+			block[i] = v[0]
+		}
+		return block, nil
+	case len(v) != size:
+		return nil, fmt.Errorf("блок %q: %d значений вместо %d", name, len(v), size)
+	}
+	return v, nil
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// Типы измерений, для которых регистрируются модели
+const (
+	MeasurementPosition           = "position"            // Позиция GNSS в ENU (м)
+	MeasurementHorizontalPosition = "horizontal_position" // Позиция GNSS в плане (E, N) без высоты (м)
+	MeasurementSpeed              = "speed"               // Скорость вдоль продольной оси объекта (м/с)
+	MeasurementHeading            = "heading"             // Курс продольной оси объекта от севера по часовой стрелке (рад)
+)
+
+// PositionMeasurement модель измерения позиции GNSS: y = [x, y, z]
+type PositionMeasurement struct {
+	pos int // Индекс позиции в состоянии
+}
+
+// NewPositionMeasurement создает модель измерения позиции для состояния layout
+func NewPositionMeasurement(layout *StateLayout) PositionMeasurement {
+	return PositionMeasurement{pos: layout.Offset(BlockPosition)}
+}
+
+// Dim возвращает размерность измерения
+func (PositionMeasurement) Dim() int { return 3 }
+
+// Observe возвращает ожидаемое измерение в состоянии x
+func (m PositionMeasurement) Observe(x mat.Vector) (mat.Vector, error) {
+	p := block3(x, m.pos)
+	return mat.NewVecDense(3, p[:]), nil
+}
+
+// Jacobian возвращает якобиан ∂Observe/∂x
+func (m PositionMeasurement) Jacobian(x mat.Vector) (*mat.Dense, error) {
+	H := mat.NewDense(3, x.Len(), nil)
+	for i := 0; i < 3; i++ {
+		H.Set(i, m.pos+i, 1)
+	}
+	return H, nil
+}
+
+// Residual возвращает невязку z - y
+func (PositionMeasurement) Residual(z, y mat.Vector) *mat.VecDense {
+	return subtract(z, y)
+}
+
+// HorizontalPositionMeasurement модель измерения позиции GNSS в плане: y = [x, y]
+type HorizontalPositionMeasurement struct {
+	pos int // Индекс позиции в состоянии
+}
+
+// NewHorizontalPositionMeasurement создает модель измерения позиции в плане для состояния layout
+func NewHorizontalPositionMeasurement(layout *StateLayout) HorizontalPositionMeasurement {
+	return HorizontalPositionMeasurement{pos: layout.Offset(BlockPosition)}
+}
+
+// Dim возвращает размерность измерения
+func (HorizontalPositionMeasurement) Dim() int { return 2 }
+
+// Observe возвращает ожидаемое измерение в состоянии x
+func (m HorizontalPositionMeasurement) Observe(x mat.Vector) (mat.Vector, error) {
+	p := block3(x, m.pos)
+	return mat.NewVecDense(2, p[:2]), nil
+}
+
+// Jacobian возвращает якобиан ∂Observe/∂x
+func (m HorizontalPositionMeasurement) Jacobian(x mat.Vector) (*mat.Dense, error) {
+	H := mat.NewDense(2, x.Len(), nil)
+	for i := 0; i < 2; i++ {
+		H.Set(i, m.pos+i, 1)
+	}
+	return H, nil
+}
+
+// Residual возвращает невязку z - y
+func (HorizontalPositionMeasurement) Residual(z, y mat.Vector) *mat.VecDense {
+	return subtract(z, y)
+}
+
+// SpeedMeasurement модель измерения скорости спидометра: компонента Y скорости в системе объекта
+type SpeedMeasurement struct {
+	vel, att int // Индексы скорости и кватерниона в состоянии
+}
+
+// NewSpeedMeasurement создает модель измерения скорости для состояния layout
+func NewSpeedMeasurement(layout *StateLayout) SpeedMeasurement {
+	return SpeedMeasurement{vel: layout.Offset(BlockVelocity), att: layout.Offset(BlockQuaternion)}
+}
+
+// Dim возвращает размерность измерения
+func (SpeedMeasurement) Dim() int { return 1 }
+
+// Observe возвращает ожидаемое измерение в состоянии x
+func (m SpeedMeasurement) Observe(x mat.Vector) (mat.Vector, error) {
+	// q_c : ENU -> объект
+	qc := conjugate(quaternionAt(x, m.att))
+	v := rotateVectorByQuaternion(block3(x, m.vel), qc)
+
+	return mat.NewVecDense(1, []float64{v[1]}), nil
+}
+
+// Jacobian возвращает якобиан ∂Observe/∂x
+func (m SpeedMeasurement) Jacobian(x mat.Vector) (*mat.Dense, error) {
+	H := mat.NewDense(1, x.Len(), nil)
+
+	v := block3(x, m.vel)
+	qc := conjugate(quaternionAt(x, m.att))
+
+	M := rotationMatrix(qc)
+	for j := 0; j < 3; j++ {
+		H.Set(0, m.vel+j, M[1][j])
+	}
+
+	// ∂q_c/∂q = diag(1, -1, -1, -1)
+	dMv := rotationMatrixDerivative(qc, v)
+	sign := [4]float64{1, -1, -1, -1}
+	for k := 0; k < 4; k++ {
+		H.Set(0, m.att+k, sign[k]*dMv[1][k])
+	}
+
+	return H, nil
+}
+
+// Residual возвращает невязку z - y
+func (SpeedMeasurement) Residual(z, y mat.Vector) *mat.VecDense {
+	return subtract(z, y)
+}
+
+// HeadingMeasurement модель измерения курса: направление продольной оси объекта (Y) в ENU,
+// отсчитываемое от севера по часовой стрелке, atan2(E, N)
+type HeadingMeasurement struct {
+	att int // Индекс кватерниона в состоянии
+}
+
+// NewHeadingMeasurement создает модель измерения курса для состояния layout
+func NewHeadingMeasurement(layout *StateLayout) HeadingMeasurement {
+	return HeadingMeasurement{att: layout.Offset(BlockQuaternion)}
+}
+
+// Dim возвращает размерность измерения
+func (HeadingMeasurement) Dim() int { return 1 }
+
+// Observe возвращает ожидаемое измерение в состоянии x
+func (m HeadingMeasurement) Observe(x mat.Vector) (mat.Vector, error) {
+	e, n := headingAxis(quaternionAt(x, m.att))
+	return mat.NewVecDense(1, []float64{math.Atan2(e, n)}), nil
+}
+
+// Jacobian возвращает якобиан ∂Observe/∂x
+func (m HeadingMeasurement) Jacobian(x mat.Vector) (*mat.Dense, error) {
+	H := mat.NewDense(1, x.Len(), nil)
+
+	q := quaternionAt(x, m.att)
+	w, qx, qy, qz := q.W, q.X, q.Y, q.Z
+	e, n := headingAxis(q)
+	d := e*e + n*n
+	if d < 1e-12 {
+		// Продольная ось вертикальна - курс не определен
+		return H, nil
+	}
+
+	// ∂E/∂q, ∂N/∂q по (w, x, y, z)
+	de := [4]float64{-2 * qz, 2 * qy, 2 * qx, -2 * w}
+	dn := [4]float64{2 * w, -2 * qx, 2 * qy, -2 * qz}
+	for k := 0; k < 4; k++ {
+		H.Set(0, m.att+k, (n*de[k]-e*dn[k])/d)
+	}
+
+	return H, nil
+}
+
+// Residual возвращает невязку z - y, приведенную к (-π, π]
+func (HeadingMeasurement) Residual(z, y mat.Vector) *mat.VecDense {
+	r := subtract(z, y)
+	r.SetVec(0, WrapAngle(r.AtVec(0)))
+	return r
+}
+
+// headingAxis возвращает компоненты E и N продольной оси объекта (Y) в ENU для ориентации q
+func headingAxis(q Quaternion) (float64, float64) {
+	w, qx, qy, qz := q.W, q.X, q.Y, q.Z
+	return 2 * (qx*qy - w*qz), w*w - qx*qx + qy*qy - qz*qz
+}
+
+// WrapAngle приводит угол (рад) к диапазону (-π, π]
+func WrapAngle(a float64) float64 {
+	a = math.Mod(a+math.Pi, 2*math.Pi)
+	if a <= 0 {
+		a += 2 * math.Pi
+	}
+	return a - math.Pi
+}
+
+func subtract(z, y mat.Vector) *mat.VecDense {
+	r := mat.NewVecDense(z.Len(), nil)
+	r.SubVec(z, y)
+	return r
+}
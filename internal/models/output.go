@@ -0,0 +1,101 @@
+package models
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+// CSVTable таблица CSV, строки которой не накапливаются в памяти, а выводятся по мере поступления.
+// Первая ошибка записи сохраняется: следующие строки не выводятся, ошибка возвращается из Err и Flush.
+type CSVTable struct {
+	name string // Содержимое таблицы для сообщений об ошибках (родительный падеж)
+	out  *csv.Writer
+	err  error
+}
+
+// NewCSVTable создает таблицу name в w и записывает заголовок header. Если w - непустой файл
+// (таблица дописывается при продолжении с контрольной точки), заголовок не повторяется.
+func NewCSVTable(w io.Writer, name string, header []string) (*CSVTable, error) {
+	t := &CSVTable{name: name, out: csv.NewWriter(w)}
+	if f, ok := w.(interface{ Stat() (fs.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			return t, nil
+		}
+	}
+	if err := t.out.Write(header); err != nil {
+		return nil, fmt.Errorf("ошибка записи заголовка %s: %v", name, err)
+	}
+	return t, nil
+}
+
+// Write выводит строку; ошибка сохраняется до Flush
+func (t *CSVTable) Write(row []string) {
+	if t.err != nil {
+		return
+	}
+	if err := t.out.Write(row); err != nil {
+		t.err = fmt.Errorf("ошибка записи %s: %v", t.name, err)
+	}
+}
+
+// Err возвращает первую ошибку вывода
+func (t *CSVTable) Err() error {
+	return t.err
+}
+
+// Flush дописывает буферизованные строки и возвращает первую ошибку вывода
+func (t *CSVTable) Flush() error {
+	t.out.Flush()
+	if t.err != nil {
+		return t.err
+	}
+	if err := t.out.Error(); err != nil {
+		return fmt.Errorf("ошибка записи %s: %v", t.name, err)
+	}
+	return nil
+}
+
+// StateWriter выводит оценки состояния в таблицу CSV
+type StateWriter struct {
+	out *CSVTable
+}
+
+// NewStateWriter создает таблицу оценок состояния и записывает ее заголовок
+func NewStateWriter(w io.Writer) (*StateWriter, error) {
+	header := []string{
+		"time", "x", "y", "z", "qw", "qx", "qy", "qz",
+		"var_x", "var_y", "var_z", "var_qw", "var_qx", "var_qy", "var_qz",
+	}
+	out, err := NewCSVTable(w, "таблицы состояний", header)
+	if err != nil {
+		return nil, err
+	}
+	return &StateWriter{out: out}, nil
+}
+
+// Write выводит оценку состояния
+func (s *StateWriter) Write(state *EstimatedState) error {
+	values := []float64{
+		state.PositionX, state.PositionY, state.PositionZ,
+		state.QuaternionW, state.QuaternionX, state.QuaternionY, state.QuaternionZ,
+		state.CovarianceXX, state.CovarianceYY, state.CovarianceZZ,
+		state.CovarianceQwQw, state.CovarianceQxQx, state.CovarianceQyQy, state.CovarianceQzQz,
+	}
+
+	record := make([]string, 0, 1+len(values))
+	record = append(record, state.Timestamp.Format(time.RFC3339Nano))
+	for _, v := range values {
+		record = append(record, strconv.FormatFloat(v, 'g', 10, 64))
+	}
+	s.out.Write(record)
+	return s.out.Err()
+}
+
+// Flush дописывает буферизованные строки и возвращает ошибку вывода
+func (s *StateWriter) Flush() error {
+	return s.out.Flush()
+}
@@ -1,7 +1,7 @@
 package models
 
 import (
-	"time" // для реального случая
+	"fmt"
 
 	"gonum.org/v1/gonum/mat"
 	"main.go/config"
@@ -9,71 +9,102 @@ import (
 
 // PositionModel реализует модель для EKF
 type PositionModel struct {
-	stateDim  int // Размерность состояния
-	inputDim  int // Размерность входа
-	outputDim int // Размерность выхода
+	layout    *StateLayout // Блоки состояния
+	inputDim  int          // Размерность входа
+	outputDim int          // Размерность выхода
+
+	// Индексы блоков в состоянии (-1 - блок смещений отсутствует)
+	pos, vel, att     int
+	biasAcc, biasGyro int
 
 	config *config.Config
 
 	// Вспомогательные переменные
 	gravity float64
 
-	LastTimeIMU time.Time // последнее обновление IMU // для реального случая
-	dT          float64
+	dT float64 // Шаг интегрирования (с), задается по временным меткам данных
+}
+
+// NewPositionLayout возвращает блоки состояния модели позиционирования по именам (пусто - все блоки навигации).
+// Позиция, скорость и кватернион обязательны, смещения датчиков можно исключить.
+func NewPositionLayout(names []string) (*StateLayout, error) {
+	layout, err := NavigationLayoutOf(names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{BlockPosition, BlockVelocity, BlockQuaternion} {
+		if !layout.Has(name) {
+			return nil, fmt.Errorf("в состоянии нет обязательного блока %q", name)
+		}
+	}
+	return layout, nil
 }
 
-// NewPositionModel создает новую модель позиционирования
-func NewPositionModel(cfg *config.Config) *PositionModel {
+// NewPositionModel создает новую модель позиционирования с блоками состояния layout
+// (nil - состояние навигации по умолчанию). Блоки, неизвестные модели, в прогнозе не изменяются.
+func NewPositionModel(cfg *config.Config, layout *StateLayout) *PositionModel {
+	if layout == nil {
+		layout = NavigationLayout()
+	}
 	return &PositionModel{
-		stateDim:  cfg.EKF.StateSize,       // [x, y, z, vx, vy, vz, qw, qx, qy, qz, bias_ax, bias_ay, bias_az, bias_wx, bias_wy, bias_wz] 		// n: размер состояния
+		layout:    layout,
 		inputDim:  6,                       // [ax_measured, ay_measured, az_measured, wx_measured, wy_measured, wz_measured] 					// p: размер управления (ax, ay, az, wx, wy, wz, dt)
 		outputDim: cfg.EKF.MeasurementSize, // [x_measured, y_measured, z_measured, v_measured] // m: размер измерений
 		gravity:   9.81,
 
-		LastTimeIMU: time.Now(), // последнее обновление IMU // для реального случая
-		dT:          0,          // период обновления IMU // Для отладки
+		pos:      layout.Offset(BlockPosition),
+		vel:      layout.Offset(BlockVelocity),
+		att:      layout.Offset(BlockQuaternion),
+		biasAcc:  layout.Offset(BlockBiasAcc),
+		biasGyro: layout.Offset(BlockBiasGyro),
+
+		dT: cfg.EKF.TimeStep,
 	}
 }
 
-// updateData актуализирует время обновления данных
-func (m *PositionModel) UpdateData() {
-	//m.dT = 1 / 10.0 // для отладки !!!!! ввести свою частоту IMU
-	m.dT = float64(time.Since(m.LastTimeIMU).Nanoseconds()) / 1e9 // для реального случая
-	m.LastTimeIMU = time.Now()                                    // для реального случая
+// Layout возвращает блоки состояния модели
+func (m *PositionModel) Layout() *StateLayout {
+	return m.layout
+}
+
+// DT возвращает текущий шаг интегрирования (с)
+func (m *PositionModel) DT() float64 {
+	return m.dT
+}
+
+// SetDT задает шаг интегрирования (с) перед предсказанием
+func (m *PositionModel) SetDT(dt float64) {
+	m.dT = dt
 }
 
 // SystemDims возвращает размерности системы
 func (m *PositionModel) SystemDims() (int, int, int, int) {
-	return m.stateDim, m.inputDim, m.outputDim, 0
+	return m.layout.Dim(), m.inputDim, m.outputDim, 0
 }
 
 // Propagate предсказывает следующее состояние
 func (m *PositionModel) Propagate(x, u, w mat.Vector) (mat.Vector, error) {
-	// x: [x, y, z, vx, vy, vz, roll, pitch, yaw, ax_bias, ay_bias, az_bias, wx_bias, wy_bias, wz_bias]
+	// x: блоки состояния layout (position, velocity, quaternion, bias_acc, bias_gyro)
 	// u: [ax, ay, az, wx, wy, wz]
 
 	dt := m.dT
 
-	// 1. Вычисляем следующее состояние
-	n := x.Len()
-	xNext := mat.NewVecDense(n, nil)
+	// 1. Вычисляем следующее состояние; смещения и блоки, неизвестные модели, считаем постоянными
+	xNext := mat.VecDenseCopyOf(x)
 
 	// 2. Извлечение управления с компенсацией смещений
-	ax := u.AtVec(0) - x.AtVec(10) // ускорение X (с компенсацией смещения)
-	ay := u.AtVec(1) - x.AtVec(11) // ускорение Y (с компенсацией смещения)
-	az := u.AtVec(2) - x.AtVec(12) // ускорение Z (с компенсацией смещения)
-	wx := u.AtVec(3) - x.AtVec(13) // угловая скорость X (с компенсацией смещения)
-	wy := u.AtVec(4) - x.AtVec(14) // угловая скорость Y (с компенсацией смещения)
-	wz := u.AtVec(5) - x.AtVec(15) // угловая скорость Z (с компенсацией смещения)
+	ba := block3(x, m.biasAcc)
+	bw := block3(x, m.biasGyro)
+	ax := u.AtVec(0) - ba[0] // ускорение X (с компенсацией смещения)
+	ay := u.AtVec(1) - ba[1] // ускорение Y (с компенсацией смещения)
+	az := u.AtVec(2) - ba[2] // ускорение Z (с компенсацией смещения)
+	wx := u.AtVec(3) - bw[0] // угловая скорость X (с компенсацией смещения)
+	wy := u.AtVec(4) - bw[1] // угловая скорость Y (с компенсацией смещения)
+	wz := u.AtVec(5) - bw[2] // угловая скорость Z (с компенсацией смещения)
 
 	// 3. Преобразование ускорений из локальной системы датчика в глобальную систему координат (ENU) с помощью кватерниона
 	// Извлечение кватерниона ориентации из текущего состояния
-	q := Quaternion{
-		W: x.AtVec(6),
-		X: x.AtVec(7),
-		Y: x.AtVec(8),
-		Z: x.AtVec(9),
-	}
+	q := quaternionAt(x, m.att)
 
 	accRotated := rotateVectorByQuaternion(
 		[3]float64{ax, ay, az},
@@ -81,14 +112,15 @@ func (m *PositionModel) Propagate(x, u, w mat.Vector) (mat.Vector, error) {
 	)
 
 	// 4. Интегрирование ускорений для получения скорости
-	newVx := x.AtVec(3) + accRotated[0]*dt
-	newVy := x.AtVec(4) + accRotated[1]*dt
-	newVz := x.AtVec(5) + (accRotated[2]-m.gravity)*dt
+	p, v := block3(x, m.pos), block3(x, m.vel)
+	newVx := v[0] + accRotated[0]*dt
+	newVy := v[1] + accRotated[1]*dt
+	newVz := v[2] + (accRotated[2]-m.gravity)*dt
 
 	// 5. Интегрирование скорости для получения позиции
-	newX := x.AtVec(0) + x.AtVec(3)*dt + 0.5*accRotated[0]*dt*dt
-	newY := x.AtVec(1) + x.AtVec(4)*dt + 0.5*accRotated[1]*dt*dt
-	newZ := x.AtVec(2) + x.AtVec(5)*dt + 0.5*(accRotated[2]-m.gravity)*dt*dt
+	newX := p[0] + v[0]*dt + 0.5*accRotated[0]*dt*dt
+	newY := p[1] + v[1]*dt + 0.5*accRotated[1]*dt*dt
+	newZ := p[2] + v[2]*dt + 0.5*(accRotated[2]-m.gravity)*dt*dt
 
 	// 6. Обновление ориентации с помощью кватернионов
 	// Вычисляем дельта-кватернион из угловой скорости
@@ -101,22 +133,16 @@ func (m *PositionModel) Propagate(x, u, w mat.Vector) (mat.Vector, error) {
 	qNew = normalizeQuaternion(qNew)
 
 	// 7. Обновление состояния
-	xNext.SetVec(0, newX)
-	xNext.SetVec(1, newY)
-	xNext.SetVec(2, newZ)
-	xNext.SetVec(3, newVx)
-	xNext.SetVec(4, newVy)
-	xNext.SetVec(5, newVz)
-	xNext.SetVec(6, qNew.W)
-	xNext.SetVec(7, qNew.X)
-	xNext.SetVec(8, qNew.Y)
-	xNext.SetVec(9, qNew.Z)
-	xNext.SetVec(10, x.AtVec(10)) // смещения считаем постоянными
-	xNext.SetVec(11, x.AtVec(11))
-	xNext.SetVec(12, x.AtVec(12))
-	xNext.SetVec(13, x.AtVec(13)) // смещения считаем постоянными
-	xNext.SetVec(14, x.AtVec(14))
-	xNext.SetVec(14, x.AtVec(15))
+	xNext.SetVec(m.pos, newX)
+	xNext.SetVec(m.pos+1, newY)
+	xNext.SetVec(m.pos+2, newZ)
+	xNext.SetVec(m.vel, newVx)
+	xNext.SetVec(m.vel+1, newVy)
+	xNext.SetVec(m.vel+2, newVz)
+	xNext.SetVec(m.att, qNew.W)
+	xNext.SetVec(m.att+1, qNew.X)
+	xNext.SetVec(m.att+2, qNew.Y)
+	xNext.SetVec(m.att+3, qNew.Z)
 
 	// 8. Добавляем шум процесса
 	if w != nil {
@@ -133,27 +159,21 @@ func (m *PositionModel) Observe(x, u, v mat.Vector) (mat.Vector, error) {
 	y := mat.NewVecDense(4, nil)
 
 	// 2. Извлечение скоростей из текущего состояния
-	Vx := x.AtVec(3)
-	Vy := x.AtVec(4)
-	Vz := x.AtVec(5)
+	vel := block3(x, m.vel)
 
 	// 3. Извлечение кватерниона ориентации из текущего состояния и преобразуем его в сопряженный для перевода скорости из системы ENU в систему объекта
 	// q_ : ENU -> car
-	q_ := Quaternion{
-		W: x.AtVec(6),
-		X: -x.AtVec(7),
-		Y: -x.AtVec(8),
-		Z: -x.AtVec(9),
-	}
+	q_ := conjugate(quaternionAt(x, m.att))
 
 	// 4. GNSS уже преобразован в метры в системе ENU
-	y.SetVec(0, x.AtVec(0))
-	y.SetVec(1, x.AtVec(1))
-	y.SetVec(2, x.AtVec(2))
+	pos := block3(x, m.pos)
+	y.SetVec(0, pos[0])
+	y.SetVec(1, pos[1])
+	y.SetVec(2, pos[2])
 
 	// 5. Вычисление скорости спидометра
 	velRotated := rotateVectorByQuaternion(
-		[3]float64{Vx, Vy, Vz},
+		vel,
 		q_,
 	)
 
@@ -166,3 +186,21 @@ func (m *PositionModel) Observe(x, u, v mat.Vector) (mat.Vector, error) {
 
 	return y, nil
 }
+
+// block3 возвращает блок из 3 элементов состояния с индекса i (нули - блока нет)
+func block3(x mat.Vector, i int) [3]float64 {
+	if i < 0 {
+		return [3]float64{}
+	}
+	return [3]float64{x.AtVec(i), x.AtVec(i + 1), x.AtVec(i + 2)}
+}
+
+// quaternionAt возвращает кватернион состояния с индекса i
+func quaternionAt(x mat.Vector, i int) Quaternion {
+	return Quaternion{W: x.AtVec(i), X: x.AtVec(i + 1), Y: x.AtVec(i + 2), Z: x.AtVec(i + 3)}
+}
+
+// conjugate возвращает сопряженный кватернион
+func conjugate(q Quaternion) Quaternion {
+	return Quaternion{W: q.W, X: -q.X, Y: -q.Y, Z: -q.Z}
+}
@@ -0,0 +1,197 @@
+package models
+
+import (
+	"math"
+
+	"gonum.org/v1/gonum/mat"
+)
+
+// StateJacobian возвращает аналитический якобиан F = ∂Propagate/∂x
+func (m *PositionModel) StateJacobian(x, u mat.Vector) (*mat.Dense, error) {
+	dt := m.dT
+	n := x.Len()
+	F := mat.NewDense(n, n, nil)
+	for i := 0; i < n; i++ {
+		F.Set(i, i, 1)
+	}
+
+	// Ускорение и угловая скорость с компенсацией смещений
+	ba, bw := block3(x, m.biasAcc), block3(x, m.biasGyro)
+	a := [3]float64{u.AtVec(0) - ba[0], u.AtVec(1) - ba[1], u.AtVec(2) - ba[2]}
+	w := [3]float64{u.AtVec(3) - bw[0], u.AtVec(4) - bw[1], u.AtVec(5) - bw[2]}
+	q := quaternionAt(x, m.att)
+
+	// accRotated = M(q)·a: ∂/∂a = M(q), ∂/∂q - столбцы dM/dq_k·a
+	M := rotationMatrix(q)
+	dMa := rotationMatrixDerivative(q, a)
+
+	p, v, att := m.pos, m.vel, m.att
+	for i := 0; i < 3; i++ {
+		// Позиция: p + v·dt + 0.5·M·a·dt²
+		F.Set(p+i, v+i, dt)
+		for k := 0; k < 4; k++ {
+			F.Set(p+i, att+k, 0.5*dt*dt*dMa[i][k])
+			F.Set(v+i, att+k, dt*dMa[i][k])
+		}
+		// Скорость: v + M·a·dt; a = u - bias_acc
+		if m.biasAcc < 0 {
+			continue
+		}
+		for j := 0; j < 3; j++ {
+			F.Set(p+i, m.biasAcc+j, -0.5*dt*dt*M[i][j])
+			F.Set(v+i, m.biasAcc+j, -dt*M[i][j])
+		}
+	}
+
+	// Кватернион: q_new = norm(q ⊗ δq(ω))
+	dq := calculateDeltaQuaternion(w[0], w[1], w[2], dt)
+	raw := quaternionMultiply(q, dq)
+	N := normalizationJacobian(raw)
+
+	// ∂(q ⊗ δq)/∂q - матрица правого умножения на δq
+	Rdq := [4][4]float64{
+		{dq.W, -dq.X, -dq.Y, -dq.Z},
+		{dq.X, dq.W, dq.Z, -dq.Y},
+		{dq.Y, -dq.Z, dq.W, dq.X},
+		{dq.Z, dq.Y, -dq.X, dq.W},
+	}
+	// ∂(q ⊗ δq)/∂δq - матрица левого умножения на q
+	Lq := [4][4]float64{
+		{q.W, -q.X, -q.Y, -q.Z},
+		{q.X, q.W, -q.Z, q.Y},
+		{q.Y, q.Z, q.W, -q.X},
+		{q.Z, -q.Y, q.X, q.W},
+	}
+	Ddq := deltaQuaternionJacobian(w, dt)
+
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			v := 0.0
+			for k := 0; k < 4; k++ {
+				v += N[i][k] * Rdq[k][j]
+			}
+			F.Set(att+i, att+j, v)
+		}
+		// ω = u - bias_gyro
+		if m.biasGyro < 0 {
+			continue
+		}
+		for j := 0; j < 3; j++ {
+			v := 0.0
+			for k := 0; k < 4; k++ {
+				for l := 0; l < 4; l++ {
+					v += N[i][k] * Lq[k][l] * Ddq[l][j]
+				}
+			}
+			F.Set(att+i, m.biasGyro+j, -v)
+		}
+	}
+
+	return F, nil
+}
+
+// ObservationJacobian возвращает аналитический якобиан H = ∂Observe/∂x
+func (m *PositionModel) ObservationJacobian(x, u mat.Vector) (*mat.Dense, error) {
+	H := mat.NewDense(m.outputDim, x.Len(), nil)
+
+	// Позиция ENU
+	for i := 0; i < 3; i++ {
+		H.Set(i, m.pos+i, 1)
+	}
+
+	// Скорость спидометра - компонента Y вектора скорости в системе объекта (поворот сопряженным кватернионом)
+	v := block3(x, m.vel)
+	qc := conjugate(quaternionAt(x, m.att))
+
+	M := rotationMatrix(qc)
+	for j := 0; j < 3; j++ {
+		H.Set(3, m.vel+j, M[1][j])
+	}
+
+	// ∂/∂q через сопряженный кватернион: ∂q_c/∂q = diag(1, -1, -1, -1)
+	dMv := rotationMatrixDerivative(qc, v)
+	sign := [4]float64{1, -1, -1, -1}
+	for k := 0; k < 4; k++ {
+		H.Set(3, m.att+k, sign[k]*dMv[1][k])
+	}
+
+	return H, nil
+}
+
+// rotationMatrix матрица отображения v -> q ⊗ v ⊗ q* (для ненормированного q масштабирована на |q|²)
+func rotationMatrix(q Quaternion) [3][3]float64 {
+	w, x, y, z := q.W, q.X, q.Y, q.Z
+	return [3][3]float64{
+		{w*w + x*x - y*y - z*z, 2 * (x*y - w*z), 2 * (x*z + w*y)},
+		{2 * (x*y + w*z), w*w - x*x + y*y - z*z, 2 * (y*z - w*x)},
+		{2 * (x*z - w*y), 2 * (y*z + w*x), w*w - x*x - y*y + z*z},
+	}
+}
+
+// rotationMatrixDerivative возвращает ∂(M(q)·v)/∂q: строка - компонента результата, столбец - w, x, y, z
+func rotationMatrixDerivative(q Quaternion, v [3]float64) [3][4]float64 {
+	w, x, y, z := q.W, q.X, q.Y, q.Z
+	dM := [4][3][3]float64{
+		{{w, -z, y}, {z, w, -x}, {-y, x, w}}, // ∂M/∂w
+		{{x, y, z}, {y, -x, -w}, {z, w, -x}}, // ∂M/∂x
+		{{-y, x, w}, {x, y, z}, {-w, z, -y}}, // ∂M/∂y
+		{{-z, -w, x}, {w, -z, y}, {x, y, z}}, // ∂M/∂z
+	}
+
+	var d [3][4]float64
+	for k := 0; k < 4; k++ {
+		for i := 0; i < 3; i++ {
+			d[i][k] = 2 * (dM[k][i][0]*v[0] + dM[k][i][1]*v[1] + dM[k][i][2]*v[2])
+		}
+	}
+	return d
+}
+
+// deltaQuaternionJacobian возвращает ∂δq/∂ω для calculateDeltaQuaternion
+func deltaQuaternionJacobian(w [3]float64, dt float64) [4][3]float64 {
+	var d [4][3]float64
+
+	n := math.Sqrt(w[0]*w[0] + w[1]*w[1] + w[2]*w[2])
+	if n < 1e-12 {
+		// Предел при ω -> 0: δq ≈ (1, ω·dt/2)
+		for j := 0; j < 3; j++ {
+			d[1+j][j] = dt / 2
+		}
+		return d
+	}
+
+	s, c := math.Sincos(n * dt / 2)
+	for j := 0; j < 3; j++ {
+		d[0][j] = -s * dt / 2 * w[j] / n
+		for i := 0; i < 3; i++ {
+			v := w[i] * w[j] * (c*dt/2*n - s) / (n * n * n)
+			if i == j {
+				v += s / n
+			}
+			d[1+i][j] = v
+		}
+	}
+	return d
+}
+
+// normalizationJacobian возвращает ∂(q/|q|)/∂q = (I - q̂·q̂ᵀ)/|q|
+func normalizationJacobian(q Quaternion) [4][4]float64 {
+	var d [4][4]float64
+
+	norm := math.Sqrt(q.W*q.W + q.X*q.X + q.Y*q.Y + q.Z*q.Z)
+	if norm < 1e-12 {
+		return d
+	}
+
+	qh := [4]float64{q.W / norm, q.X / norm, q.Y / norm, q.Z / norm}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			v := -qh[i] * qh[j]
+			if i == j {
+				v += 1
+			}
+			d[i][j] = v / norm
+		}
+	}
+	return d
+}
@@ -28,6 +28,21 @@ type GNSSData struct {
 	Altitude  float64   // Высота (метры)
 	Speed     float64   // Скорость (м/с)
 	Heading   float64   // Направление (градусы)
+
+	// Наличие необязательных полей в отсчете (false - поле не пришло, значение нулевое)
+	HasAltitude, HasSpeed, HasHeading bool
+
+	FixQuality int     // Качество решения (GGA: 0 - нет, 1 - GPS, 2 - DGPS, 4 - RTK fixed, 5 - RTK float)
+	FixType    int     // Тип решения (GSA: 1 - нет, 2 - 2D, 3 - 3D)
+	Satellites int     // Число спутников в решении
+	HDOP       float64 // Горизонтальный геометрический фактор
+	VDOP       float64 // Вертикальный геометрический фактор
+	PDOP       float64 // Пространственный геометрический фактор
+
+	HorizontalAccuracy float64 // Оценка точности в плане (метры, 0 - неизвестна)
+	VerticalAccuracy   float64 // Оценка точности по высоте (метры, 0 - неизвестна)
+	SpeedAccuracy      float64 // Оценка точности скорости (м/с, 0 - неизвестна)
+	BearingAccuracy    float64 // Оценка точности направления (градусы, 0 - неизвестна)
 }
 
 // EstimatedState представляет оцененное состояние
@@ -51,16 +66,54 @@ type EstimatedState struct {
 	CovarianceQyQy float64 // Дисперсия кватерниона Y
 	CovarianceQzQz float64 // Дисперсия кватерниона Z
 
+	Gating   []GateDecision // Решения проверки невязок измерений эпохи (nil - без коррекции)
+	Rejected int            // Число отброшенных измерений с начала работы
+	Modes    []float64      // Вероятности режимов IMM (nil - без IMM)
+
+	Lagged *EstimatedState // Сглаженная оценка с фиксированной задержкой (nil - выключено или окно не заполнено)
 }
 
+// Решения проверки невязки измерения
+const (
+	GateAccepted = "accepted" // Измерение применено
+	GateRejected = "rejected" // Измерение отброшено
+	GateInflated = "inflated" // Измерение применено с увеличенным шумом
+)
+
+// GateDecision решение проверки невязки одного измерения
+type GateDecision struct {
+	Type      string  // Тип измерения
+	Distance2 float64 // Квадрат расстояния Махаланобиса невязки (NIS)
+	Threshold float64 // Порог (0 - проверка выключена)
+	Action    string  // accepted, rejected, inflated
+	Scale     float64 // Множитель ковариации шума измерения
+}
+
+// SensorSource датчик, отсчет которого породил событие синхронизации
+type SensorSource string
+
+const (
+	SourceACC  SensorSource = "acc"
+	SourceGYRO SensorSource = "gyro"
+	SourceGNSS SensorSource = "gnss"
+)
+
 // SynchronizedData представляет синхронизированные данные
 type SynchronizedData struct {
 	Timestamp time.Time
+	Source    SensorSource // Датчик, отсчет которого породил событие
 	// IMU данные
+	HasIMU                 bool // false - разрыв в потоке IMU (только для событий GNSS)
 	AccelX, AccelY, AccelZ float64
 	GyroX, GyroY, GyroZ    float64
 	// GNSS данные (если есть)
-	HasGNSS                       bool
-	Latitude, Longitude, Altitude float64
-	Speed                         float64
+	HasGNSS                           bool
+	Latitude, Longitude, Altitude     float64
+	Speed                             float64
+	Heading                           float64 // Курс, градусы от севера по часовой стрелке
+	HasAltitude, HasSpeed, HasHeading bool    // Наличие высоты, скорости и курса в отсчете GNSS
+	// Оценки точности GNSS (0 - неизвестна)
+	HorizontalAccuracy, VerticalAccuracy float64 // метры
+	SpeedAccuracy                        float64 // м/с
+	BearingAccuracy                      float64 // градусы
 }
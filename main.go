@@ -2,8 +2,16 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"iter"
 	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
 	"main.go/config"
 	"main.go/internal/fuzzer"
@@ -12,56 +20,248 @@ import (
 	"main.go/data_processor"
 )
 
+// options параметры запуска
+type options struct {
+	config             string
+	resume             string        // Контрольная точка, с которой продолжается обработка
+	checkpoint         string        // Файл сохраняемой контрольной точки
+	checkpointInterval time.Duration // Период сохранения по времени данных (0 - только в конце обработки)
+}
+
 func main() {
+	var opts options
+	flag.StringVar(&opts.config, "config", "config/config.yaml", "файл конфигурации")
+	flag.StringVar(&opts.resume, "resume", "", "продолжить обработку с контрольной точки из файла")
+	flag.StringVar(&opts.checkpoint, "checkpoint", "", "сохранять контрольную точку в файл")
+	flag.DurationVar(&opts.checkpointInterval, "checkpoint-interval", 0, "период сохранения контрольной точки по времени данных (0 - только в конце обработки)")
+	flag.Parse()
+
 	// 1. Загрузка конфигурации
-	cfg, err := config.LoadConfig("config/config.yaml")
+	cfg, err := config.LoadConfig(opts.config)
 	if err != nil {
 		log.Fatal("Ошибка загрузки конфигурации:", err)
 	}
 
 	// 2. Чтение данных
-	// Чтение данных датчиков
-	accData, err := data_processor.ReadAccelerometerCSV("data/acc_31_07.csv")
+	// Потоки данных датчиков читаются по мере обработки, без загрузки файлов целиком
+	accFile, err := os.Open(cfg.Sensors.Accelerometer.File)
 	if err != nil {
 		log.Fatal("Ошибка чтения данных акселерометра:", err)
 	}
+	defer accFile.Close()
 
-	gyroData, err := data_processor.ReadGyroCSV("data/gyro_31_07.csv")
+	gyroFile, err := os.Open(cfg.Sensors.Gyroscope.File)
 	if err != nil {
-		log.Fatal("Ошибка чтения данных акселерометра:", err)
+		log.Fatal("Ошибка чтения данных гироскопа:", err)
 	}
+	defer gyroFile.Close()
 
-	gnssData, err := data_processor.ReadGNSSDataCSV("data/gnss_31_07.csv")
+	gnssFile, err := os.Open(cfg.Sensors.GNSS.File)
 	if err != nil {
 		log.Fatal("Ошибка чтения данных GNSS:", err)
 	}
+	defer gnssFile.Close()
+
+	// Итоги разбора: в мягком режиме сюда попадают отброшенные записи
+	var accReport, gyroReport, gnssReport data_processor.ParseReport
 
-	fmt.Printf("\nЗагружено %d записей акселерометра\n", len(accData))
-	fmt.Printf("Загружено %d записей гироскопа\n", len(gyroData))
-	fmt.Printf("Загружено %d записей GNSS\n", len(gnssData))
+	accData := data_processor.StreamAccelerometer(accFile, cfg.Sensors.Accelerometer.File, cfg, &accReport)
+	gyroData := data_processor.StreamGyro(gyroFile, cfg.Sensors.Gyroscope.File, cfg, &gyroReport)
+	gnssData := data_processor.StreamGNSS(gnssFile, cfg.Sensors.GNSS.File, cfg, &gnssReport)
+
+	// Поправка часов GNSS к шкале IMU
+	clock, err := data_processor.ClockCorrection(cfg)
+	if errors.Is(err, data_processor.ErrClockOffset) {
+		log.Printf("Смещение часов не оценено, используется заданное в конфигурации: %v", err)
+		clock = data_processor.ClockModel{Offset: cfg.Sensors.Clock.Offset, Drift: cfg.Sensors.Clock.Drift}
+	} else if err != nil {
+		log.Fatal("Ошибка оценки смещения часов GNSS:", err)
+	}
+	fmt.Println(clock)
+	gnssData = data_processor.CorrectGNSSClock(gnssData, clock)
 
 	// 3. Синхронизируем данные всех датчиков
-	syncedData, err := data_processor.ReadGNSSDataCSV_1(accData, gyroData, gnssData, cfg)
+	syncedData := data_processor.SynchronizeStream(accData, gyroData, gnssData, cfg)
 
 	// 4. Основной цикл обработки
+	count, err := runNavigation(syncedData, cfg, opts)
+	if err != nil {
+		log.Fatal("Ошибка обработки данных:", err)
+	}
 
-	runNavigation(syncedData, cfg)
+	for _, report := range []*data_processor.ParseReport{&accReport, &gyroReport, &gnssReport} {
+		if report.Dropped > 0 {
+			fmt.Println(report)
+		}
+	}
 
-	fmt.Printf("Состояние: X=%d\n", len(accData))
+	fmt.Printf("Получено оценок состояния: %d\n", count)
 
 }
 
-func runNavigation(syncedData []models.SynchronizedData, cfg *config.Config) ([]models.EstimatedState, error) {
+func runNavigation(syncedData iter.Seq2[models.SynchronizedData, error], cfg *config.Config, opts options) (int, error) {
 
 	fmt.Println("Запуск навигационной системы...")
 
 	// 1. Создание процессора данных
 	fuzzer := fuzzer.NewFuzzer(cfg)
+	// При продолжении с контрольной точки таблицы дописываются в файлы прерванной обработки
+	resume := opts.resume != ""
+	if file := cfg.EKF.Diagnostics.File; cfg.EKF.Diagnostics.Enabled && file != "" {
+		out, err := createFile(file, resume)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания файла диагностики: %v", err)
+		}
+		defer out.Close()
+		fuzzer.SetDiagnosticsOutput(out)
+	}
+	if file := cfg.EKF.AdaptiveNoise.File; cfg.EKF.AdaptiveNoise.Enabled && file != "" {
+		out, err := createFile(file, resume)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания файла адаптированных шумов: %v", err)
+		}
+		defer out.Close()
+		fuzzer.SetAdaptiveNoiseOutput(out)
+	}
+	if file := cfg.EKF.IMM.File; cfg.EKF.IMM.Enabled && file != "" {
+		out, err := createFile(file, resume)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания файла вероятностей режимов: %v", err)
+		}
+		defer out.Close()
+		fuzzer.SetIMMOutput(out)
+	}
+	if resume {
+		if err := fuzzer.LoadCheckpoint(opts.resume); err != nil {
+			return 0, fmt.Errorf("ошибка загрузки контрольной точки: %v", err)
+		}
+		fmt.Printf("Обработка продолжена с контрольной точки %s\n", opts.resume)
+	}
+
+	// Таблицы оценок фильтра и оценок, сглаженных с задержкой
+	var output, laggedOutput *models.StateWriter
+	if file := cfg.EKF.Output; file != "" {
+		out, w, err := createStateFile(file, resume)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания файла оценок: %v", err)
+		}
+		defer out.Close()
+		output = w
+	}
+	if file := cfg.EKF.Smoother.LagFile; cfg.EKF.Smoother.Lag > 0 && file != "" {
+		out, w, err := createStateFile(file, resume)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка создания файла оценок, сглаженных с задержкой: %v", err)
+		}
+		defer out.Close()
+		laggedOutput = w
+	}
 
 	//2.  Обработка данных
-	results, err := fuzzer.Process(syncedData)
-	if err != nil {
-		log.Fatal("Ошибка обработки данных:", err)
+	count := 0
+	var lastCheckpoint time.Time
+	lagged := 0 // Число оценок, сглаженных с задержкой
+	var lastLagged *models.EstimatedState
+	for state, err := range fuzzer.ProcessStream(syncedData) {
+		if err != nil {
+			return count, err
+		}
+		count++
+		if output != nil {
+			if err := output.Write(&state); err != nil {
+				return count, fmt.Errorf("ошибка сохранения оценки: %v", err)
+			}
+		}
+		if state.Lagged != nil {
+			lagged++
+			lastLagged = state.Lagged
+			if laggedOutput != nil {
+				if err := laggedOutput.Write(state.Lagged); err != nil {
+					return count, fmt.Errorf("ошибка сохранения оценки, сглаженной с задержкой: %v", err)
+				}
+			}
+		}
+
+		if opts.checkpoint == "" || opts.checkpointInterval <= 0 {
+			continue
+		}
+		if lastCheckpoint.IsZero() {
+			lastCheckpoint = state.Timestamp
+		} else if state.Timestamp.Sub(lastCheckpoint) >= opts.checkpointInterval {
+			if err := flushOutputs(fuzzer, output, laggedOutput); err != nil {
+				return count, err
+			}
+			if err := fuzzer.SaveCheckpoint(opts.checkpoint); err != nil {
+				return count, fmt.Errorf("ошибка сохранения контрольной точки: %v", err)
+			}
+			lastCheckpoint = state.Timestamp
+		}
+	}
+
+	if err := flushOutputs(fuzzer, output, laggedOutput); err != nil {
+		return count, err
+	}
+	if opts.checkpoint != "" {
+		if err := fuzzer.SaveCheckpoint(opts.checkpoint); err != nil {
+			return count, fmt.Errorf("ошибка сохранения контрольной точки: %v", err)
+		}
+	}
+
+	rejected := fuzzer.Rejected()
+	for _, typ := range slices.Sorted(maps.Keys(rejected)) {
+		fmt.Printf("Отброшено измерений %s: %d\n", typ, rejected[typ])
+	}
+
+	if health, ok := fuzzer.CovarianceHealth(); ok {
+		fmt.Printf("Ковариация: %v\n", health)
+	}
+
+	if adapter := fuzzer.AdaptiveNoise(); adapter != nil {
+		fmt.Println("Адаптированные шумы:")
+		fmt.Println(adapter)
+		if err := adapter.Flush(); err != nil {
+			log.Printf("Ошибка сохранения адаптированных шумов: %v", err)
+		}
+	}
+
+	if imm := fuzzer.IMM(); imm != nil {
+		fmt.Println("Режимы движения (IMM):")
+		fmt.Println(imm)
+		if err := imm.Flush(); err != nil {
+			log.Printf("Ошибка сохранения вероятностей режимов: %v", err)
+		}
+	}
+
+	if lag := cfg.EKF.Smoother.Lag; lag > 0 {
+		fmt.Printf("Сглажено с задержкой %v: %d оценок\n", lag, lagged)
+		if lastLagged != nil {
+			fmt.Printf("Последняя сглаженная с задержкой: %v X_ENU: %f, Y_ENU: %f, Z_ENU: %f\n",
+				lastLagged.Timestamp.Format(time.RFC3339Nano), lastLagged.PositionX, lastLagged.PositionY, lastLagged.PositionZ)
+		}
+	}
+
+	if cfg.EKF.Smoother.Enabled {
+		smoothed, err := fuzzer.Smooth()
+		if err != nil {
+			return count, fmt.Errorf("ошибка сглаживания: %v", err)
+		}
+		fmt.Printf("Сглажено состояний: %d\n", len(smoothed))
+		if n := len(smoothed); n > 0 {
+			fmt.Printf("Сглаженное начало: X_ENU: %f, Y_ENU: %f, Z_ENU: %f\n", smoothed[0].PositionX, smoothed[0].PositionY, smoothed[0].PositionZ)
+		}
+		if file := cfg.EKF.Smoother.File; file != "" {
+			if err := writeStates(file, smoothed); err != nil {
+				log.Printf("Ошибка сохранения сглаженной траектории: %v", err)
+			}
+		}
+	}
+
+	if diagnostics := fuzzer.Diagnostics(); diagnostics != nil {
+		fmt.Println("Согласованность фильтра:")
+		fmt.Println(diagnostics)
+		if err := diagnostics.Flush(); err != nil {
+			log.Printf("Ошибка сохранения диагностики: %v", err)
+		}
 	}
 
 	/*
@@ -122,5 +322,77 @@ func runNavigation(syncedData []models.SynchronizedData, cfg *config.Config) ([]
 			}
 	*/
 
-	return results, nil
+	return count, nil
+}
+
+// writeStates сохраняет оценки состояния в CSV, создавая каталог файла
+func writeStates(file string, states []models.EstimatedState) error {
+	out, w, err := createStateFile(file, false)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for i := range states {
+		if err := w.Write(&states[i]); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// createStateFile создает файл таблицы оценок состояния и записывает ее заголовок
+// (при дописывании в непустой файл заголовок не повторяется)
+func createStateFile(file string, resume bool) (*os.File, *models.StateWriter, error) {
+	out, err := createFile(file, resume)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := models.NewStateWriter(out)
+	if err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return out, w, nil
+}
+
+// createFile создает файл вывода вместе с его каталогом; при продолжении с контрольной точки (resume)
+// существующий файл открывается для дописывания
+func createFile(file string, resume bool) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return nil, err
+	}
+	if resume {
+		return os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	}
+	return os.Create(file)
+}
+
+// flushOutputs дописывает буферизованные строки всех таблиц вывода, чтобы файлы содержали
+// все строки до сохраняемой контрольной точки
+func flushOutputs(f *fuzzer.Fuzzer, states ...*models.StateWriter) error {
+	for _, w := range states {
+		if w == nil {
+			continue
+		}
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("ошибка сохранения оценок: %v", err)
+		}
+	}
+	if d := f.Diagnostics(); d != nil {
+		if err := d.Flush(); err != nil {
+			return fmt.Errorf("ошибка сохранения диагностики: %v", err)
+		}
+	}
+	if a := f.AdaptiveNoise(); a != nil {
+		if err := a.Flush(); err != nil {
+			return fmt.Errorf("ошибка сохранения адаптированных шумов: %v", err)
+		}
+	}
+	if imm := f.IMM(); imm != nil {
+		if err := imm.Flush(); err != nil {
+			return fmt.Errorf("ошибка сохранения вероятностей режимов: %v", err)
+		}
+	}
+	return nil
 }